@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Parses a countdown schedule like "10m,5m,1m,30s" into the times before shutdown to announce at, longest first
+func parseCountdown(schedule string) ([]time.Duration, error) {
+
+	var countdown []time.Duration
+	for _, value := range strings.Split(schedule, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		remaining, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid countdown %q: %v", value, err)
+		}
+		if remaining <= 0 {
+			return nil, fmt.Errorf("countdown %q must be positive", value)
+		}
+		countdown = append(countdown, remaining)
+	}
+
+	slices.Sort(countdown)
+	slices.Reverse(countdown)
+
+	return countdown, nil
+}
+
+// Warns the players of a shutdown over a countdown, optionally takes a final backup, then stops the container
+func announceShutdownCommand(db *sql.DB, args []string) error {
+
+	flags := flag.NewFlagSet("announce-shutdown", flag.ContinueOnError)
+	instanceName := flags.String("instance", "", "Container name of the instance to shut down")
+	minutes := flags.Int("in", 0, "Minutes until the shutdown")
+	schedule := flags.String("schedule", "10m,5m,1m,30s", "Comma separated times before the shutdown to announce at, longer than --in are ignored")
+	message := flags.String("message", "Server shutting down for maintenance in {remaining}", "Announcement, {remaining} is replaced with the time left")
+	finalMessage := flags.String("final-message", "Server shutting down now", "Announcement made when the countdown ends")
+	backup := flags.Bool("backup", false, "Take a backup when the countdown ends, before stopping the container")
+	stop := flags.Bool("stop", true, "Stop the container when the countdown ends")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *instanceName == "" {
+		return fmt.Errorf("--instance is required")
+	}
+	if *minutes < 0 {
+		return fmt.Errorf("--in can't be negative")
+	}
+
+	countdown, err := parseCountdown(*schedule)
+	if err != nil {
+		return err
+	}
+
+	instance, err := getInstanceByName(db, *instanceName)
+	if err != nil {
+		return err
+	}
+
+	// Check the backup can work now, rather than finding out once the players have been told to leave
+	if *backup {
+		err = checkAWSCLI()
+		if err != nil {
+			return err
+		}
+		err = validateInstance(instance)
+		if err != nil {
+			return err
+		}
+	}
+
+	shutdown := time.Now().Add(time.Duration(*minutes) * time.Minute)
+
+	announce := func(remaining time.Duration) {
+		text := strings.ReplaceAll(*message, "{remaining}", formatRemaining(remaining))
+		log.Printf("%v: %v\n", instance.containerName, text)
+		err := say(text, instance)
+		if err != nil {
+			log.Printf("%v: Could not announce shutdown: %v\n", instance.containerName, err)
+		}
+	}
+
+	// Always tell the players when the countdown starts, even if that's between two scheduled announcements
+	total := time.Duration(*minutes) * time.Minute
+	if total > 0 && !slices.Contains(countdown, total) {
+		announce(total)
+	}
+
+	for _, remaining := range countdown {
+		at := shutdown.Add(-remaining)
+		if time.Until(at) < 0 {
+			continue
+		}
+		time.Sleep(time.Until(at))
+		announce(remaining)
+	}
+
+	time.Sleep(time.Until(shutdown))
+
+	log.Printf("%v: %v\n", instance.containerName, *finalMessage)
+	err = say(*finalMessage, instance)
+	if err != nil {
+		log.Printf("%v: Could not announce shutdown: %v\n", instance.containerName, err)
+	}
+
+	if *backup {
+		err = backupInstance(context.Background(), db, instance)
+		if err != nil {
+			return fmt.Errorf("final backup failed, leaving %v running: %v", instance.containerName, err)
+		}
+	}
+
+	if *stop {
+		err = stopContainerAndWait(instance.containerName, time.Duration(instance.stopTimeoutSeconds)*time.Second)
+		if err != nil {
+			return err
+		}
+		log.Printf("%v: Stopped\n", instance.containerName)
+	}
+
+	return nil
+}
+
+// Formats the time left for players, e.g. "5 minutes" or "30 seconds"
+func formatRemaining(remaining time.Duration) string {
+
+	if remaining >= time.Minute && remaining%time.Minute == 0 {
+		if remaining == time.Minute {
+			return "1 minute"
+		}
+		return fmt.Sprintf("%d minutes", remaining/time.Minute)
+	}
+
+	seconds := int(remaining.Round(time.Second) / time.Second)
+	if seconds == 1 {
+		return "1 second"
+	}
+	return fmt.Sprintf("%d seconds", seconds)
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultLogLines = 100               // Lines returned by /logs when ?lines isn't given
+const maxLogLines = 5000                  // Most lines /logs will return
+const logStreamPollInterval = time.Second // How often /logs/stream checks the log file for new lines
+
+// Starts the HTTP API in the background
+// Every endpoint requires the bearer token, so the API refuses to start without one
+// Backups triggered through it are cancelled with ctx like the scheduled ones, and added to backups so a shutdown waits for them
+func startAPIServer(ctx context.Context, address string, token string, logFilePath string, db *sql.DB, backups *sync.WaitGroup) (*http.Server, error) {
+
+	if token == "" {
+		return nil, fmt.Errorf("an API token is required to enable the API")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /logs", requireToken(token, logsHandler(logFilePath)))
+	mux.HandleFunc("GET /logs/stream", requireToken(token, logStreamHandler(logFilePath)))
+	mux.HandleFunc("GET /instances", requireToken(token, instancesHandler(db)))
+	mux.HandleFunc("POST /instances/{id}/backup", requireToken(token, backupHandler(ctx, db, backups)))
+	mux.HandleFunc("GET /saves", requireToken(token, savesHandler(db)))
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("API server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("API listening on %v", address)
+	return server, nil
+}
+
+// Stops the API server, giving requests in flight a moment to finish
+// Manual backups are waited for before this, so only the read endpoints are cut short
+func stopAPIServer(server *http.Server) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Could not stop API server: %v", err)
+	}
+}
+
+// Rejects requests that don't carry "Authorization: Bearer <token>"
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provided, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// GET /logs?lines=N returns the last N lines of the log file
+func logsHandler(logFilePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		lines := defaultLogLines
+		if value := r.URL.Query().Get("lines"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				http.Error(w, "lines must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			lines = min(parsed, maxLogLines)
+		}
+
+		tail, err := tailFile(logFilePath, lines)
+		if err != nil {
+			log.Printf("Could not read log file: %v", err)
+			http.Error(w, "could not read log file", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range tail {
+			_, _ = fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// GET /logs/stream follows the log file and sends each new line as a server-sent event
+func logStreamHandler(logFilePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		file, err := os.Open(logFilePath)
+		if err != nil {
+			log.Printf("Could not open log file: %v", err)
+			http.Error(w, "could not read log file", http.StatusInternalServerError)
+			return
+		}
+		// file is replaced when the log is rotated
+		defer func() {
+			_ = file.Close()
+		}()
+
+		// Only lines written from now on are streamed
+		offset, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			http.Error(w, "could not read log file", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		reader := bufio.NewReader(file)
+		partial := ""
+
+		for {
+			line, err := reader.ReadString('\n')
+			offset += int64(len(line))
+
+			if err == io.EOF {
+				partial += line
+
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(logStreamPollInterval):
+				}
+
+				// Start over if the log file was truncated, or follow the new file once it was rotated
+				stats, statErr := os.Stat(logFilePath)
+				current, currentErr := file.Stat()
+				if statErr != nil || currentErr != nil {
+					continue
+				}
+				rotated := !os.SameFile(stats, current)
+				if rotated {
+					reopened, err := os.Open(logFilePath)
+					if err != nil {
+						continue
+					}
+					_ = file.Close()
+					file = reopened
+				}
+				if rotated || stats.Size() < offset {
+					_, _ = file.Seek(0, io.SeekStart)
+					reader.Reset(file)
+					offset = 0
+					partial = ""
+				}
+				continue
+			}
+			if err != nil {
+				log.Printf("Could not read log file: %v", err)
+				return
+			}
+
+			_, err = fmt.Fprintf(w, "data: %v\n\n", strings.TrimRight(partial+line, "\r\n"))
+			if err != nil {
+				return
+			}
+			partial = ""
+			flusher.Flush()
+		}
+	}
+}
+
+// Per-instance locks held for the whole of a backup, so one triggered through the API and the scheduled one never run at once
+type instanceLocks struct {
+	mu    sync.Mutex
+	locks map[int]*sync.Mutex
+}
+
+var backupLocks = &instanceLocks{locks: make(map[int]*sync.Mutex)}
+
+// Returns the instance's lock, creating it the first time
+func (l *instanceLocks) get(instanceID int) *sync.Mutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, ok := l.locks[instanceID]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[instanceID] = lock
+	}
+	return lock
+}
+
+// Per-working-path locks, since instances sharing a working path would write their archives and canaries over each other
+// Every backup takes its instance's lock from backupLocks first and then this one, so the two can't deadlock
+type workingPathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+var pathLocks = &workingPathLocks{locks: make(map[string]*sync.Mutex)}
+
+// Returns the working path's lock, creating it the first time
+func (l *workingPathLocks) get(workingPath string) *sync.Mutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, ok := l.locks[workingPath]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[workingPath] = lock
+	}
+	return lock
+}
+
+// An instance as returned by GET /instances
+type apiInstance struct {
+	ID                    int    `json:"id"`
+	ContainerName         string `json:"container_name"`
+	Description           string `json:"description"`
+	Active                bool   `json:"active"`
+	ServerType            string `json:"server_type"`
+	Backend               string `json:"backend"`
+	S3Bucket              string `json:"s3_bucket"`
+	Prefix                string `json:"prefix"`
+	BackupIntervalMinutes int    `json:"backup_interval_minutes"`
+}
+
+// The outcome of POST /instances/{id}/backup
+type apiBackupResult struct {
+	Instance string  `json:"instance"`
+	Result   string  `json:"result"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Printf("Could not write API response: %v", err)
+	}
+}
+
+// GET /instances returns every instance, active or not
+func instancesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		instances, err := getInstances(db)
+		if err != nil {
+			log.Printf("Could not get instances: %v", err)
+			http.Error(w, "could not get instances", http.StatusInternalServerError)
+			return
+		}
+
+		response := []apiInstance{}
+		for _, instance := range instances {
+			response = append(response, apiInstance{
+				ID:                    instance.id,
+				ContainerName:         instance.containerName,
+				Description:           instance.description,
+				Active:                instance.active,
+				ServerType:            instance.serverType,
+				Backend:               instance.backend,
+				S3Bucket:              instance.s3Bucket,
+				Prefix:                instance.prefix,
+				BackupIntervalMinutes: instance.backupIntervalMinutes,
+			})
+		}
+
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// Returns the instance with the ID, or an error that can be shown to the client
+func apiInstanceByID(db *sql.DB, value string) (Instance, int, error) {
+
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return Instance{}, http.StatusBadRequest, fmt.Errorf("invalid instance id %q", value)
+	}
+
+	instances, err := getInstances(db)
+	if err != nil {
+		log.Printf("Could not get instances: %v", err)
+		return Instance{}, http.StatusInternalServerError, fmt.Errorf("could not get instances")
+	}
+
+	for _, instance := range instances {
+		if instance.id == id {
+			return instance, http.StatusOK, nil
+		}
+	}
+
+	return Instance{}, http.StatusNotFound, fmt.Errorf("no instance with id %d", id)
+}
+
+// POST /instances/{id}/backup backs the instance up now and responds once it is done
+// It answers 409 if the instance is already being backed up, rather than queueing a second backup behind the first,
+// and 422 for instances the loop wouldn't back up on their own: inactive, grouped or sharing another's storage location
+func backupHandler(ctx context.Context, db *sql.DB, backups *sync.WaitGroup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		instance, status, err := apiInstanceByID(db, r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if !instance.active {
+			http.Error(w, fmt.Sprintf("%v is inactive", instance.containerName), http.StatusUnprocessableEntity)
+			return
+		}
+		if instance.groupID != 0 {
+			http.Error(w, fmt.Sprintf("%v is backed up with its group", instance.containerName), http.StatusUnprocessableEntity)
+			return
+		}
+
+		err = validateInstance(instance)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid instance configuration: %v", err), http.StatusUnprocessableEntity)
+			return
+		}
+
+		instances, err := getInstances(db)
+		if err != nil {
+			log.Printf("Could not get instances: %v", err)
+			http.Error(w, "could not get instances", http.StatusInternalServerError)
+			return
+		}
+		if other, ok := conflictingInstances(instances)[instance.id]; ok {
+			http.Error(w, fmt.Sprintf("invalid instance configuration: saves are stored under the same bucket and prefix as %v", other), http.StatusUnprocessableEntity)
+			return
+		}
+
+		if ctx.Err() != nil {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		// ?force=true backs up even within the instance's min_backup_gap_minutes
+		force := false
+		if value := r.URL.Query().Get("force"); value != "" {
+			force, err = strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "force must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+		if !force {
+			remaining, err := backupGapRemaining(db, instance)
+			if err != nil {
+				log.Printf("%v: Could not check time since last backup: %v", instance.containerName, err)
+				http.Error(w, "could not check time since last backup", http.StatusInternalServerError)
+				return
+			}
+			if remaining > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+				http.Error(w, fmt.Sprintf("%v was backed up less than %d minutes ago, try again in %v or pass force=true", instance.containerName, instance.minBackupGapMinutes, remaining.Round(time.Second)), http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		lock := backupLocks.get(instance.id)
+		if !lock.TryLock() {
+			http.Error(w, fmt.Sprintf("%v is already being backed up", instance.containerName), http.StatusConflict)
+			return
+		}
+		backups.Add(1)
+		defer backups.Done()
+		defer lock.Unlock()
+
+		log.Printf("%v: Backup requested through the API\n", instance.containerName)
+
+		// The backup carries on if the client disconnects, only a shutdown cuts it short
+		duration, err := manualBackup(ctx, db, instance)
+		result := apiBackupResult{Instance: instance.containerName, Result: eventSuccess, Duration: duration.Seconds()}
+		if err != nil {
+			result.Result = eventFailure
+			result.Error = err.Error()
+			writeJSON(w, http.StatusInternalServerError, result)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// Backs the instance up outside the loop, reporting a failure like the loop does
+// The caller holds the instance's backup lock, the working path's lock is waited for here like the loop does
+func manualBackup(ctx context.Context, db *sql.DB, instance Instance) (time.Duration, error) {
+
+	pathLock := pathLocks.get(instance.workingPath)
+	pathLock.Lock()
+	defer pathLock.Unlock()
+
+	start := time.Now()
+	err := backupInstance(ctx, db, instance)
+	if err != nil {
+		log.Printf("%v: Backup failed: %v\n", instance.containerName, err)
+		notifier.NotifyFailure(NotificationData{Instance: instance.containerName, Error: err.Error()})
+		events.Record(instance.id, eventFailure, err.Error(), time.Since(start))
+	}
+
+	return time.Since(start), err
+}
+
+// GET /saves?instance=<id> lists the instance's saves that haven't been deleted, oldest first
+func savesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		instance, status, err := apiInstanceByID(db, r.URL.Query().Get("instance"))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		records, err := getHistory(db, instance, "0000-01-01 00:00:00", "9999-12-31 23:59:59")
+		if err != nil {
+			log.Printf("Could not get saves: %v", err)
+			http.Error(w, "could not get saves", http.StatusInternalServerError)
+			return
+		}
+
+		saves := []historyRecord{}
+		for _, record := range records {
+			if !record.Deleted {
+				saves = append(saves, record)
+			}
+		}
+
+		writeJSON(w, http.StatusOK, saves)
+	}
+}
+
+// Returns the last n lines of the file, reading backwards from the end so large logs aren't loaded whole
+func tailFile(path string, n int) ([]string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	stats, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const chunkSize = 64 * 1024
+	end := stats.Size()
+	var data []byte
+
+	// Read chunks from the end until there are more than n line breaks or the start of the file is reached
+	for end > 0 && strings.Count(string(data), "\n") <= n {
+		start := max(end-chunkSize, 0)
+		chunk := make([]byte, end-start)
+		_, err = file.ReadAt(chunk, start)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		data = append(chunk, data...)
+		end = start
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return []string{}, nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Returns the command that writes the archive's uncompressed tar stream to stdout
+// Saves compressed with a zstd dictionary need its path, other saves pass ""
+func decompressCommand(archivePath string, dictionaryPath string) []string {
+	if strings.HasSuffix(archivePath, ".tar.zst") {
+		if dictionaryPath != "" {
+			return []string{"/usr/bin/zstd", "-q", "-dc", "-D", dictionaryPath, archivePath}
+		}
+		return []string{"/usr/bin/zstd", "-q", "-dc", archivePath}
+	}
+	if strings.HasSuffix(archivePath, ".tar") {
+		return []string{"/bin/cat", archivePath}
+	}
+	return []string{"/bin/gzip", "-dc", archivePath}
+}
+
+// Lists the members of the archive, one per line
+func listArchive(archivePath string, dictionaryPath string) (string, error) {
+	return runPipeline(decompressCommand(archivePath, dictionaryPath), []string{"/bin/tar", "-tf", "-"})
+}
+
+// Extracts the archive into the destination directory
+func extractArchive(archivePath string, dictionaryPath string, destination string) error {
+	output, err := runPipeline(decompressCommand(archivePath, dictionaryPath), []string{"/bin/tar", "-xf", "-", "-C", destination})
+	if err != nil {
+		return fmt.Errorf("could not extract save: %v, error: %v", output, err)
+	}
+	return nil
+}
+
+// Extracts a tar --listed-incremental archive over the saves before it, which also removes the files deleted since them
+func extractListedIncremental(archivePath string, dictionaryPath string, destination string) error {
+	output, err := runPipeline(decompressCommand(archivePath, dictionaryPath), []string{"/bin/tar", "-xf", "-", "--listed-incremental=/dev/null", "-C", destination})
+	if err != nil {
+		return fmt.Errorf("could not extract save: %v, error: %v", output, err)
+	}
+	return nil
+}
+
+// Returns the content of a single member of the archive
+func readArchiveMember(archivePath string, dictionaryPath string, member string) (string, error) {
+	return runPipeline(decompressCommand(archivePath, dictionaryPath), []string{"/bin/tar", "-xOf", "-", member})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Stands in for the aws CLI, copying the file it is asked to upload into $FAKE_S3_DIR
+const fakeAWSScript = `#!/bin/sh
+cp "$3" "$FAKE_S3_DIR/"
+`
+
+// DB backups used to chdir into their working path and leave the process there
+func TestBackupDatabaseKeepsWorkingDirectory(t *testing.T) {
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	uploads := filepath.Join(dir, "uploads")
+	workingPath := filepath.Join(dir, "dbbackups")
+	for _, path := range []string{bin, uploads, workingPath} {
+		err := os.MkdirAll(path, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := os.WriteFile(filepath.Join(bin, "aws"), []byte(fakeAWSScript), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FAKE_S3_DIR", uploads)
+
+	db := initDB(filepath.Join(dir, "db.sqlite"))
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	before, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backupDatabase(db, workingPath, "bucket", "db")
+	if err != nil {
+		t.Fatalf("DB backup failed: %v", err)
+	}
+
+	after, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Errorf("working directory changed from %v to %v", before, after)
+	}
+
+	uploaded, err := filepath.Glob(filepath.Join(uploads, "db*.sqlite.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploaded) != 1 {
+		t.Errorf("expected 1 uploaded DB backup, found %v", uploaded)
+	}
+
+	// The copy and the archive are written under the working path and removed once uploaded, never left in the process's directory
+	leftover, _ := filepath.Glob(filepath.Join(workingPath, "db*"))
+	stray, _ := filepath.Glob(filepath.Join(before, "db*.sqlite*"))
+	if len(leftover) > 0 || len(stray) > 0 {
+		t.Errorf("DB backup files left behind: %v %v", leftover, stray)
+	}
+}
+
+// Stands in for the docker CLI, answering /list with one player online and save-all with the save confirmation
+const fakeContainerScript = `#!/bin/sh
+case "$*" in
+*/list*) echo 'There are 1 of a max of 20 players online: Alice';;
+*save-all*) echo 'Saved the game';;
+*) echo ok;;
+esac
+`
+
+// Sets up a DB and a fake container CLI for backups to the local backend, restoring the globals afterwards
+func newTestBackupEnvironment(t *testing.T) (*sql.DB, string) {
+
+	dir := t.TempDir()
+
+	fake := filepath.Join(dir, "docker")
+	err := os.WriteFile(fake, []byte(fakeContainerScript), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousBinary, previousSaveAll, previousSaveOff, previousNotifier := containerBinary, saveAllDelay, saveOffDelay, notifier
+	t.Cleanup(func() {
+		containerBinary, saveAllDelay, saveOffDelay, notifier = previousBinary, previousSaveAll, previousSaveOff, previousNotifier
+	})
+	containerBinary = fake
+	saveAllDelay = 0
+	saveOffDelay = 0
+	notifier, err = newNotifier(NotificationTemplates{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := initDB(filepath.Join(dir, "db.sqlite"))
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	return db, dir
+}
+
+// Adds an active instance backed up to backendDir, with a world holding only level.dat under workingPath
+func addTestInstance(t *testing.T, db *sql.DB, name string, workingPath string, backendDir string) {
+
+	err := os.MkdirAll(filepath.Join(workingPath, "world"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(workingPath, "world", "level.dat"), []byte("level"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("INSERT INTO instances (container_name,description,dir_name,s3_bucket,prefix,working_path,keep_inventory,active,backend,backend_dir) VALUES (?,'','world','',?,?,0,1,?,?)",
+		name, name, workingPath, backendLocal, backendDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tar incremental saves build on the previous save's snapshot until full_every forces a full save,
+// and restoring one layers the chain so changed files are updated and deleted ones removed
+func TestTarIncrementalChain(t *testing.T) {
+
+	db, dir := newTestBackupEnvironment(t)
+	previousSnapshotDir := snapshotDir
+	t.Cleanup(func() {
+		snapshotDir = previousSnapshotDir
+	})
+	snapshotDir = filepath.Join(dir, "snapshots")
+
+	workingPath := filepath.Join(dir, "survival")
+	addTestInstance(t, db, "survival", workingPath, filepath.Join(dir, "saves"))
+	_, err := db.Exec("UPDATE instances SET incremental = 1, incremental_method = ?, full_every = 3", incrementalTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regionDir := filepath.Join(workingPath, "world", "region")
+	err = os.MkdirAll(regionDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRegion := func(name string, content string) {
+		err := os.WriteFile(filepath.Join(regionDir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRegion("r.0.0.mca", "original")
+	writeRegion("r.1.0.mca", "removed later")
+
+	instances, err := getInstances(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := instances[0]
+
+	backup := func() {
+		// Archive names only go down to the second
+		time.Sleep(1100 * time.Millisecond)
+		err := backupInstance(context.Background(), db, instance)
+		if err != nil {
+			t.Fatalf("backup failed: %v", err)
+		}
+	}
+
+	backup()
+	writeRegion("r.0.0.mca", "changed")
+	err = os.Remove(filepath.Join(regionDir, "r.1.0.mca"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup()
+	backup()
+	backup()
+
+	rows, err := db.Query("SELECT id, save_type FROM saves ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	var types []string
+	for rows.Next() {
+		var id int
+		var saveType string
+		err = rows.Scan(&id, &saveType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		types = append(types, saveType)
+	}
+	_ = rows.Close()
+
+	expected := []string{saveTypeFull, saveTypeIncremental, saveTypeIncremental, saveTypeFull}
+	if !slices.Equal(types, expected) {
+		t.Fatalf("expected save types %v, got %v", expected, types)
+	}
+
+	// Only the latest save's snapshot is kept
+	snapshots, err := filepath.Glob(filepath.Join(snapshotDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(snapshots, []string{snapshotPath(instance.id, ids[3])}) {
+		t.Errorf("expected only the snapshot of save %d, found %v", ids[3], snapshots)
+	}
+
+	save, err := getSave(db, instance, ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoreDir := t.TempDir()
+	err = fetchSave(db, instance, save, restoreDir)
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(restoreDir, "world", "region", "r.0.0.mca"))
+	if err != nil || string(content) != "changed" {
+		t.Errorf("expected the changed region file, got %q, error: %v", content, err)
+	}
+	if fileExists(filepath.Join(restoreDir, "world", "region", "r.1.0.mca")) {
+		t.Errorf("deleted region file was restored")
+	}
+	if !fileExists(filepath.Join(restoreDir, "world", "level.dat")) {
+		t.Errorf("level.dat from the full save is missing")
+	}
+	leftover, _ := filepath.Glob(filepath.Join(restoreDir, "world*.tar.gz"))
+	if len(leftover) > 0 {
+		t.Errorf("downloaded archives left behind: %v", leftover)
+	}
+}
+
+// Multipart uploads get the SHA-256 of their parts' digests, which has to come out the same however the data is written
+func TestS3ChecksumMultipart(t *testing.T) {
+
+	data := bytes.Repeat([]byte("minecraft"), s3MultipartChunkSize/9*2+1000)
+
+	var digests []byte
+	for start := 0; start < len(data); start += s3MultipartChunkSize {
+		part := sha256.Sum256(data[start:min(start+s3MultipartChunkSize, len(data))])
+		digests = append(digests, part[:]...)
+	}
+	composite := sha256.Sum256(digests)
+	expected := base64.StdEncoding.EncodeToString(composite[:]) + "-3"
+
+	checksum := newS3Checksum(s3MultipartChunkSize)
+	for start := 0; start < len(data); start += 1 << 20 / 3 {
+		_, _ = checksum.Write(data[start:min(start+1<<20/3, len(data))])
+	}
+	if checksum.Expected() != expected {
+		t.Errorf("expected checksum %v, got %v", expected, checksum.Expected())
+	}
+
+	whole := sha256.Sum256(data)
+	if checksum.SHA256() != hex.EncodeToString(whole[:]) {
+		t.Errorf("SHA-256 of the object doesn't match")
+	}
+
+	if comparable, match := compareChecksums(expected, expected); !comparable || !match {
+		t.Errorf("identical checksums should match")
+	}
+	if comparable, _ := compareChecksums(base64.StdEncoding.EncodeToString(composite[:])+"-2", expected); comparable {
+		t.Errorf("checksums with different part counts should not be comparable")
+	}
+}
+
+// The copies of a delta save in its other compression_formats used to be named like full saves
+func TestConvertedDeltaKeepsSuffix(t *testing.T) {
+
+	db, dir := newTestBackupEnvironment(t)
+
+	workingPath := filepath.Join(dir, "creative")
+	backendDir := filepath.Join(dir, "saves")
+	addTestInstance(t, db, "creative", workingPath, backendDir)
+	_, err := db.Exec("UPDATE instances SET incremental = 1, compression_formats = 'gzip,none'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := getInstances(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, content := range []string{"level", "changed"} {
+		err = os.WriteFile(filepath.Join(workingPath, "world", "level.dat"), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Archive names only go down to the second
+		time.Sleep(1100 * time.Millisecond)
+		err = backupInstance(context.Background(), db, instances[0])
+		if err != nil {
+			t.Fatalf("backup failed: %v", err)
+		}
+	}
+
+	deltas, err := filepath.Glob(filepath.Join(backendDir, "*", "world*-delta.tar*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deltas) != 2 {
+		t.Errorf("expected the delta save in both formats, found %v", deltas)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Caps how fast all S3 uploads together send data, set in main() from max_upload_bandwidth
+// A nil *BandwidthLimiter is valid and doesn't limit anything, which is the default
+var uploadLimiter *BandwidthLimiter
+
+// Paces the data passed through it to bytesPerSecond, shared by every upload so backup_workers
+// running at once split the bandwidth between them instead of each getting the whole of it
+type BandwidthLimiter struct {
+	bytesPerSecond int64
+
+	mu   sync.Mutex
+	next time.Time // When the data reserved so far will have been sent at the limit
+}
+
+// Returns nil for 0, so an unset limit costs nothing
+func newBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &BandwidthLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// Waits until n more bytes can be sent without going over the limit
+func (l *BandwidthLimiter) wait(n int) {
+
+	l.mu.Lock()
+	now := time.Now()
+	// Time the limiter sat idle isn't saved up, so a new upload doesn't start with a burst
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.bytesPerSecond) * float64(time.Second)))
+	l.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+// Largest piece of data passed at once, a tenth of a second's worth so the rate stays smooth
+func (l *BandwidthLimiter) chunkSize() int {
+	return int(l.bytesPerSecond/10 + 1)
+}
+
+// Wraps reader so reads from it are limited
+func (l *BandwidthLimiter) Reader(reader io.Reader) io.Reader {
+	if l == nil {
+		return reader
+	}
+	return &limitedReader{reader: reader, limiter: l}
+}
+
+// Wraps writer so writes to it are limited
+func (l *BandwidthLimiter) Writer(writer io.Writer) io.Writer {
+	if l == nil {
+		return writer
+	}
+	return &limitedWriter{writer: writer, limiter: l}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *BandwidthLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+
+	if len(p) > r.limiter.chunkSize() {
+		p = p[:r.limiter.chunkSize()]
+	}
+
+	n, err := r.reader.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
+
+type limitedWriter struct {
+	writer  io.Writer
+	limiter *BandwidthLimiter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+w.limiter.chunkSize())]
+		w.limiter.wait(len(chunk))
+
+		n, err := w.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Units accepted in max_upload_bandwidth, in bytes per second
+var bandwidthUnits = map[string]int64{
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"KIB": 1024,
+	"MIB": 1024 * 1024,
+	"GIB": 1024 * 1024 * 1024,
+}
+
+// Parses a rate such as "10MB/s", "512KiB/s" or "2.5MB" into bytes per second
+// An empty value, or one of 0, means unlimited
+func parseBandwidth(value string) (int64, error) {
+
+	trimmed := strings.ToUpper(strings.TrimSpace(value))
+	trimmed = strings.TrimSuffix(trimmed, "/S")
+	if trimmed == "" {
+		return 0, nil
+	}
+
+	number := strings.TrimRight(trimmed, "BGIKM ")
+	unit := strings.TrimSpace(trimmed[len(number):])
+	if unit == "" {
+		unit = "B"
+	}
+
+	multiplier, ok := bandwidthUnits[unit]
+	amount, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if !ok || err != nil || amount < 0 {
+		return 0, fmt.Errorf("expected a rate like 10MB/s or 512KiB/s, got %q", value)
+	}
+
+	return int64(amount * float64(multiplier)), nil
+}
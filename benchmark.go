@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A compressor tried by the benchmark
+type benchmarkCodec struct {
+	name    string
+	command []string // Reads the tar stream on stdin and writes the compressed archive to stdout
+	binary  string   // Codecs whose binary isn't installed are skipped
+	format  string   // compression_formats value that gives this codec, empty if it can't be configured
+}
+
+var benchmarkCodecs = []benchmarkCodec{
+	{name: "gzip -6", command: []string{"/bin/gzip", "-c"}, binary: "/bin/gzip", format: "gzip"},
+	{name: "pigz -6", command: []string{"/usr/bin/pigz", "-c"}, binary: "/usr/bin/pigz"},
+	{name: "zstd -1", command: []string{"/usr/bin/zstd", "-q", "-c", "-1"}, binary: "/usr/bin/zstd"},
+	{name: "zstd -3", command: []string{"/usr/bin/zstd", "-q", "-c", "-3"}, binary: "/usr/bin/zstd", format: "zstd"},
+	{name: "zstd -9", command: []string{"/usr/bin/zstd", "-q", "-c", "-9"}, binary: "/usr/bin/zstd"},
+	{name: "zstd -19", command: []string{"/usr/bin/zstd", "-q", "-c", "-19"}, binary: "/usr/bin/zstd"},
+}
+
+// How one codec did on the world
+type benchmarkResult struct {
+	codec    benchmarkCodec
+	duration time.Duration
+	size     int64
+}
+
+// Compresses a snapshot of the instance's world with each codec and recommends one, without uploading anything
+func benchmarkCommand(db *sql.DB, args []string) error {
+
+	flags := flag.NewFlagSet("benchmark", flag.ContinueOnError)
+	instanceName := flags.String("instance", "", "Container name of the instance to benchmark")
+	sizeWeight := flags.Float64("size-weight", 0.5, "How much size matters against time when recommending, from 0 (only time) to 1 (only size)")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *instanceName == "" {
+		return fmt.Errorf("--instance is required")
+	}
+	if *sizeWeight < 0 || *sizeWeight > 1 {
+		return fmt.Errorf("--size-weight must be between 0 and 1")
+	}
+
+	instance, err := getInstanceByName(db, *instanceName)
+	if err != nil {
+		return err
+	}
+
+	// Work next to the live worlds rather than in /tmp, which is often too small for a world
+	benchmarkDir, err := os.MkdirTemp(instance.workingPath, "benchmark-")
+	if err != nil {
+		return fmt.Errorf("could not create benchmark directory: %v", err)
+	}
+	defer func(benchmarkDir string) {
+		err := os.RemoveAll(benchmarkDir)
+		if err != nil {
+			log.Printf("Could not remove benchmark directory: %v\n", err)
+		}
+	}(benchmarkDir)
+
+	// The snapshot is taken without disabling saving, so the server and its backups carry on as normal
+	// A file changing mid-read doesn't matter here, it only needs to be representative
+	snapshotPath := filepath.Join(benchmarkDir, "snapshot.tar")
+	output, err := runCommand("/bin/tar", append([]string{"-cf", snapshotPath, "-C", instance.workingPath}, worldTarSources(instance)...)...)
+	if err != nil && commandExitCode(err) != 1 {
+		return fmt.Errorf("could not snapshot world: %v, error: %v", output, err)
+	}
+
+	snapshotStats, err := os.Stat(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("could not stat snapshot: %v", err)
+	}
+	fmt.Printf("Snapshot of %v: %v uncompressed\n\n", instance.containerName, formatBytes(snapshotStats.Size()))
+
+	var results []benchmarkResult
+
+	for _, codec := range benchmarkCodecs {
+
+		if !fileExists(codec.binary) {
+			fmt.Printf("%-9v skipped, %v is not installed\n", codec.name, codec.binary)
+			continue
+		}
+
+		archivePath := filepath.Join(benchmarkDir, "archive")
+
+		start := time.Now()
+		err = writePipeline([]string{"/bin/cat", snapshotPath}, codec.command, 0, archivePath)
+		duration := time.Since(start)
+		if err != nil {
+			fmt.Printf("%-9v failed: %v\n", codec.name, err)
+			_ = deleteFile(archivePath)
+			continue
+		}
+
+		archiveStats, err := os.Stat(archivePath)
+		if err != nil {
+			return fmt.Errorf("could not stat archive: %v", err)
+		}
+
+		err = deleteFile(archivePath)
+		if err != nil {
+			return fmt.Errorf("could not delete archive: %v", err)
+		}
+
+		results = append(results, benchmarkResult{codec: codec, duration: duration, size: archiveStats.Size()})
+		fmt.Printf("%-9v %8v  %10v  %5.1f%%\n", codec.name, duration.Round(time.Millisecond), formatBytes(archiveStats.Size()),
+			100*float64(archiveStats.Size())/float64(snapshotStats.Size()))
+	}
+
+	if len(results) == 0 {
+		return fmt.Errorf("no codec could be benchmarked")
+	}
+
+	best := recommendCodec(results, *sizeWeight)
+
+	fmt.Printf("\nRecommended with size weight %v: %v\n", *sizeWeight, best.codec.name)
+	if best.codec.format != "" {
+		fmt.Printf("Set compression_formats to '%v' to use it\n", best.codec.format)
+	} else {
+		fmt.Printf("Backups can't be configured to use it yet, the closest configurable codecs are gzip and zstd\n")
+	}
+
+	return nil
+}
+
+// Scores each result by its time and size relative to the fastest and smallest, weighted by sizeWeight, and returns the lowest
+func recommendCodec(results []benchmarkResult, sizeWeight float64) benchmarkResult {
+
+	fastest, smallest := results[0].duration, results[0].size
+	for _, result := range results {
+		fastest = min(fastest, result.duration)
+		smallest = min(smallest, result.size)
+	}
+
+	var best benchmarkResult
+	bestScore := 0.0
+
+	for i, result := range results {
+		score := (1-sizeWeight)*float64(result.duration)/float64(max(fastest, 1)) +
+			sizeWeight*float64(result.size)/float64(max(smallest, 1))
+		if i == 0 || score < bestScore {
+			best, bestScore = result, score
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// The AWS CLI's default multipart threshold and part size, which decide what checksum S3 gives an upload
+const s3MultipartChunkSize = 8 * 1024 * 1024
+
+// The AWS CLI grows the part size when a file would need more parts than S3 allows
+const s3MaxParts = 10000
+
+// s3Checksum hashes data as it is written, the way S3 checksums an object uploaded with --checksum-algorithm SHA256
+// Objects smaller than the multipart threshold get the base64 SHA-256 of their content, multipart ones the base64
+// SHA-256 of the parts' SHA-256 digests followed by the part count, e.g. "3q2+7w==-4"
+type s3Checksum struct {
+	partSize    int64
+	object      hash.Hash // SHA-256 of everything written, which is what saves.checksum records
+	part        hash.Hash
+	partWritten int64
+	parts       []byte // Digests of the finished parts, one after the other
+	partCount   int
+	size        int64
+}
+
+func newS3Checksum(partSize int64) *s3Checksum {
+	return &s3Checksum{partSize: partSize, object: sha256.New(), part: sha256.New()}
+}
+
+func (c *s3Checksum) Write(p []byte) (int, error) {
+
+	written := len(p)
+	c.object.Write(p)
+	c.size += int64(len(p))
+
+	for len(p) > 0 {
+		n := min(int64(len(p)), c.partSize-c.partWritten)
+		c.part.Write(p[:n])
+		c.partWritten += n
+		p = p[n:]
+		if c.partWritten == c.partSize {
+			c.finishPart()
+		}
+	}
+
+	return written, nil
+}
+
+func (c *s3Checksum) finishPart() {
+	c.parts = c.part.Sum(c.parts)
+	c.partCount = c.partCount + 1
+	c.part.Reset()
+	c.partWritten = 0
+}
+
+// Returns the hex SHA-256 of everything written
+func (c *s3Checksum) SHA256() string {
+	return hex.EncodeToString(c.object.Sum(nil))
+}
+
+// Returns the ChecksumSHA256 S3 should report for an object made of everything written
+func (c *s3Checksum) Expected() string {
+
+	if c.size < s3MultipartChunkSize {
+		return base64.StdEncoding.EncodeToString(c.object.Sum(nil))
+	}
+
+	if c.partWritten > 0 {
+		c.finishPart()
+	}
+	composite := sha256.Sum256(c.parts)
+
+	return fmt.Sprintf("%v-%d", base64.StdEncoding.EncodeToString(composite[:]), c.partCount)
+}
+
+// Returns the file's SHA-256 and the ChecksumSHA256 S3 should report for it after an aws s3 cp with the default settings
+func fileChecksums(path string) (string, string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not open %v: %v", path, err)
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	stats, err := file.Stat()
+	if err != nil {
+		return "", "", fmt.Errorf("Could not stat %v: %v", path, err)
+	}
+
+	chunkSize := int64(s3MultipartChunkSize)
+	for (stats.Size()+chunkSize-1)/chunkSize > s3MaxParts {
+		chunkSize = chunkSize * 2
+	}
+
+	checksum := newS3Checksum(chunkSize)
+	_, err = io.Copy(checksum, file)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not read %v: %v", path, err)
+	}
+
+	return checksum.SHA256(), checksum.Expected(), nil
+}
+
+// Compares an uploaded object's checksum with the one expected for the local data
+// Returns false for comparable when the object was uploaded in a different number of parts than expected,
+// e.g. because the AWS CLI's multipart settings were changed, in which case the checksums say nothing about the content
+func compareChecksums(checksum string, expected string) (comparable bool, match bool) {
+
+	if checksum == expected {
+		return true, true
+	}
+
+	_, expectedParts, _ := strings.Cut(expected, "-")
+	_, parts, _ := strings.Cut(checksum, "-")
+
+	return parts == expectedParts, false
+}
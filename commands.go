@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Runs a one-off command given on the command line, e.g. "mcbackuper metrics --json"
+func runSubcommand(db *sql.DB, args []string) error {
+
+	switch args[0] {
+	case "metrics":
+		return metricsCommand(db, args[1:])
+	case "verify":
+		return verifyCommand(db, args[1:])
+	case "reconcile-sizes":
+		return reconcileSizesCommand(db, args[1:])
+	case "reconcile":
+		return reconcileCommand(db, args[1:])
+	case "saves":
+		return savesCommand(db, args[1:])
+	case "usage":
+		return usageCommand(db, args[1:])
+	case "simulate-retention":
+		return simulateRetentionCommand(db, args[1:])
+	case "benchmark":
+		return benchmarkCommand(db, args[1:])
+	case "announce-shutdown":
+		return announceShutdownCommand(db, args[1:])
+	case "history":
+		return historyCommand(db, args[1:])
+	case "restore":
+		return restoreCommand(db, args[1:])
+	case "doctor":
+		return doctorCommand(db, args[1:])
+	default:
+		return fmt.Errorf("unknown command, available commands: metrics, verify, reconcile-sizes, reconcile, saves, usage, simulate-retention, benchmark, announce-shutdown, history, restore, doctor")
+	}
+}
+
+// Finds an instance by its container name
+func getInstanceByName(db *sql.DB, name string) (Instance, error) {
+
+	instances, err := getInstances(db)
+	if err != nil {
+		return Instance{}, err
+	}
+
+	for _, instance := range instances {
+		if instance.containerName == name {
+			return instance, nil
+		}
+	}
+
+	return Instance{}, fmt.Errorf("no instance named %v", name)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// File extension of each archive format
+var compressionExtensions = map[string]string{
+	"gzip": ".tar.gz",
+	"zstd": ".tar.zst",
+	"none": ".tar",
+}
+
+// Binary each format needs
+var compressionBinaries = map[string]string{
+	"gzip": "/bin/gzip",
+	"zstd": "/usr/bin/zstd",
+	"none": "/bin/cat",
+}
+
+// Highest level each compressor accepts
+var maxCompressionLevels = map[string]int{
+	"gzip": 9,
+	"zstd": 19,
+	"none": 0,
+}
+
+// Format saves are written in when the instance doesn't choose one, set in main() from the config
+var defaultCompression = "gzip"
+
+// Level defaultCompression is run at, 0 for the compressor's own default
+// Other formats always use their default level
+var compressionLevel = 0
+
+// Splits a compression_formats value such as "zstd,gzip" into its formats
+func parseCompressionFormats(value string) ([]string, error) {
+
+	var formats []string
+	for _, format := range strings.Split(value, ",") {
+		format = strings.TrimSpace(format)
+		if format == "" {
+			continue
+		}
+		if _, ok := compressionExtensions[format]; !ok {
+			return nil, fmt.Errorf("unknown compression format %v, expected gzip, zstd or none", format)
+		}
+		if slices.Contains(formats, format) {
+			return nil, fmt.Errorf("compression format %v is listed twice", format)
+		}
+		formats = append(formats, format)
+	}
+
+	return formats, nil
+}
+
+// Returns the command that compresses a tar stream from stdin into the format on stdout
+// zstd uses the dictionary when there is one
+func compressCommand(format string, dictionaryPath string) []string {
+
+	var command []string
+	switch format {
+	case "zstd":
+		command = []string{"/usr/bin/zstd", "-q", "-c"}
+	case "none":
+		return []string{"/bin/cat"}
+	default:
+		command = []string{"/bin/gzip", "-c"}
+	}
+
+	if format == defaultCompression && compressionLevel > 0 {
+		command = append(command, fmt.Sprintf("-%d", compressionLevel))
+	}
+	if format == "zstd" && dictionaryPath != "" {
+		command = append(command, "-D", dictionaryPath)
+	}
+
+	return command
+}
+
+// Checks the compression settings from the config, falling back to gzip at its default level if the compressor isn't installed
+func setDefaultCompression(format string, level int) {
+
+	if !fileExists(compressionBinaries[format]) {
+		log.Printf("%v is not installed, compressing with gzip instead of %v", compressionBinaries[format], format)
+		format, level = "gzip", 0
+	}
+
+	defaultCompression = format
+	compressionLevel = level
+}
+
+// Returns the dictionary an archive was compressed with, which only zstd archives use
+func archiveDictionaryPath(fileName string, dictionaryPath string) string {
+	if strings.HasSuffix(strings.TrimSuffix(fileName, encryptedExtension), compressionExtensions["zstd"]) {
+		return dictionaryPath
+	}
+	return ""
+}
+
+// Returns the format of an archive from its file name
+func archiveFormat(fileName string) string {
+	fileName = strings.TrimSuffix(fileName, encryptedExtension)
+	for format, extension := range compressionExtensions {
+		if strings.HasSuffix(fileName, extension) {
+			return format
+		}
+	}
+	return ""
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Config holds the settings read from the config file
+type Config struct {
+	SaveIntervalMinutes       int     `json:"save_interval_minutes"`
+	SaveRetentionCount        int     `json:"save_retention_count"`
+	DBPath                    string  `json:"db_path"`
+	S3StorageClass            string  `json:"s3_storage_class"`
+	LogFilePath               string  `json:"log_file_path"`
+	LogFormat                 string  `json:"log_format"`
+	LogMaxSizeMB              int     `json:"log_max_size_mb"`
+	LogMaxBackups             int     `json:"log_max_backups"`
+	LogMaxAgeDays             int     `json:"log_max_age_days"`
+	MaxLoadAverage            float64 `json:"max_load_average"`
+	SuccessTemplate           string  `json:"success_template"`
+	FailureTemplate           string  `json:"failure_template"`
+	DeletionTemplate          string  `json:"deletion_template"`
+	DBBackupBucket            string  `json:"db_backup_bucket"`
+	DBBackupPrefix            string  `json:"db_backup_prefix"`
+	DBBackupIntervalHours     int     `json:"db_backup_interval_hours"`
+	CrashLoopRestarts         int     `json:"crash_loop_restarts"`
+	CrashLoopWindowMinutes    int     `json:"crash_loop_window_minutes"`
+	EventBatchIntervalSeconds int     `json:"event_batch_interval_seconds"`
+	DigestEnabled             bool    `json:"digest_enabled"`
+	DigestTime                string  `json:"digest_time"`
+	PlayerDataRetentionCount  int     `json:"player_data_retention_count"`
+	DockerExecRetries         int     `json:"docker_exec_retries"`
+	DockerExecBackoffSeconds  int     `json:"docker_exec_backoff_seconds"`
+	S3UploadAttempts          int     `json:"s3_upload_attempts"`
+	S3UploadBackoffSeconds    int     `json:"s3_upload_backoff_seconds"`
+	DiscordWebhookURL         string  `json:"discord_webhook_url"`
+	Compression               string  `json:"compression"`
+	CompressionLevel          int     `json:"compression_level"`
+	MetricsPort               int     `json:"metrics_port"`
+	StreamUpload              bool    `json:"stream_upload"`
+	BackupWorkers             int     `json:"backup_workers"`
+	TarAttempts               int     `json:"tar_attempts"`
+	SaveAllDelaySeconds       int     `json:"save_all_delay_seconds"`
+	SaveOffDelaySeconds       int     `json:"save_off_delay_seconds"`
+	SMTPHost                  string  `json:"smtp_host"`
+	SMTPPort                  int     `json:"smtp_port"`
+	SMTPUsername              string  `json:"smtp_username"`
+	SMTPPassword              string  `json:"smtp_password"`
+	SMTPFrom                  string  `json:"smtp_from"`
+	SMTPTo                    string  `json:"smtp_to"`
+	LockFilePath              string  `json:"lock_file_path"`
+	ContainerRuntime          string  `json:"container_runtime"`
+	EncryptionKey             string  `json:"encryption_key"`
+	EncryptionKeyFile         string  `json:"encryption_key_file"`
+	MaxUploadBandwidth        string  `json:"max_upload_bandwidth"`
+	SlackWebhookURL           string  `json:"slack_webhook_url"`
+	WebhookURL                string  `json:"webhook_url"`
+	WebhookTemplate           string  `json:"webhook_template"`
+	WebhookHeaders            string  `json:"webhook_headers"`
+	FreeSpaceMarginMB         int     `json:"free_space_margin_mb"`
+	APIAddress                string  `json:"api_address"`
+	APIToken                  string  `json:"api_token"`
+	SnapshotDir               string  `json:"snapshot_dir"`
+	DBBusyTimeoutMS           int     `json:"db_busy_timeout_ms"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		SaveIntervalMinutes:       SAVE_INTERVAL_MINUTES,
+		SaveRetentionCount:        SAVE_RETENTION_COUNT,
+		DBPath:                    DB_PATH,
+		S3StorageClass:            S3_STORAGE_CLASS,
+		LogFilePath:               LOG_FILE_PATH,
+		LogFormat:                 LOG_FORMAT,
+		LogMaxSizeMB:              LOG_MAX_SIZE_MB,
+		LogMaxBackups:             LOG_MAX_BACKUPS,
+		LogMaxAgeDays:             LOG_MAX_AGE_DAYS,
+		MaxLoadAverage:            MAX_LOAD_AVERAGE,
+		SuccessTemplate:           SUCCESS_TEMPLATE,
+		FailureTemplate:           FAILURE_TEMPLATE,
+		DeletionTemplate:          DELETION_TEMPLATE,
+		DBBackupBucket:            DB_BACKUP_BUCKET,
+		DBBackupPrefix:            DB_BACKUP_PREFIX,
+		DBBackupIntervalHours:     DB_BACKUP_INTERVAL_HOURS,
+		CrashLoopRestarts:         CRASH_LOOP_RESTARTS,
+		CrashLoopWindowMinutes:    CRASH_LOOP_WINDOW_MINUTES,
+		EventBatchIntervalSeconds: EVENT_BATCH_INTERVAL_SECONDS,
+		DigestEnabled:             DIGEST_ENABLED,
+		DigestTime:                DIGEST_TIME,
+		PlayerDataRetentionCount:  PLAYER_DATA_RETENTION_COUNT,
+		DockerExecRetries:         DOCKER_EXEC_RETRIES,
+		DockerExecBackoffSeconds:  DOCKER_EXEC_BACKOFF_SECONDS,
+		S3UploadAttempts:          S3_UPLOAD_ATTEMPTS,
+		S3UploadBackoffSeconds:    S3_UPLOAD_BACKOFF_SECONDS,
+		DiscordWebhookURL:         DISCORD_WEBHOOK_URL,
+		Compression:               COMPRESSION,
+		CompressionLevel:          COMPRESSION_LEVEL,
+		MetricsPort:               METRICS_PORT,
+		StreamUpload:              STREAM_UPLOAD,
+		BackupWorkers:             BACKUP_WORKERS,
+		TarAttempts:               TAR_ATTEMPTS,
+		SaveAllDelaySeconds:       SAVE_ALL_DELAY_SECONDS,
+		SaveOffDelaySeconds:       SAVE_OFF_DELAY_SECONDS,
+		SMTPHost:                  SMTP_HOST,
+		SMTPPort:                  SMTP_PORT,
+		SMTPUsername:              SMTP_USERNAME,
+		SMTPPassword:              SMTP_PASSWORD,
+		SMTPFrom:                  SMTP_FROM,
+		SMTPTo:                    SMTP_TO,
+		LockFilePath:              LOCK_FILE_PATH,
+		ContainerRuntime:          CONTAINER_RUNTIME,
+		EncryptionKey:             ENCRYPTION_KEY,
+		EncryptionKeyFile:         ENCRYPTION_KEY_FILE,
+		MaxUploadBandwidth:        MAX_UPLOAD_BANDWIDTH,
+		SlackWebhookURL:           SLACK_WEBHOOK_URL,
+		WebhookURL:                WEBHOOK_URL,
+		WebhookTemplate:           WEBHOOK_TEMPLATE,
+		WebhookHeaders:            WEBHOOK_HEADERS,
+		FreeSpaceMarginMB:         FREE_SPACE_MARGIN_MB,
+		APIAddress:                API_ADDRESS,
+		APIToken:                  API_TOKEN,
+		SnapshotDir:               SNAPSHOT_DIR,
+		DBBusyTimeoutMS:           DB_BUSY_TIMEOUT_MS,
+	}
+}
+
+// Reads the config file, a JSON object or flat YAML, with the constants as defaults for missing keys
+// An empty path gives the defaults
+func loadConfig(path string) (Config, error) {
+
+	config := defaultConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("could not read config file: %v", err)
+	}
+
+	extension := strings.ToLower(filepath.Ext(path))
+	if extension == ".yaml" || extension == ".yml" {
+		data, err = flatYAMLToJSON(data)
+		if err != nil {
+			return config, fmt.Errorf("invalid config file %v: %v", path, err)
+		}
+	}
+
+	// Unknown keys are almost always typos, which would otherwise silently leave the default in place
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	if err != nil {
+		return config, fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+
+	err = validateConfig(config)
+	if err != nil {
+		return config, fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+
+	return config, nil
+}
+
+func validateConfig(config Config) error {
+
+	if config.SaveIntervalMinutes <= 0 {
+		return fmt.Errorf("save_interval_minutes must be positive")
+	}
+	if config.SaveRetentionCount < 1 {
+		return fmt.Errorf("save_retention_count must be at least 1")
+	}
+	if config.DBPath == "" {
+		return fmt.Errorf("db_path can't be empty")
+	}
+	if !storageClasses[config.S3StorageClass] {
+		return fmt.Errorf("unknown s3_storage_class: %v", config.S3StorageClass)
+	}
+	if config.LogFilePath == "" {
+		return fmt.Errorf("log_file_path can't be empty")
+	}
+	if config.LockFilePath == "" {
+		return fmt.Errorf("lock_file_path can't be empty")
+	}
+	if config.EncryptionKey != "" && config.EncryptionKeyFile != "" {
+		return fmt.Errorf("set only one of encryption_key and encryption_key_file")
+	}
+	if _, err := parseBandwidth(config.MaxUploadBandwidth); err != nil {
+		return fmt.Errorf("invalid max_upload_bandwidth: %v", err)
+	}
+	if config.WebhookURL != "" {
+		if _, err := newWebhookNotifier(config); err != nil {
+			return err
+		}
+	}
+	if config.ContainerRuntime != containerRuntimeDocker && config.ContainerRuntime != containerRuntimePodman {
+		return fmt.Errorf("unknown container_runtime %v, expected docker or podman", config.ContainerRuntime)
+	}
+	if config.LogFormat != logFormatText && config.LogFormat != logFormatJSON {
+		return fmt.Errorf("unknown log_format %v, expected text or json", config.LogFormat)
+	}
+	if config.LogMaxSizeMB < 1 {
+		return fmt.Errorf("log_max_size_mb must be at least 1")
+	}
+	if config.LogMaxBackups < 0 || config.LogMaxAgeDays < 0 {
+		return fmt.Errorf("log_max_backups and log_max_age_days can't be negative")
+	}
+	maxLevel, ok := maxCompressionLevels[config.Compression]
+	if !ok {
+		return fmt.Errorf("unknown compression %v, expected gzip, zstd or none", config.Compression)
+	}
+	if config.CompressionLevel < 0 || config.CompressionLevel > maxLevel {
+		return fmt.Errorf("compression_level for %v must be between 0 and %d", config.Compression, maxLevel)
+	}
+	if config.BackupWorkers < 1 {
+		return fmt.Errorf("backup_workers must be at least 1")
+	}
+	if config.SaveAllDelaySeconds < 0 || config.SaveOffDelaySeconds < 0 {
+		return fmt.Errorf("save_all_delay_seconds and save_off_delay_seconds can't be negative")
+	}
+	if config.FreeSpaceMarginMB < 0 {
+		return fmt.Errorf("free_space_margin_mb can't be negative")
+	}
+	if config.TarAttempts < 1 {
+		return fmt.Errorf("tar_attempts must be at least 1")
+	}
+	if config.MetricsPort < 0 || config.MetricsPort > 65535 {
+		return fmt.Errorf("metrics_port must be between 0 and 65535")
+	}
+	if config.APIAddress != "" && config.APIToken == "" {
+		return fmt.Errorf("api_token is required when api_address is set")
+	}
+	if config.SMTPHost != "" {
+		if config.SMTPPort < 1 || config.SMTPPort > 65535 {
+			return fmt.Errorf("smtp_port must be between 1 and 65535")
+		}
+		if config.SMTPFrom == "" || len(parseEmailAddresses(config.SMTPTo)) == 0 {
+			return fmt.Errorf("smtp_from and smtp_to are required when smtp_host is set")
+		}
+	}
+	if config.MaxLoadAverage < 0 {
+		return fmt.Errorf("max_load_average can't be negative")
+	}
+	if _, err := newNotifier(notificationTemplates(config), nil); err != nil {
+		return err
+	}
+	if config.DBBackupBucket != "" {
+		if config.DBBackupPrefix == "" {
+			return fmt.Errorf("db_backup_prefix can't be empty when db_backup_bucket is set")
+		}
+		if config.DBBackupIntervalHours < 1 {
+			return fmt.Errorf("db_backup_interval_hours must be at least 1")
+		}
+	}
+	if config.CrashLoopRestarts < 0 {
+		return fmt.Errorf("crash_loop_restarts can't be negative")
+	}
+	if config.CrashLoopRestarts > 0 && config.CrashLoopWindowMinutes < 1 {
+		return fmt.Errorf("crash_loop_window_minutes must be at least 1")
+	}
+	if config.EventBatchIntervalSeconds < 0 {
+		return fmt.Errorf("event_batch_interval_seconds can't be negative")
+	}
+	if _, err := parseDigestTime(config.DigestTime); err != nil {
+		return fmt.Errorf("invalid digest_time: %v", err)
+	}
+	if config.PlayerDataRetentionCount < 1 {
+		return fmt.Errorf("player_data_retention_count must be at least 1")
+	}
+	if config.DockerExecRetries < 0 || config.DockerExecBackoffSeconds < 0 {
+		return fmt.Errorf("docker_exec_retries and docker_exec_backoff_seconds can't be negative")
+	}
+	if config.S3UploadAttempts < 1 {
+		return fmt.Errorf("s3_upload_attempts must be at least 1")
+	}
+	if config.S3UploadBackoffSeconds < 0 {
+		return fmt.Errorf("s3_upload_backoff_seconds can't be negative")
+	}
+	if config.SnapshotDir == "" {
+		return fmt.Errorf("snapshot_dir can't be empty")
+	}
+	if config.DBBusyTimeoutMS < 0 {
+		return fmt.Errorf("db_busy_timeout_ms can't be negative")
+	}
+
+	return nil
+}
+
+// The notification message templates from the config file, empty ones use the built-in defaults
+func notificationTemplates(config Config) NotificationTemplates {
+	return NotificationTemplates{
+		Success:  config.SuccessTemplate,
+		Failure:  config.FailureTemplate,
+		Deletion: config.DeletionTemplate,
+	}
+}
+
+// Returns the kind of Config field behind each key, so YAML values are read as what the field holds
+// rather than guessed from how they look, e.g. an api_token of 123456 stays a string
+func configKeyKinds() map[string]reflect.Kind {
+
+	kinds := make(map[string]reflect.Kind)
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		kinds[key] = field.Type.Kind()
+	}
+
+	return kinds
+}
+
+// Converts YAML made of "key: value" lines, which is all the config needs, into a JSON object
+// Unquoted values are converted to the type of the key's Config field, quoted ones and unknown keys are left as strings
+// for the JSON decoder to reject
+func flatYAMLToJSON(data []byte) ([]byte, error) {
+
+	object := make(map[string]any)
+	kinds := configKeyKinds()
+
+	for i, line := range strings.Split(string(data), "\n") {
+
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if trimmed != line && strings.HasPrefix(line, " ") {
+			return nil, fmt.Errorf("line %d: nested values aren't supported", i+1)
+		}
+
+		key, value, found := strings.Cut(trimmed, ":")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected key: value", i+1)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		// Quoted values are always strings and may contain a #, and either kind can be followed by a comment
+		if value != "" && (value[0] == '"' || value[0] == '\'') {
+			end := strings.IndexByte(value[1:], value[0])
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: missing closing quote", i+1)
+			}
+			rest := strings.TrimSpace(value[end+2:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("line %d: unexpected %q after the closing quote", i+1, rest)
+			}
+			object[key] = value[1 : end+1]
+			continue
+		}
+		if strings.HasPrefix(value, "#") {
+			value = ""
+		} else if comment := strings.Index(value, " #"); comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+
+		switch kinds[key] {
+		case reflect.Int, reflect.Int64:
+			number, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v must be a whole number", i+1, key)
+			}
+			object[key] = number
+		case reflect.Float64:
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v must be a number", i+1, key)
+			}
+			object[key] = number
+		case reflect.Bool:
+			if value != "true" && value != "false" {
+				return nil, fmt.Errorf("line %d: %v must be true or false", i+1, key)
+			}
+			object[key] = value == "true"
+		default:
+			object[key] = value
+		}
+	}
+
+	return json.Marshal(object)
+}
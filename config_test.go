@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlatYAMLToJSON(t *testing.T) {
+
+	tests := []struct {
+		name string
+		yaml string
+		want map[string]any
+	}{
+		{"plain values", "db_path: ./db.sqlite\nbackup_workers: 2\nstream_upload: true", map[string]any{"db_path": "./db.sqlite", "backup_workers": 2.0, "stream_upload": true}},
+		{"comment after a value", "backup_workers: 2   # How many at once", map[string]any{"backup_workers": 2.0}},
+		{"empty quotes with a comment", `discord_webhook_url: ""   # Also post here`, map[string]any{"discord_webhook_url": ""}},
+		{"single quotes with a comment", "smtp_from: 'backups@example.com' # Sender", map[string]any{"smtp_from": "backups@example.com"}},
+		{"hash inside quotes", `smtp_password: "pa ss #1"  # Kept`, map[string]any{"smtp_password": "pa ss #1"}},
+		{"quoted number stays a string", `smtp_port: "587"`, map[string]any{"smtp_port": "587"}},
+		{"only a comment", "webhook_template: # Default", map[string]any{"webhook_template": ""}},
+		{"comment lines and document marker", "---\n# Settings\n\ndb_path: db", map[string]any{"db_path": "db"}},
+		{"numeric string key stays a string", "api_token: 123456", map[string]any{"api_token": "123456"}},
+		{"float-like string key stays a string", "smtp_password: 1e3", map[string]any{"smtp_password": "1e3"}},
+		{"boolean-like string key stays a string", "smtp_username: true", map[string]any{"smtp_username": "true"}},
+		{"float key", "max_load_average: 2", map[string]any{"max_load_average": 2.0}},
+		{"unknown key is left for the decoder", "no_such_key: 5", map[string]any{"no_such_key": "5"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := flatYAMLToJSON([]byte(test.yaml))
+			if err != nil {
+				t.Fatalf("flatYAMLToJSON: %v", err)
+			}
+			var got map[string]any
+			if err = json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("invalid JSON %s: %v", data, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFlatYAMLToJSONErrors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"nested value", "smtp:\n  host: mail"},
+		{"missing colon", "db_path"},
+		{"unterminated quote", `smtp_from: "backups`},
+		{"text after the closing quote", `smtp_from: "a" b`},
+		{"word for a whole number", "backup_workers: two"},
+		{"fraction for a whole number", "backup_workers: 1.5"},
+		{"word for a boolean", "stream_upload: yes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := flatYAMLToJSON([]byte(test.yaml)); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+// Values are read as the type of the key's field, so a token made of digits loads as a string
+func TestLoadConfigYAMLTypes(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "api_address: :8080\napi_token: 123456\nmax_load_average: 4\nbackup_workers: 3\n"
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if config.APIToken != "123456" || config.MaxLoadAverage != 4 || config.BackupWorkers != 3 {
+		t.Errorf("read api_token %q, max_load_average %v and backup_workers %d", config.APIToken, config.MaxLoadAverage, config.BackupWorkers)
+	}
+}
+
+// The sample in the README has to load as it is, since it's what people copy
+func TestLoadConfigREADMESample(t *testing.T) {
+
+	readme, err := os.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sample, found := strings.Cut(string(readme), "```yaml\n")
+	if !found {
+		t.Fatal("no YAML sample in README.md")
+	}
+	sample, _, _ = strings.Cut(sample, "```")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err = os.WriteFile(path, []byte(sample), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if config.DBBackupBucket != "" || config.SuccessTemplate != "" || config.DigestTime != "09:00" {
+		t.Errorf("quoted values were read as %q, %q and %q", config.DBBackupBucket, config.SuccessTemplate, config.DigestTime)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		change func(*Config)
+	}{
+		{"api_address without a token", func(c *Config) { c.APIAddress = ":8080" }},
+		{"negative max_load_average", func(c *Config) { c.MaxLoadAverage = -1 }},
+		{"unparsable success_template", func(c *Config) { c.SuccessTemplate = "{{.Instance" }},
+		{"failure_template with an unknown field", func(c *Config) { c.FailureTemplate = "{{.Missing}}" }},
+		{"db_backup_bucket without a prefix", func(c *Config) { c.DBBackupBucket = "backups"; c.DBBackupPrefix = "" }},
+		{"negative crash_loop_restarts", func(c *Config) { c.CrashLoopRestarts = -1 }},
+		{"crash_loop_window_minutes of 0", func(c *Config) { c.CrashLoopWindowMinutes = 0 }},
+		{"negative event_batch_interval_seconds", func(c *Config) { c.EventBatchIntervalSeconds = -1 }},
+		{"digest_time that isn't HH:MM", func(c *Config) { c.DigestTime = "9am" }},
+		{"player_data_retention_count of 0", func(c *Config) { c.PlayerDataRetentionCount = 0 }},
+		{"negative docker_exec_retries", func(c *Config) { c.DockerExecRetries = -1 }},
+		{"s3_upload_attempts of 0", func(c *Config) { c.S3UploadAttempts = 0 }},
+		{"db_backup_interval_hours of 0", func(c *Config) { c.DBBackupBucket = "backups"; c.DBBackupIntervalHours = 0 }},
+		{"empty snapshot_dir", func(c *Config) { c.SnapshotDir = "" }},
+		{"negative db_busy_timeout_ms", func(c *Config) { c.DBBusyTimeoutMS = -1 }},
+	}
+
+	if err := validateConfig(defaultConfig()); err != nil {
+		t.Fatalf("the defaults are invalid: %v", err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultConfig()
+			test.change(&config)
+			if err := validateConfig(config); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+// Defaults for the settings that can be set in the config file
+const (
+	SAVE_INTERVAL_MINUTES        = 30              // How often instances are backed up unless they set their own interval
+	SAVE_RETENTION_COUNT         = 5               // How many saves are held on to for each instance
+	DB_PATH                      = "./db.sqlite"   // The path to the sqlite file
+	S3_STORAGE_CLASS             = "STANDARD"      // Storage class saves are uploaded with
+	LOG_FILE_PATH                = "./log.log"     // Log output is written here as well as to the console
+	LOG_FORMAT                   = "text"          // Format of log lines, text or json
+	LOG_MAX_SIZE_MB              = 50              // The log file is rotated once it reaches this size
+	LOG_MAX_BACKUPS              = 7               // How many rotated log files are kept, 0 to keep them all
+	LOG_MAX_AGE_DAYS             = 0               // Rotated log files older than this are deleted, 0 to keep them however old
+	MAX_LOAD_AVERAGE             = 0.0             // Whole cycles are skipped while the 1-minute load average is above this, 0 to disable
+	SUCCESS_TEMPLATE             = ""              // Go template of success notifications, empty for the built-in default
+	FAILURE_TEMPLATE             = ""              // Go template of failure notifications, empty for the built-in default
+	DELETION_TEMPLATE            = ""              // Go template of notifications about deleted saves, empty for the built-in default
+	DB_BACKUP_BUCKET             = ""              // Bucket the DB itself is backed up to, empty to disable DB backups
+	DB_BACKUP_PREFIX             = "mcbackuper-db" // Prefix DB backups are uploaded under
+	DB_BACKUP_INTERVAL_HOURS     = 24              // How often the DB is backed up
+	CRASH_LOOP_RESTARTS          = 3               // Instances whose container restarted this many times within CRASH_LOOP_WINDOW_MINUTES are skipped, 0 to disable
+	CRASH_LOOP_WINDOW_MINUTES    = 30
+	EVENT_BATCH_INTERVAL_SECONDS = 0             // Backup events are buffered and written together this often, 0 to write each one straight away
+	DIGEST_ENABLED               = false         // Send a daily summary of the last 24 hours through the notifiers
+	DIGEST_TIME                  = "09:00"       // Local time of day the digest is sent at, HH:MM
+	PLAYER_DATA_RETENTION_COUNT  = 24            // How many player data saves are held on to for each instance with a player data schedule
+	DOCKER_EXEC_RETRIES          = 3             // Retries of a docker exec that failed because the daemon was busy or unreachable, 0 to disable
+	DOCKER_EXEC_BACKOFF_SECONDS  = 2             // Wait before the first docker exec retry, doubled for each one after
+	S3_UPLOAD_ATTEMPTS           = 5             // How many times each S3 or sftp upload is attempted before the backup fails
+	S3_UPLOAD_BACKOFF_SECONDS    = 2             // Wait before the first upload retry, doubled for each one after
+	SNAPSHOT_DIR                 = "./snapshots" // tar snapshot files of instances with incremental_method tar are kept here
+	DISCORD_WEBHOOK_URL          = ""            // Notifications are also posted to this Discord webhook, empty to disable
+	SLACK_WEBHOOK_URL            = ""            // Notifications are also posted to this Slack incoming webhook, empty to disable
+	WEBHOOK_URL                  = ""            // Notifications are also posted to this URL with WEBHOOK_TEMPLATE as the body, empty to disable
+	WEBHOOK_TEMPLATE             = ""            // Go template of the webhook's body, empty for a JSON object with every field
+	WEBHOOK_HEADERS              = ""            // Extra headers sent to the webhook, as "Name: value; Name: value"
+	COMPRESSION                  = "gzip"        // Format saves are compressed in unless the instance sets compression_formats, gzip, zstd or none
+	COMPRESSION_LEVEL            = 0             // Level COMPRESSION runs at, 0 for the compressor's default
+	METRICS_PORT                 = 9090          // Port /metrics is served on for Prometheus, 0 to disable
+	BACKUP_WORKERS               = 1             // How many instances are backed up at the same time
+	STREAM_UPLOAD                = false         // Pipe tar straight into the S3 upload instead of writing the archive to local disk first
+	FREE_SPACE_MARGIN_MB         = 1024          // Free space left on the working path's disk after the archive, or the backup isn't started
+	TAR_ATTEMPTS                 = 5             // How many times the world is tarred before the backup gives up
+	SAVE_ALL_DELAY_SECONDS       = 10            // Longest wait for the save command to finish before saving is disabled
+	SAVE_OFF_DELAY_SECONDS       = 5             // Wait after /save-off before the world is read
+	SMTP_HOST                    = ""            // Failures are also emailed through this SMTP server, empty to disable
+	SMTP_PORT                    = 587           // Port of the SMTP server, STARTTLS is used when the server offers it
+	SMTP_USERNAME                = ""            // Empty to send without authenticating
+	SMTP_PASSWORD                = ""
+	SMTP_FROM                    = ""                  // Sender address of failure emails
+	SMTP_TO                      = ""                  // Comma separated recipients of failure emails
+	CONTAINER_RUNTIME            = "docker"            // CLI the servers' containers are managed with, docker or podman
+	ENCRYPTION_KEY               = ""                  // Key saves of instances with encrypt on are encrypted with, 32 bytes as hex or base64
+	ENCRYPTION_KEY_FILE          = ""                  // File holding the encryption key, instead of ENCRYPTION_KEY
+	MAX_UPLOAD_BANDWIDTH         = ""                  // Cap on how fast all S3 uploads together send, e.g. 10MB/s, empty for unlimited
+	LOCK_FILE_PATH               = "./mcbackuper.lock" // Locked while the backup loop runs so a second copy refuses to start
+	API_ADDRESS                  = ""                  // Address the HTTP API listens on, e.g. ":8080", empty to disable it
+	API_TOKEN                    = ""                  // Bearer token every API request must send, required with API_ADDRESS
+	DB_BUSY_TIMEOUT_MS           = 5000                // How long a DB write waits for a lock held by another connection or process before failing
+)
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A container's restart count and state as seen at one point in time
+type restartSample struct {
+	at       time.Time
+	restarts int
+	running  bool
+}
+
+// CrashLoopDetector tracks container restarts across cycles so unstable servers aren't backed up
+type CrashLoopDetector struct {
+	maxRestarts int           // Restarts within the window that count as a crash loop, 0 to disable
+	window      time.Duration // How far back restarts are counted
+	samples     map[string][]restartSample
+	alerted     map[string]bool // Containers already reported, so a loop is only notified once
+}
+
+func newCrashLoopDetector(maxRestarts int, window time.Duration) *CrashLoopDetector {
+	return &CrashLoopDetector{
+		maxRestarts: maxRestarts,
+		window:      window,
+		samples:     map[string][]restartSample{},
+		alerted:     map[string]bool{},
+	}
+}
+
+// Records the container's current state and returns how many times it restarted within the window
+// Restarts are counted from docker's restart count, or from the container being seen down between cycles when
+// something other than docker's restart policy is restarting it, whichever is higher
+func (d *CrashLoopDetector) Restarts(container string) (int, error) {
+
+	sample, err := inspectRestarts(container)
+	if err != nil {
+		return 0, err
+	}
+
+	// Drop samples that have aged out of the window, keeping the last one before it as the baseline
+	// Cycles are usually as long as the window, so otherwise there would never be anything to compare against
+	samples := append(d.samples[container], sample)
+	for len(samples) > 1 && sample.at.Sub(samples[1].at) >= d.window {
+		samples = samples[1:]
+	}
+	d.samples[container] = samples
+
+	counted := samples[len(samples)-1].restarts - samples[0].restarts
+
+	flips := 0
+	for i := 1; i < len(samples); i++ {
+		if samples[i-1].running && !samples[i].running {
+			flips = flips + 1
+		}
+	}
+
+	return max(counted, flips), nil
+}
+
+// Reports whether the container is crash looping, and whether this is the first cycle it has been seen doing so
+func (d *CrashLoopDetector) Check(container string) (bool, bool, int, error) {
+
+	if d.maxRestarts <= 0 {
+		return false, false, 0, nil
+	}
+
+	restarts, err := d.Restarts(container)
+	if err != nil {
+		return false, false, 0, err
+	}
+
+	if restarts < d.maxRestarts {
+		delete(d.alerted, container)
+		return false, false, restarts, nil
+	}
+
+	first := !d.alerted[container]
+	d.alerted[container] = true
+
+	return true, first, restarts, nil
+}
+
+func inspectRestarts(container string) (restartSample, error) {
+
+	output, err := runCommand(containerBinary, "inspect", "-f", "{{.RestartCount}},{{.State.Running}}", container)
+	if err != nil {
+		return restartSample{}, fmt.Errorf("Could not inspect container: %v, error: %v", output, err)
+	}
+
+	fields := strings.Split(strings.TrimSpace(output), ",")
+	if len(fields) != 2 {
+		return restartSample{}, fmt.Errorf("unexpected docker inspect output: %q", output)
+	}
+
+	restarts, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return restartSample{}, fmt.Errorf("unexpected restart count %q: %v", fields[0], err)
+	}
+
+	return restartSample{at: time.Now(), restarts: restarts, running: fields[1] == "true"}, nil
+}
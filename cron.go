@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A parsed five field cron expression, with one set bit per value each field allows
+type CronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	// Standard cron runs on days matching either field when both day fields are restricted
+	dayOfMonthAny, dayOfWeekAny bool
+}
+
+// Shorthands accepted in place of the five fields
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// How far ahead Next looks before deciding an expression never matches, e.g. 0 0 30 2 *
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// Parses "minute hour day-of-month month day-of-week", e.g. "0 3,15 * * *" for 3am and 3pm
+// Fields take *, numbers, ranges like 1-5, lists like 1,15 and steps like */15 or 8-18/2
+// Days of the week run from 0 for Sunday to 6, and 7 is Sunday as well
+func parseCronSchedule(expression string) (CronSchedule, error) {
+
+	if macro, ok := cronMacros[strings.TrimSpace(expression)]; ok {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return CronSchedule{}, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+
+	var schedule CronSchedule
+	var err error
+
+	schedule.minute, err = parseCronField(fields[0], 0, 59)
+	if err != nil {
+		return CronSchedule{}, fmt.Errorf("minute: %v", err)
+	}
+	schedule.hour, err = parseCronField(fields[1], 0, 23)
+	if err != nil {
+		return CronSchedule{}, fmt.Errorf("hour: %v", err)
+	}
+	schedule.dayOfMonth, err = parseCronField(fields[2], 1, 31)
+	if err != nil {
+		return CronSchedule{}, fmt.Errorf("day of month: %v", err)
+	}
+	schedule.month, err = parseCronField(fields[3], 1, 12)
+	if err != nil {
+		return CronSchedule{}, fmt.Errorf("month: %v", err)
+	}
+	schedule.dayOfWeek, err = parseCronField(fields[4], 0, 7)
+	if err != nil {
+		return CronSchedule{}, fmt.Errorf("day of week: %v", err)
+	}
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1
+	}
+
+	schedule.dayOfMonthAny = strings.HasPrefix(fields[2], "*")
+	schedule.dayOfWeekAny = strings.HasPrefix(fields[4], "*")
+
+	if schedule.Next(time.Now()).IsZero() {
+		return CronSchedule{}, fmt.Errorf("%q never matches a date", expression)
+	}
+
+	return schedule, nil
+}
+
+// Parses one comma separated field into a bit set of the values between low and high it allows
+func parseCronField(field string, low int, high int) (uint64, error) {
+
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		start, end := low, high
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+
+			var err error
+			start, err = strconv.Atoi(first)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			end = start
+			if isRange {
+				end, err = strconv.Atoi(last)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			} else if hasStep {
+				// "5/15" means from 5 to the end of the range in steps of 15
+				end = high
+			}
+		}
+
+		if start < low || end > high || start > end {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, low, high)
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+
+	return bits, nil
+}
+
+// Returns the first time after t the schedule matches, to the minute, in t's time zone
+// Returns the zero time if there is none within the next five years
+func (s CronSchedule) Next(t time.Time) time.Time {
+
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+
+	for next.Before(limit) {
+
+		if s.month&(1<<int(next.Month())) == 0 {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+		if !s.matchesDay(next) {
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, next.Location())
+			continue
+		}
+		if s.hour&(1<<next.Hour()) == 0 {
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+			continue
+		}
+		if s.minute&(1<<next.Minute()) == 0 {
+			next = next.Add(time.Minute)
+			continue
+		}
+
+		return next
+	}
+
+	return time.Time{}
+}
+
+func (s CronSchedule) matchesDay(t time.Time) bool {
+
+	dayOfMonth := s.dayOfMonth&(1<<t.Day()) != 0
+	dayOfWeek := s.dayOfWeek&(1<<int(t.Weekday())) != 0
+
+	if !s.dayOfMonthAny && !s.dayOfWeekAny {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
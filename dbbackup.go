@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The online backup copies this many pages at a time and then lets other connections at the DB
+const dbBackupStepPages = 256
+const dbBackupStepDelay = 10 * time.Millisecond
+
+// Checks whether enough time has passed since the last DB backup
+func databaseBackupDue(db *sql.DB, intervalHours int) (bool, error) {
+
+	var createdAt string
+
+	err := db.QueryRow("SELECT created_at FROM database_backups ORDER BY id DESC LIMIT 1").Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	lastBackup, err := parseDBTime(createdAt)
+	if err != nil {
+		return false, err
+	}
+
+	return time.Since(lastBackup) >= time.Duration(intervalHours)*time.Hour, nil
+}
+
+// Takes a consistent copy of the DB with SQLite's online backup API, compresses it and uploads it
+// The copy is made in workingPath, which should have room for the whole DB
+func backupDatabase(db *sql.DB, workingPath string, bucket string, prefix string) error {
+
+	startTime := time.Now()
+
+	fileName := fmt.Sprintf("db%v.sqlite", getTime())
+	archiveName := fileName + ".gz"
+	filePath := filepath.Join(workingPath, fileName)
+	archivePath := filepath.Join(workingPath, archiveName)
+
+	// Neither file is worth keeping once the upload is done or has failed
+	defer func() {
+		for _, path := range []string{filePath, archivePath} {
+			err := os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("Could not remove DB backup file %v: %v\n", path, err)
+			}
+		}
+	}()
+
+	err := copyDatabase(db, filePath)
+	if err != nil {
+		return err
+	}
+
+	output, err := runCommand("/bin/gzip", filePath)
+	if err != nil {
+		return fmt.Errorf("Could not compress DB backup: %v, error: %v", output, err)
+	}
+
+	archiveStats, err := os.Stat(archivePath)
+	if err != nil {
+		return fmt.Errorf("Could not get DB backup size: %v", err)
+	}
+
+	err = S3Backend{bucket: bucket, prefix: prefix, storageClass: "STANDARD"}.Upload(archivePath, archiveName)
+	if err != nil {
+		return fmt.Errorf("Could not upload DB backup: %v", err)
+	}
+
+	_, err = db.Exec("INSERT INTO database_backups (filename,size) VALUES (?,?)", archiveName, archiveStats.Size())
+	if err != nil {
+		return fmt.Errorf("Could not insert into DB: %v", err)
+	}
+
+	log.Printf("Backed up the DB to %v (%d bytes) in %v\n", archiveName, archiveStats.Size(), time.Since(startTime).Round(time.Second))
+
+	return nil
+}
+
+// Copies the live DB to destination a few pages at a time, so the backup loop and API aren't locked out while it runs
+// Writes made during the copy are picked up by SQLite, so the result is a consistent snapshot
+func copyDatabase(db *sql.DB, destination string) error {
+
+	ctx := context.Background()
+
+	// The copy gets a connection of its own, holding db's only connection would stop everything else while it runs
+	var sourcePath string
+	err := db.QueryRow("SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&sourcePath)
+	if err != nil {
+		return fmt.Errorf("Could not get DB path: %v", err)
+	}
+
+	sourceDB, err := sql.Open("sqlite3", sqliteDSN(sourcePath, url.Values{"_busy_timeout": {strconv.FormatInt(dbBusyTimeout.Milliseconds(), 10)}}))
+	if err != nil {
+		return fmt.Errorf("Could not open DB: %v", err)
+	}
+	defer func(sourceDB *sql.DB) {
+		_ = sourceDB.Close()
+	}(sourceDB)
+
+	sourceConn, err := sourceDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not get DB connection: %v", err)
+	}
+	defer func(sourceConn *sql.Conn) {
+		_ = sourceConn.Close()
+	}(sourceConn)
+
+	destinationDB, err := sql.Open("sqlite3", destination)
+	if err != nil {
+		return fmt.Errorf("Could not create DB backup: %v", err)
+	}
+	defer func(destinationDB *sql.DB) {
+		_ = destinationDB.Close()
+	}(destinationDB)
+
+	destinationConn, err := destinationDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not create DB backup: %v", err)
+	}
+	defer func(destinationConn *sql.Conn) {
+		_ = destinationConn.Close()
+	}(destinationConn)
+
+	return destinationConn.Raw(func(destinationDriverConn any) error {
+		return sourceConn.Raw(func(sourceDriverConn any) error {
+
+			backup, err := destinationDriverConn.(*sqlite3.SQLiteConn).Backup("main", sourceDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("Could not start DB backup: %v", err)
+			}
+
+			for {
+				done, err := backup.Step(dbBackupStepPages)
+				if err != nil {
+					_ = backup.Finish()
+					return fmt.Errorf("Could not copy DB: %v", err)
+				}
+				if done {
+					break
+				}
+				time.Sleep(dbBackupStepDelay)
+			}
+
+			return backup.Finish()
+		})
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Another backend an instance's saves are copied to after they are uploaded to its own, e.g. a local disk next to S3
+// Copies go under the same prefix as the save, and are deleted along with it
+type Destination struct {
+	id          int
+	backend     string // s3, local or sftp, like the instance's own backend
+	backendDir  string // Directory saves are copied into for the local and sftp backends
+	s3Bucket    string
+	region      string // Region of s3Bucket, empty for the AWS CLI's default region
+	sftpHost    string
+	sftpPort    int
+	sftpUser    string
+	sftpKeyPath string
+}
+
+// Returns every instance's destinations, keyed by instance ID
+func getDestinations(db *sql.DB) (map[int][]Destination, error) {
+
+	rows, err := db.Query("SELECT id,instance_id,backend,backend_dir,s3_bucket,region,sftp_host,sftp_port,sftp_user,sftp_key_path FROM destinations ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("could not query destinations: %v", err)
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	destinations := make(map[int][]Destination)
+	for rows.Next() {
+		var destination Destination
+		var instanceID int
+		err = rows.Scan(&destination.id, &instanceID, &destination.backend, &destination.backendDir, &destination.s3Bucket, &destination.region,
+			&destination.sftpHost, &destination.sftpPort, &destination.sftpUser, &destination.sftpKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read destination: %v", err)
+		}
+		destinations[instanceID] = append(destinations[instanceID], destination)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read destinations: %v", err)
+	}
+
+	return destinations, nil
+}
+
+func validateDestination(destination Destination) error {
+
+	switch destination.backend {
+	case backendS3:
+		if destination.s3Bucket == "" {
+			return fmt.Errorf("destination %d: a bucket is required with the s3 backend", destination.id)
+		}
+	case backendLocal:
+		if destination.backendDir == "" {
+			return fmt.Errorf("destination %d: a backend directory is required with the local backend", destination.id)
+		}
+	case backendSFTP:
+		if destination.backendDir == "" || destination.sftpHost == "" || destination.sftpUser == "" {
+			return fmt.Errorf("destination %d: a backend directory, SFTP host and SFTP user are required with the sftp backend", destination.id)
+		}
+		if destination.sftpPort < 1 || destination.sftpPort > 65535 {
+			return fmt.Errorf("destination %d: invalid SFTP port %d", destination.id, destination.sftpPort)
+		}
+	default:
+		return fmt.Errorf("destination %d: invalid backend %v, expected s3, local or sftp", destination.id, destination.backend)
+	}
+
+	return nil
+}
+
+// The instance with its backend swapped for the destination's, so instanceStorage and checkStorageBackend work on it as they are
+func destinationInstance(instance Instance, destination Destination) Instance {
+
+	instance.backend = destination.backend
+	instance.backendDir = destination.backendDir
+	instance.s3Bucket = destination.s3Bucket
+	instance.region = destination.region
+	instance.sftpHost = destination.sftpHost
+	instance.sftpPort = destination.sftpPort
+	instance.sftpUser = destination.sftpUser
+	instance.sftpKeyPath = destination.sftpKeyPath
+	instance.failoverBucket = ""
+
+	return instance
+}
+
+// Names the destination in logs and notifications, e.g. "destination 2 (local)"
+func (destination Destination) String() string {
+	return fmt.Sprintf("destination %d (%v)", destination.id, destination.backend)
+}
+
+// Copies the archives, already uploaded to the instance's own backend, to each of its destinations
+// archivePath gives the local path of each archive
+// Returns the IDs of the destinations that got every archive, and a line for each copy that failed
+// A failed copy doesn't stop the others, so one unreachable destination doesn't leave the rest without the save
+func copyToDestinations(instance Instance, archives []string, archivePath func(string) string, prefix string) ([]int, []string) {
+
+	var copied []int
+	var failures []string
+
+	for _, destination := range instance.destinations {
+
+		storage := instanceStorage(destinationInstance(instance, destination), "", prefix, "", instanceStorageClass(instance))
+
+		var err error
+		for _, fileName := range archives {
+			err = storage.Upload(archivePath(fileName), fileName)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("%v: Could not copy save to %v: %v\n", instance.containerName, destination, strings.TrimSpace(err.Error()))
+			failures = append(failures, fmt.Sprintf("%v: %v", destination, strings.TrimSpace(err.Error())))
+			continue
+		}
+
+		copied = append(copied, destination.id)
+	}
+
+	return copied, failures
+}
+
+// Deletes the copies of a save's file from the destinations it was copied to
+// A copy that can't be deleted is only logged, the save itself is gone and nothing refers to the copy any more
+func deleteSaveCopies(tx *sql.Tx, instance Instance, fileName string, prefix string) error {
+
+	rows, err := tx.Query("SELECT DISTINCT save_copies.destination_id FROM save_copies JOIN saves ON saves.id = save_copies.save_id WHERE saves.instance_id = ? AND saves.filename = ? AND saves.prefix = ?",
+		instance.id, fileName, prefix)
+	if err != nil {
+		return fmt.Errorf("Could not query save copies: %v", err)
+	}
+
+	var destinationIDs []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("Could not read save copy: %v", err)
+		}
+		destinationIDs = append(destinationIDs, id)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("Could not read save copies: %v", err)
+	}
+
+	for _, id := range destinationIDs {
+
+		var destination Destination
+		for _, candidate := range instance.destinations {
+			if candidate.id == id {
+				destination = candidate
+			}
+		}
+		if destination.id == 0 {
+			log.Printf("%v: Warning: %v was copied to destination %d, which no longer exists, delete it there by hand\n", instance.containerName, fileName, id)
+			continue
+		}
+
+		err = instanceStorage(destinationInstance(instance, destination), "", prefix, "", "").Delete(fileName)
+		if err != nil {
+			log.Printf("%v: Warning: could not delete the copy of %v in %v: %v\n", instance.containerName, fileName, destination, err)
+		}
+	}
+
+	return nil
+}
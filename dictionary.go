@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long a trained dictionary is used before a fresh one is trained on the current world
+const dictionaryMaxAge = 30 * 24 * time.Hour
+
+// Largest dictionary zstd is asked to train, zstd's own default
+const dictionaryMaxSize = 112640
+
+// Dictionaries are kept next to the worlds and in S3 under <prefix>/dictionaries,
+// since every save compressed with one needs it to be decompressed
+func dictionaryDir(instance Instance) string {
+	return filepath.Join(instance.workingPath, ".mcbackuper-dictionaries")
+}
+
+func dictionaryPrefix(instance Instance) string {
+	return fmt.Sprintf("%v/dictionaries", instance.prefix)
+}
+
+// Returns the ID and local path of the dictionary to compress the next save with, training a new one if needed
+func currentDictionary(db *sql.DB, instance Instance) (int, string, error) {
+
+	var id int
+	var createdAt string
+
+	err := db.QueryRow("SELECT id, created_at FROM zstd_dictionaries WHERE instance_id = ? ORDER BY id DESC LIMIT 1", instance.id).Scan(&id, &createdAt)
+	if err == sql.ErrNoRows {
+		return trainDictionary(db, instance)
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("could not query dictionaries: %v", err)
+	}
+
+	trainedAt, err := parseDBTime(createdAt)
+	if err != nil {
+		return 0, "", err
+	}
+	if time.Since(trainedAt) > dictionaryMaxAge {
+		return trainDictionary(db, instance)
+	}
+
+	path, err := dictionaryPath(db, instance, id)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return id, path, nil
+}
+
+// Trains a dictionary on the world's files, uploads it and records it as the instance's newest version
+func trainDictionary(db *sql.DB, instance Instance) (int, string, error) {
+
+	// A dictionary that is recorded but never uploaded would break every later save compressed with it
+	if dryRun {
+		return 0, "", fmt.Errorf("dictionaries aren't trained in dry-run mode")
+	}
+
+	err := os.MkdirAll(dictionaryDir(instance), 0755)
+	if err != nil {
+		return 0, "", fmt.Errorf("could not create dictionary directory: %v", err)
+	}
+
+	fileName := fmt.Sprintf("dictionary%v.zdict", getTime())
+	path := filepath.Join(dictionaryDir(instance), fileName)
+	args := []string{"-q", "--train", "-r"}
+	for _, dir := range worldDirs(instance) {
+		args = append(args, filepath.Join(instance.workingPath, dir))
+	}
+
+	log.Printf("%v: Training zstd dictionary...\n", instance.containerName)
+
+	output, err := runCommand("/usr/bin/zstd", append(args, fmt.Sprintf("--maxdict=%d", dictionaryMaxSize), "-o", path)...)
+	if err != nil {
+		return 0, "", fmt.Errorf("could not train dictionary: %v, error: %v", output, err)
+	}
+
+	stats, err := os.Stat(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("could not stat dictionary: %v", err)
+	}
+
+	s3Path := fmt.Sprintf("s3://%v/%v/%v", instance.s3Bucket, dictionaryPrefix(instance), fileName)
+	_, err = runCommand("aws", append([]string{"s3", "cp", path, s3Path}, regionArgs(instance.region)...)...)
+	if err != nil {
+		return 0, "", fmt.Errorf("could not upload dictionary: %v", err)
+	}
+
+	result, err := db.Exec("INSERT INTO zstd_dictionaries (filename,size,instance_id) VALUES (?,?,?)", fileName, stats.Size(), instance.id)
+	if err != nil {
+		return 0, "", fmt.Errorf("could not insert dictionary record: %v", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+
+	return int(id), path, nil
+}
+
+// Returns the local path of the dictionary, downloading it from S3 if it isn't on disk
+func dictionaryPath(db *sql.DB, instance Instance, id int) (string, error) {
+
+	var fileName string
+
+	err := db.QueryRow("SELECT filename FROM zstd_dictionaries WHERE id = ?", id).Scan(&fileName)
+	if err != nil {
+		return "", fmt.Errorf("could not query dictionary %d: %v", id, err)
+	}
+
+	path := filepath.Join(dictionaryDir(instance), fileName)
+	if fileExists(path) {
+		return path, nil
+	}
+
+	err = os.MkdirAll(dictionaryDir(instance), 0755)
+	if err != nil {
+		return "", fmt.Errorf("could not create dictionary directory: %v", err)
+	}
+
+	err = downloadFromS3(fileName, instance.s3Bucket, dictionaryPrefix(instance), instance.region, path)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Returns the local path of the dictionary the save was compressed with, or "" if it didn't use one
+func saveDictionaryPath(db *sql.DB, instance Instance, dictionaryID sql.NullInt64) (string, error) {
+	if !dictionaryID.Valid {
+		return "", nil
+	}
+	return dictionaryPath(db, instance, int(dictionaryID.Int64))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// One instance's line in the daily digest
+type digestEntry struct {
+	instance    string
+	backups     int64
+	bytes       int64
+	failures    int64
+	storedBytes int64
+}
+
+// Parses the digest's time of day, e.g. "09:00", in the server's local time
+func parseDigestTime(value string) (time.Time, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid digest time %q, expected HH:MM: %v", value, err)
+	}
+	return parsed, nil
+}
+
+// Checks whether today's digest time has passed without a digest being sent since
+func digestDue(db *sql.DB, digestTime time.Time, now time.Time) (bool, error) {
+
+	scheduled := time.Date(now.Year(), now.Month(), now.Day(), digestTime.Hour(), digestTime.Minute(), 0, 0, now.Location())
+	if now.Before(scheduled) {
+		return false, nil
+	}
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM digests WHERE created_at >= ?", scheduled.UTC().Format(dbTimeLayout)).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count == 0, nil
+}
+
+// Summarises the last 24 hours of every instance from the saves and backup_events tables
+func buildDigest(db *sql.DB, now time.Time) (string, error) {
+
+	instances, err := getInstances(db)
+	if err != nil {
+		return "", err
+	}
+
+	since := now.Add(-24 * time.Hour).UTC().Format(dbTimeLayout)
+
+	var entries []digestEntry
+	var total digestEntry
+
+	for _, instance := range instances {
+
+		entry := digestEntry{instance: instance.containerName}
+
+		// Deduped saves count as backups but didn't upload anything
+		err = db.QueryRow("SELECT COUNT(*), COALESCE(SUM(CASE WHEN deduped = 0 THEN size END), 0) FROM saves WHERE instance_id = ? AND created_at >= ?",
+			instance.id, since).Scan(&entry.backups, &entry.bytes)
+		if err != nil {
+			return "", fmt.Errorf("Could not query saves: %v", err)
+		}
+
+		err = db.QueryRow("SELECT COUNT(*) FROM backup_events WHERE instance_id = ? AND kind = ? AND created_at >= ?",
+			instance.id, eventFailure, since).Scan(&entry.failures)
+		if err != nil {
+			return "", fmt.Errorf("Could not query backup events: %v", err)
+		}
+
+		err = db.QueryRow("SELECT COALESCE(SUM(CASE WHEN deduped = 0 THEN size END), 0) FROM saves WHERE instance_id = ? AND deleted = 0",
+			instance.id).Scan(&entry.storedBytes)
+		if err != nil {
+			return "", fmt.Errorf("Could not query saves: %v", err)
+		}
+
+		total.backups = total.backups + entry.backups
+		total.bytes = total.bytes + entry.bytes
+		total.failures = total.failures + entry.failures
+		total.storedBytes = total.storedBytes + entry.storedBytes
+
+		entries = append(entries, entry)
+	}
+
+	var digest strings.Builder
+
+	_, _ = fmt.Fprintf(&digest, "Daily backup digest: %d backups, %v uploaded, %d failures, %v stored\n",
+		total.backups, formatBytes(total.bytes), total.failures, formatBytes(total.storedBytes))
+
+	for _, entry := range entries {
+		_, _ = fmt.Fprintf(&digest, "%v: %d backups, %v uploaded, %d failures, %v stored\n",
+			entry.instance, entry.backups, formatBytes(entry.bytes), entry.failures, formatBytes(entry.storedBytes))
+	}
+
+	return strings.TrimSuffix(digest.String(), "\n"), nil
+}
+
+// Builds the digest, sends it and records that it was sent
+func sendDigest(db *sql.DB) error {
+
+	digest, err := buildDigest(db, time.Now())
+	if err != nil {
+		return err
+	}
+
+	notifier.Send(digest)
+
+	_, err = db.Exec("INSERT INTO digests DEFAULT VALUES")
+	if err != nil {
+		return fmt.Errorf("Could not record digest: %v", err)
+	}
+
+	return nil
+}
+
+// Formats a byte count with a binary unit, e.g. 1.5 GiB
+func formatBytes(size int64) string {
+
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	divisor, exponent := int64(unit), 0
+	for n := size / unit; n >= unit; n = n / unit {
+		divisor = divisor * unit
+		exponent = exponent + 1
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(divisor), "KMGTPE"[exponent])
+}
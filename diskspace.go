@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Free space kept on the working path's disk on top of the archive's estimate, set in main() from free_space_margin_mb
+var freeSpaceMargin int64
+
+// The archive is estimated at this multiple of the world's size, in case it doesn't compress, plus tar's headers
+const archiveSizeEstimate = 1.2
+
+// Returns the bytes available to this user on the disk holding path
+func freeDiskSpace(path string) (int64, error) {
+
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Refuses a backup whose archive of worldBytes might not fit in the working path, rather than let tar fill the disk part way through
+func checkDiskSpace(workingPath string, worldBytes int64) error {
+
+	free, err := freeDiskSpace(workingPath)
+	if err != nil {
+		return fmt.Errorf("Could not check free disk space: %v", err)
+	}
+
+	needed := int64(float64(worldBytes)*archiveSizeEstimate) + freeSpaceMargin
+	if free < needed {
+		return fmt.Errorf("insufficient disk space in %v: %v free, but the %v world needs at least %v", workingPath, formatBytes(free), formatBytes(worldBytes), formatBytes(needed))
+	}
+
+	return nil
+}
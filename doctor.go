@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Tables the service expects in the DB
+var expectedTables = []string{"instances", "saves", "backup_groups", "group_saves", "zstd_dictionaries", "restore_drills", "backup_events", "playerdata_saves", "digests", "database_backups", "save_files", "destinations", "save_copies"}
+
+// Checks that everything the backup loop needs is in place, printing a line per check
+// Fails if any check does, so it can be used in scripts
+func doctorCommand(db *sql.DB, args []string) error {
+
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	check := func(name string, err error) {
+		if err != nil {
+			failures++
+			fmt.Printf("FAIL %v: %v\n", name, err)
+		} else {
+			fmt.Printf("PASS %v\n", name)
+		}
+	}
+
+	_, err = exec.LookPath(containerBinary)
+	check(fmt.Sprintf("%v is installed", containerBinary), err)
+	if err == nil {
+		// info needs the daemon, or for podman the user's storage, unlike version
+		_, err := runCommand(containerBinary, "info")
+		check(fmt.Sprintf("%v daemon is reachable", containerBinary), err)
+	}
+
+	err = checkAWSCLI()
+	check("AWS CLI is installed", err)
+	if err == nil {
+		_, err := runCommand("aws", "sts", "get-caller-identity")
+		check("AWS credentials are valid", err)
+	}
+
+	err = db.Ping()
+	check("DB is reachable", err)
+	check("DB has every table", checkTables(db))
+
+	instances, err := getInstances(db)
+	check("instances can be read", err)
+
+	for _, instance := range instances {
+
+		if !instance.active {
+			continue
+		}
+		name := instance.containerName
+
+		check(fmt.Sprintf("%v: configuration is valid", name), validateInstance(instance))
+
+		info, err := os.Stat(instance.workingPath)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%v is not a directory", instance.workingPath)
+		}
+		check(fmt.Sprintf("%v: working_path exists", name), err)
+		if err == nil {
+			check(fmt.Sprintf("%v: world directories exist", name), checkWorldDirs(instance))
+		}
+
+		// An instance reached over RCON may not be in a container at all
+		// Factorio would post anything that isn't a command to the chat
+		if instance.rconHost != "" {
+			command := "/list"
+			if instance.serverType == serverTypeFactorio {
+				command = "/players online"
+			}
+			_, err = runRconTCPCommand(instance, command)
+			check(fmt.Sprintf("%v: RCON at %v:%d answers", name, instance.rconHost, instance.rconPort), err)
+		} else {
+			output, err := runCommand(containerBinary, "inspect", "-f", "{{.State.Status}}", name)
+			if err == nil {
+				if status := strings.TrimSpace(output); status != "running" {
+					err = fmt.Errorf("container is %v", status)
+				}
+			}
+			check(fmt.Sprintf("%v: container is known to %v and running", name, containerBinary), err)
+		}
+
+		check(fmt.Sprintf("%v: storage backend is usable", name), checkStorageBackend(instance))
+		for _, destination := range instance.destinations {
+			check(fmt.Sprintf("%v: %v is usable", name, destination), checkStorageBackend(destinationInstance(instance, destination)))
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d checks failed", failures)
+	}
+
+	return nil
+}
+
+// Reports the tables missing from the DB
+func checkTables(db *sql.DB) error {
+
+	var missing []string
+	for _, table := range expectedTables {
+		var name string
+		err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&name)
+		if err == sql.ErrNoRows {
+			missing = append(missing, table)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %v", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
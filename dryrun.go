@@ -0,0 +1,34 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Set from --dry-run in main()
+// Uploads, deletes and the save records are only logged, the world is still saved and archived so the rest of the configuration is exercised
+var dryRun = false
+
+// Commits the transaction, or in dry-run mode rolls it back and logs what would have been recorded
+func commitUnlessDryRun(transaction *sql.Tx, description string) error {
+
+	if dryRun {
+		log.Printf("[DRY RUN] would record %v\n", description)
+		return transaction.Rollback()
+	}
+
+	return transaction.Commit()
+}
+
+// Reports saves deleted by retention, once their records are committed
+// A dry run deletes nothing, so there is nothing to report and the would-be deletions are only logged
+func notifyDeletions(deleted []NotificationData) {
+
+	if dryRun {
+		return
+	}
+
+	for _, data := range deleted {
+		notifier.NotifyDeletion(data)
+	}
+}
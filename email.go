@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout for the whole SMTP conversation, so an unreachable mail server can't hold up the loop
+const smtpTimeout = 30 * time.Second
+
+// Emails the failures of a loop pass as one message, for people who don't use Discord or Slack
+type EmailNotifier struct {
+	host     string
+	port     int
+	username string // Empty to send without authenticating
+	password string
+	from     string
+	to       []string
+
+	mu       sync.Mutex
+	failures []NotificationData // Failures since the last Flush
+}
+
+// Returns nil when smtp_host isn't set
+func newEmailNotifier(config Config) *EmailNotifier {
+
+	if config.SMTPHost == "" {
+		return nil
+	}
+
+	return &EmailNotifier{
+		host:     config.SMTPHost,
+		port:     config.SMTPPort,
+		username: config.SMTPUsername,
+		password: config.SMTPPassword,
+		from:     config.SMTPFrom,
+		to:       parseEmailAddresses(config.SMTPTo),
+	}
+}
+
+// Splits a comma separated list of addresses, ignoring empty entries
+func parseEmailAddresses(list string) []string {
+
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+func (e *EmailNotifier) Name() string {
+	return "email"
+}
+
+// Holds on to failures until the end of the loop pass, other messages aren't emailed
+func (e *EmailNotifier) Notify(message string, data NotificationData) error {
+
+	if data.Result != resultFailure {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures = append(e.failures, data)
+	return nil
+}
+
+// Sends one email listing every failure added since the last call, if there were any
+func (e *EmailNotifier) Flush() error {
+
+	e.mu.Lock()
+	failures := e.failures
+	e.failures = nil
+	e.mu.Unlock()
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	subject := fmt.Sprintf("MC-Backuper: %v failed", failures[0].Instance)
+	if len(failures) > 1 {
+		subject = fmt.Sprintf("MC-Backuper: %d backups failed", len(failures))
+	}
+
+	var body strings.Builder
+	body.WriteString("The following backups failed during the last backup cycle:\r\n\r\n")
+	for _, failure := range failures {
+		fmt.Fprintf(&body, "%v: %v\r\n", failure.Instance, failure.Error)
+	}
+
+	err := e.send(subject, body.String())
+	if err != nil {
+		return fmt.Errorf("could not email %d failures to %v: %v", len(failures), strings.Join(e.to, ", "), err)
+	}
+
+	return nil
+}
+
+// Sends the message, upgrading the connection with STARTTLS when the server offers it
+// net/smtp's PlainAuth refuses to send the password over a connection that isn't encrypted, except to localhost
+func (e *EmailNotifier) send(subject string, body string) error {
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(e.host, strconv.Itoa(e.port)), smtpTimeout)
+	if err != nil {
+		return err
+	}
+	err = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func(client *smtp.Client) {
+		_ = client.Close()
+	}(client)
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: e.host})
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.username != "" {
+		err = client.Auth(smtp.PlainAuth("", e.username, e.password, e.host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(e.from)
+	if err != nil {
+		return err
+	}
+	for _, address := range e.to {
+		err = client.Rcpt(address)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	headers := []string{
+		"From: " + e.from,
+		"To: " + strings.Join(e.to, ", "),
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	_, err = fmt.Fprintf(writer, "%v\r\n\r\n%v", strings.Join(headers, "\r\n"), body)
+	if err != nil {
+		_ = writer.Close()
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
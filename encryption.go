@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Value of the saves' encryption column for encrypted saves, empty for plaintext ones
+const encryptionAES256GCM = "aes-256-gcm"
+
+// Added to the archive's name once it is encrypted, e.g. world2024-01-01_00-00-00.tar.gz.enc
+const encryptedExtension = ".enc"
+
+// Key saves of instances with encrypt on are encrypted with, set in main() from the config
+// nil when no key is configured
+var encryptionKey []byte
+
+// Encrypted files start with this, then the nonce the chunks' nonces are derived from
+const encryptionMagic = "MCBKENC1"
+
+// The archive is sealed in chunks of this size, so a world of any size is encrypted without holding it in memory
+const encryptionChunkSize = 1024 * 1024
+
+// Reads the key from encryption_key or the file encryption_key_file names
+// Keys are 32 bytes, written as hex or base64, and a key file may also hold the 32 raw bytes
+func loadEncryptionKey(config Config) ([]byte, error) {
+
+	if config.EncryptionKey != "" {
+		key, err := parseEncryptionKey([]byte(config.EncryptionKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption_key: %v", err)
+		}
+		return key, nil
+	}
+
+	if config.EncryptionKeyFile == "" {
+		return nil, nil
+	}
+
+	contents, err := os.ReadFile(config.EncryptionKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read encryption_key_file: %v", err)
+	}
+	if len(contents) == 32 {
+		return contents, nil
+	}
+
+	key, err := parseEncryptionKey(contents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %v: %v", config.EncryptionKeyFile, err)
+	}
+	return key, nil
+}
+
+func parseEncryptionKey(text []byte) ([]byte, error) {
+
+	trimmed := strings.TrimSpace(string(text))
+
+	key, err := hex.DecodeString(trimmed)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(trimmed)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("expected a 32 byte key as 64 hex characters or base64, e.g. from openssl rand -hex 32")
+	}
+
+	return key, nil
+}
+
+// Encrypts the file at source into destination with AES-256-GCM
+// Each chunk is sealed with its own nonce and marked as the last one or not, so chunks can't be reordered,
+// dropped or cut off the end without decryption failing
+func encryptFile(source string, destination string, key []byte) error {
+
+	aead, err := newEncryptionAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func(input *os.File) {
+		_ = input.Close()
+	}(input)
+
+	output, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	err = encryptStream(aead, bufio.NewReaderSize(input, encryptionChunkSize), output)
+	closeErr := output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = deleteFile(destination)
+		return err
+	}
+
+	return nil
+}
+
+func encryptStream(aead cipher.AEAD, input *bufio.Reader, output io.Writer) error {
+
+	header := make([]byte, len(encryptionMagic)+aead.NonceSize())
+	copy(header, encryptionMagic)
+	_, err := rand.Read(header[len(encryptionMagic):])
+	if err != nil {
+		return err
+	}
+
+	_, err = output.Write(header)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, encryptionChunkSize)
+	var sealed []byte
+
+	for counter := uint64(0); ; counter++ {
+
+		n, err := io.ReadFull(input, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// The chunk is the last one if nothing follows it, which an empty file's single empty chunk is as well
+		_, peekErr := input.Peek(1)
+		last := peekErr == io.EOF
+		if peekErr != nil && !last {
+			return peekErr
+		}
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(header, counter), chunk[:n], chunkAdditionalData(header, last))
+		_, err = output.Write(sealed)
+		if err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// Decrypts a file written by encryptFile into destination
+func decryptFile(source string, destination string, key []byte) error {
+
+	aead, err := newEncryptionAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func(input *os.File) {
+		_ = input.Close()
+	}(input)
+
+	output, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	err = decryptStream(aead, bufio.NewReaderSize(input, encryptionChunkSize+aead.Overhead()), output)
+	closeErr := output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = deleteFile(destination)
+		return err
+	}
+
+	return nil
+}
+
+func decryptStream(aead cipher.AEAD, input *bufio.Reader, output io.Writer) error {
+
+	header := make([]byte, len(encryptionMagic)+aead.NonceSize())
+	_, err := io.ReadFull(input, header)
+	if err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return fmt.Errorf("not an encrypted save")
+	}
+
+	chunk := make([]byte, encryptionChunkSize+aead.Overhead())
+	var opened []byte
+
+	for counter := uint64(0); ; counter++ {
+
+		n, err := io.ReadFull(input, chunk)
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("encrypted save is truncated")
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		_, peekErr := input.Peek(1)
+		last := peekErr == io.EOF
+		if peekErr != nil && !last {
+			return peekErr
+		}
+
+		opened, err = aead.Open(opened[:0], chunkNonce(header, counter), chunk[:n], chunkAdditionalData(header, last))
+		if err != nil {
+			return fmt.Errorf("could not decrypt save, the key is wrong or the file is corrupt or truncated")
+		}
+
+		_, err = output.Write(opened)
+		if err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+func newEncryptionAEAD(key []byte) (cipher.AEAD, error) {
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("no encryption key configured, set encryption_key or encryption_key_file")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// The file's nonce with the chunk's number added into its last 8 bytes, so no two chunks share a nonce
+func chunkNonce(header []byte, counter uint64) []byte {
+
+	nonce := make([]byte, len(header)-len(encryptionMagic))
+	copy(nonce, header[len(encryptionMagic):])
+
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^counter)
+
+	return nonce
+}
+
+// Authenticates the header along with each chunk, and whether the chunk is the last one
+func chunkAdditionalData(header []byte, last bool) []byte {
+
+	data := append([]byte{}, header...)
+	if last {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
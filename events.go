@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Kinds of backup events
+const (
+	eventSuccess = "success"
+	eventFailure = "failure"
+	eventSkipped = "skipped"
+)
+
+// A backup outcome waiting to be written to the backup_events table
+type backupEvent struct {
+	instanceID int
+	kind       string
+	message    string
+	duration   time.Duration
+	createdAt  string
+}
+
+// EventLog records backup outcomes in the backup_events table
+// With a batch interval the events are buffered and written together, otherwise each one is written as it happens
+// Save records don't go through here, they are always written with the backup's transaction
+type EventLog struct {
+	db            *sql.DB
+	batchInterval time.Duration
+	mu            sync.Mutex
+	pending       []backupEvent
+	stop          chan struct{}
+	stopped       chan struct{}
+}
+
+// The event log used by the backup loop, set in main()
+// Events recorded while it is nil, e.g. by one-off commands, are dropped
+var events *EventLog
+
+func newEventLog(db *sql.DB, batchInterval time.Duration) *EventLog {
+
+	l := &EventLog{
+		db:            db,
+		batchInterval: batchInterval,
+		stop:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+
+	if batchInterval > 0 {
+		go l.flushPeriodically()
+	} else {
+		close(l.stopped)
+	}
+
+	return l
+}
+
+// Records an event for the instance, with how long the attempt took, 0 for attempts that were skipped before starting
+func (l *EventLog) Record(instanceID int, kind string, message string, duration time.Duration) {
+
+	if l == nil {
+		return
+	}
+
+	// Batched events are written later, so the time is taken now rather than left to the DB default
+	event := backupEvent{
+		instanceID: instanceID,
+		kind:       kind,
+		message:    message,
+		duration:   duration,
+		createdAt:  time.Now().UTC().Format(dbTimeLayout),
+	}
+
+	l.mu.Lock()
+	l.pending = append(l.pending, event)
+	l.mu.Unlock()
+
+	if l.batchInterval <= 0 {
+		err := l.Flush()
+		if err != nil {
+			log.Printf("Could not record backup event: %v", err)
+		}
+	}
+}
+
+// Writes every pending event in a single transaction
+func (l *EventLog) Flush() error {
+
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := l.write(pending)
+	if err != nil {
+		// Keep the events for the next flush rather than losing them
+		l.mu.Lock()
+		l.pending = append(pending, l.pending...)
+		l.mu.Unlock()
+	}
+
+	return err
+}
+
+func (l *EventLog) write(pending []backupEvent) error {
+
+	transaction, err := l.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer func(transaction *sql.Tx) {
+		_ = transaction.Rollback()
+	}(transaction)
+
+	for _, event := range pending {
+		_, err = transaction.Exec("INSERT INTO backup_events (instance_id,kind,message,duration_ms,created_at) VALUES (?,?,?,?,?)",
+			event.instanceID, event.kind, event.message, event.duration.Milliseconds(), event.createdAt)
+		if err != nil {
+			return fmt.Errorf("Could not insert backup event: %v", err)
+		}
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return fmt.Errorf("Could not commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// Stops the periodic flush and writes whatever is still pending
+func (l *EventLog) Close() error {
+
+	if l == nil {
+		return nil
+	}
+
+	if l.batchInterval > 0 {
+		close(l.stop)
+		<-l.stopped
+	}
+
+	return l.Flush()
+}
+
+func (l *EventLog) flushPeriodically() {
+
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(l.batchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := l.Flush()
+			if err != nil {
+				log.Printf("Could not flush backup events: %v", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
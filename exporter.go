@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the backup duration histogram's buckets, in seconds
+var backupDurationBuckets = []float64{15, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// Results a backup is counted under
+const backupResultSuccess = "success"
+const backupResultFailure = "failure"
+const backupResultSkipped = "skipped"
+
+type durationHistogram struct {
+	counts []uint64 // Observations at or below each of backupDurationBuckets, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Live backup metrics for the /metrics endpoint, kept in memory since the process started
+// Unlike the metrics command, which reads totals from the DB, these include failures and durations
+type BackupMetrics struct {
+	mu           sync.Mutex
+	backups      map[[2]string]uint64 // Keyed by instance and result
+	durations    map[string]*durationHistogram
+	lastSaveSize map[string]int64
+}
+
+// Updated by backupInstance, whether or not the metrics server is running
+var backupMetrics = newBackupMetrics()
+
+func newBackupMetrics() *BackupMetrics {
+	return &BackupMetrics{
+		backups:      make(map[[2]string]uint64),
+		durations:    make(map[string]*durationHistogram),
+		lastSaveSize: make(map[string]int64),
+	}
+}
+
+// Counts a backup run, skipped runs aren't added to the duration histogram
+func (metrics *BackupMetrics) ObserveBackup(instance string, result string, duration time.Duration) {
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.backups[[2]string{instance, result}]++
+
+	if result == backupResultSkipped {
+		return
+	}
+
+	histogram, ok := metrics.durations[instance]
+	if !ok {
+		histogram = &durationHistogram{counts: make([]uint64, len(backupDurationBuckets))}
+		metrics.durations[instance] = histogram
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range backupDurationBuckets {
+		if seconds <= bound {
+			histogram.counts[i]++
+			break
+		}
+	}
+	histogram.sum += seconds
+	histogram.count++
+}
+
+func (metrics *BackupMetrics) SetLastSaveSize(instance string, size int64) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.lastSaveSize[instance] = size
+}
+
+// Writes the metrics in the Prometheus text format
+func (metrics *BackupMetrics) Write(w io.Writer) {
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP mcbackuper_backups_total Backup runs since startup by instance and result.")
+	fmt.Fprintln(w, "# TYPE mcbackuper_backups_total counter")
+	keys := make([][2]string, 0, len(metrics.backups))
+	for key := range metrics.backups {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b [2]string) int {
+		if a[0] != b[0] {
+			return strings.Compare(a[0], b[0])
+		}
+		return strings.Compare(a[1], b[1])
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "mcbackuper_backups_total{instance=%q,result=%q} %d\n", key[0], key[1], metrics.backups[key])
+	}
+
+	fmt.Fprintln(w, "# HELP mcbackuper_backup_duration_seconds Time taken by backups that weren't skipped.")
+	fmt.Fprintln(w, "# TYPE mcbackuper_backup_duration_seconds histogram")
+	for _, instance := range sortedKeys(metrics.durations) {
+		histogram := metrics.durations[instance]
+		var cumulative uint64
+		for i, bound := range backupDurationBuckets {
+			cumulative += histogram.counts[i]
+			fmt.Fprintf(w, "mcbackuper_backup_duration_seconds_bucket{instance=%q,le=%q} %d\n", instance, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "mcbackuper_backup_duration_seconds_bucket{instance=%q,le=\"+Inf\"} %d\n", instance, histogram.count)
+		fmt.Fprintf(w, "mcbackuper_backup_duration_seconds_sum{instance=%q} %v\n", instance, strconv.FormatFloat(histogram.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "mcbackuper_backup_duration_seconds_count{instance=%q} %d\n", instance, histogram.count)
+	}
+
+	fmt.Fprintln(w, "# HELP mcbackuper_last_save_size_bytes Size of the instance's last uploaded save.")
+	fmt.Fprintln(w, "# TYPE mcbackuper_last_save_size_bytes gauge")
+	for _, instance := range sortedKeys(metrics.lastSaveSize) {
+		fmt.Fprintf(w, "mcbackuper_last_save_size_bytes{instance=%q} %d\n", instance, metrics.lastSaveSize[instance])
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Starts serving /metrics, and the /healthz and /ready checks, on the port in the background
+// The endpoints are unauthenticated like most Prometheus exporters, so keep the port off the public internet
+func startMetricsServer(port int, metrics *BackupMetrics, db *sql.DB, healthMaxAge time.Duration) *http.Server {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.Write(w)
+	})
+	mux.HandleFunc("GET /healthz", healthzHandler(loopHealth, healthMaxAge))
+	mux.HandleFunc("GET /ready", readyHandler(db))
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Serving metrics on %v/metrics", server.Addr)
+	return server
+}
+
+// Stops the metrics server, giving an in-flight scrape a moment to finish
+func stopMetricsServer(server *http.Server) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Could not stop metrics server: %v", err)
+	}
+}
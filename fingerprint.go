@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files the server rewrites on every save even when nothing in the world changed
+var fingerprintIgnoredFiles = map[string]bool{
+	"level.dat":     true,
+	"level.dat_old": true,
+	"session.lock":  true,
+}
+
+// Hashes the contents of every file in the world, so two worlds with the same fingerprint have the same blocks,
+// entities and player data
+// The main world's paths are hashed relative to it, so its fingerprint is the same as before dir_name could list
+// several directories, and the other directories' paths start with their name
+func worldFingerprint(root string, dirs []string) (string, error) {
+
+	hash := sha256.New()
+
+	for i, dir := range dirs {
+
+		worldPath := filepath.Join(root, dir)
+		err := filepath.WalkDir(worldPath, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() || fingerprintIgnoredFiles[entry.Name()] {
+				return nil
+			}
+
+			relativePath, err := filepath.Rel(worldPath, path)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				relativePath = filepath.Join(dir, relativePath)
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func(file *os.File) {
+				_ = file.Close()
+			}(file)
+
+			// The path goes in too, so moving a file changes the fingerprint
+			_, _ = fmt.Fprintf(hash, "%v\x00%d\x00", relativePath, info.Size())
+			_, err = io.Copy(hash, file)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("could not fingerprint world: %v", err)
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Reports whether any file in the world was modified after since, stopping at the first one found
+// Only modification times are read, which is far cheaper than worldFingerprint but trusts the server to touch what it writes
+func worldChangedSince(root string, dirs []string, since time.Time) (bool, error) {
+
+	changed := false
+
+	for _, dir := range dirs {
+		err := filepath.WalkDir(filepath.Join(root, dir), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() || fingerprintIgnoredFiles[entry.Name()] {
+				return nil
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(since) {
+				changed = true
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			return false, fmt.Errorf("Could not check world for changes: %v", err)
+		}
+		if changed {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Returns when the tar of the instance's newest save started, which files modified since aren't in it
+// The row is written after the upload, so the tar and upload times recorded with it are taken off
+// Reports false when there is no save to compare against
+func lastSaveStarted(db *sql.DB, instance Instance) (time.Time, bool, error) {
+
+	var createdAt string
+	var tarDurationMs, uploadDurationMs int64
+
+	err := db.QueryRow("SELECT created_at, tar_duration_ms, upload_duration_ms FROM saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC, id DESC LIMIT 1",
+		instance.id).Scan(&createdAt, &tarDurationMs, &uploadDurationMs)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("Could not query last save: %v", err)
+	}
+
+	createdTime, err := parseDBTime(createdAt)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return createdTime.Add(-time.Duration(tarDurationMs+uploadDurationMs) * time.Millisecond), true, nil
+}
+
+// Length of the hash prefix put in archive names
+const archiveHashLength = 16
+
+// Returns the archive's name with a prefix of its SHA-256 added before the extension, e.g. world2024-01-01_00_00_00-3f2a9c0d1e4b5a6f.tar.gz
+func hashedArchiveName(fileName string) (string, error) {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", fmt.Errorf("Could not open archive: %v", err)
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", fmt.Errorf("Could not hash archive: %v", err)
+	}
+
+	extension := compressionExtensions[archiveFormat(fileName)]
+	sum := hex.EncodeToString(hash.Sum(nil))[:archiveHashLength]
+
+	return fmt.Sprintf("%v-%v%v", strings.TrimSuffix(fileName, extension), sum, extension), nil
+}
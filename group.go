@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BackupGroup archives several instances together into a single save
+type BackupGroup struct {
+	id              int
+	name            string
+	s3Bucket        string
+	prefix          string
+	workingPath     string // Where the combined archive is written before upload
+	intervalMinutes int
+	active          bool
+}
+
+func getBackupGroups(db *sql.DB) ([]BackupGroup, error) {
+
+	var groups []BackupGroup
+
+	rows, err := db.Query("SELECT id,name,s3_bucket,prefix,working_path,interval_minutes,active FROM backup_groups")
+	if err != nil {
+		return nil, fmt.Errorf("Could not query backup groups: %s", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Error closing rows: %s", err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		var group BackupGroup
+		err = rows.Scan(&group.id, &group.name, &group.s3Bucket, &group.prefix, &group.workingPath, &group.intervalMinutes, &group.active)
+		if err != nil {
+			return nil, fmt.Errorf("Error scanning row: %s", err)
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+// Backs up every active group whose interval has passed
+func runGroupBackups(db *sql.DB, instances []Instance, saveRetention int) {
+
+	groups, err := getBackupGroups(db)
+	if err != nil {
+		log.Printf("Could not get backup groups: %v", err)
+		return
+	}
+
+	for _, group := range groups {
+
+		if group.active == false {
+			continue
+		}
+
+		due, err := backupGroupDue(db, group)
+		if err != nil {
+			log.Printf("%v: Could not check group schedule: %v", group.name, err)
+			continue
+		}
+		if !due {
+			continue
+		}
+
+		var members []Instance
+		for _, instance := range instances {
+			if instance.groupID == group.id && instance.active {
+				members = append(members, instance)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+
+		err = removeOldGroupSaves(db, group, saveRetention-1) // The minus one is to account for the save that is about to happen
+		if err != nil {
+			log.Printf("Could not remove old group saves: %v", err)
+		}
+
+		err = backupGroup(db, group, members)
+		if err != nil {
+			notifier.NotifyFailure(NotificationData{Instance: group.name, Error: err.Error()})
+		}
+	}
+}
+
+// Checks whether the group's interval has passed since its last save
+func backupGroupDue(db *sql.DB, group BackupGroup) (bool, error) {
+
+	var createdAt string
+
+	err := db.QueryRow("SELECT created_at FROM group_saves WHERE group_id = ? ORDER BY created_at DESC, id DESC LIMIT 1", group.id).Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	lastSave, err := parseDBTime(createdAt)
+	if err != nil {
+		return false, err
+	}
+
+	return time.Since(lastSave) >= time.Duration(group.intervalMinutes)*time.Minute, nil
+}
+
+// Quiesces every member, tars all of their worlds into one archive and uploads it once
+// Each world is stored under its full path without the leading slash, e.g. home/mc/survival/world,
+// so a restore extracts just that sub-path.
+func backupGroup(db *sql.DB, group BackupGroup, members []Instance) error {
+
+	startTime := time.Now()
+
+	log.Printf("%v: Saving %d grouped instances...\n", group.name, len(members))
+
+	var worldPaths []string
+	paused := make(map[string]bool) // Members that are still frozen by pause_during_backup
+
+	for _, member := range members {
+
+		err := gameServer(member).PreBackup(context.Background(), member)
+
+		// Saving has to come back on for every member that was touched, whether or not the backup works
+		defer func(member Instance) {
+			if paused[member.containerName] {
+				err := unpauseContainer(member.containerName)
+				if err != nil {
+					log.Printf("%v: %v\n", member.containerName, err)
+				}
+			}
+			err := gameServer(member).PostBackup(member)
+			if err != nil {
+				log.Printf("%v: %v\n", member.containerName, err)
+			}
+		}(member)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", member.containerName, err)
+		}
+		paused[member.containerName] = member.pauseDuringBackup
+
+		for _, dir := range worldDirs(member) {
+			worldPath := filepath.Join(member.workingPath, dir)
+			worldPaths = append(worldPaths, strings.TrimPrefix(worldPath, "/"))
+		}
+	}
+
+	tarFileName := fmt.Sprintf("combined%v.tar.gz", getTime())
+	tarFilePath := filepath.Join(group.workingPath, tarFileName)
+
+	// Tar the worlds
+	// If it fails due to a changed during access, try again until it works
+	for {
+		output, err := runCommand("/bin/tar", append([]string{"-czf", tarFilePath, "-C", "/"}, worldPaths...)...)
+		if err != nil {
+			log.Printf("Could not compress worlds: %v, error: %v\n", output, err)
+
+			err = deleteFile(tarFilePath)
+			if err != nil {
+				return fmt.Errorf("Could not delete file: %v", err)
+			}
+
+			time.Sleep(5 * time.Second) // Time buffer to hopefully allow whatever happened to clear up
+			continue
+		}
+		break
+	}
+
+	// Unfreeze paused members as soon as the tar is written rather than after the upload
+	for _, member := range members {
+		if paused[member.containerName] {
+			paused[member.containerName] = false
+			err := unpauseContainer(member.containerName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Delete the tar file whether or not the upload works
+	defer func(tarFilePath string) {
+		err := deleteFile(tarFilePath)
+		if err != nil {
+			log.Printf("Could not delete tar file: %v\n", err)
+		}
+	}(tarFilePath)
+
+	err := S3Backend{bucket: group.s3Bucket, prefix: group.prefix, storageClass: s3StorageClass}.Upload(tarFilePath, tarFileName)
+	if err != nil {
+		return fmt.Errorf("Could not backup to S3: %v", err)
+	}
+
+	tarFileStats, err := os.Stat(tarFilePath)
+	if err != nil {
+		return fmt.Errorf("Could not stat tar file: %v", err)
+	}
+
+	// Only started once the upload is done, the DB has a single connection and would be held for the whole backup
+	transaction, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %s", err)
+	}
+
+	// If the function errors out, call rollback.
+	// If everything is successful and tx is committed, rollback should have no effect
+	defer func(transaction *sql.Tx) {
+		_ = transaction.Rollback()
+	}(transaction)
+
+	_, err = transaction.Exec("INSERT INTO group_saves (filename,size,group_id) VALUES (?,?,?)", tarFileName, tarFileStats.Size(), group.id)
+	if err != nil {
+		return fmt.Errorf("Could not insert group save record: %v", err)
+	}
+
+	err = commitUnlessDryRun(transaction, fmt.Sprintf("group save %v of %v", tarFileName, group.name))
+	if err != nil {
+		return fmt.Errorf("Could not commit transaction: %v", err)
+	}
+
+	for _, member := range members {
+		_ = say("Save successful!", member)
+	}
+	notifier.NotifySuccess(NotificationData{
+		Instance: group.name,
+		Filename: tarFileName,
+		Size:     tarFileStats.Size(),
+		Duration: time.Since(startTime),
+	})
+	return nil
+}
+
+func removeOldGroupSaves(db *sql.DB, group BackupGroup, saveRetention int) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	// If the function errors out, call rollback.
+	// If everything is successful and tx is committed, rollback should have no effect
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	// The saves are read through the transaction, the DB's only connection can't serve a query and a transaction at once
+	saveRecords, err := tx.Query("SELECT id,filename FROM group_saves WHERE deleted = 0 AND group_id = ? ORDER BY created_at DESC", group.id)
+	if err != nil {
+		return fmt.Errorf("Could not query DB: %v", err)
+	}
+
+	defer func(saveRecords *sql.Rows) {
+		err := saveRecords.Close()
+		if err != nil {
+			log.Printf("Error closing saves: %s", err)
+		}
+	}(saveRecords)
+
+	var fileName string
+	var id int
+	var failures []string          // A save whose file couldn't be deleted stays recorded, so it is tried again next cycle
+	var deleted []NotificationData // Reported once the deletions are committed
+	i := 0
+
+	for saveRecords.Next() {
+
+		err = saveRecords.Scan(&id, &fileName)
+		if err != nil {
+			return fmt.Errorf("Error scanning row: %s", err)
+		}
+
+		// The newest saveRetention saves are kept
+		i++
+		if i <= saveRetention {
+			continue
+		}
+
+		err = deleteS3File(fileName, group.s3Bucket, group.prefix, "")
+		if err != nil {
+			log.Printf("%v: Could not delete save file %v: %v\n", group.name, fileName, err)
+			failures = append(failures, fmt.Sprintf("%v: %v", fileName, err))
+			continue
+		}
+
+		_, err = tx.Exec("UPDATE group_saves SET deleted = 1 WHERE id = ?", id)
+		if err != nil {
+			return fmt.Errorf("Could not update group save record: %v", err)
+		}
+		deleted = append(deleted, NotificationData{Instance: group.name, Filename: fileName})
+	}
+	if err = saveRecords.Err(); err != nil {
+		return fmt.Errorf("Error reading saves: %v", err)
+	}
+
+	err = commitUnlessDryRun(tx, fmt.Sprintf("old group saves of %v as deleted", group.name))
+	if err != nil {
+		return fmt.Errorf("Could not commit transaction: %v", err)
+	}
+	notifyDeletions(deleted)
+
+	return pruneFailuresError(failures)
+}
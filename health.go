@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// When the backup loop last finished a pass, read by /healthz while the loop updates it
+type LoopHealth struct {
+	mu                sync.Mutex
+	lastLoopCompleted time.Time
+}
+
+// Counts the service as healthy from startup, so a long first pass isn't reported as a hung loop
+var loopHealth = &LoopHealth{lastLoopCompleted: time.Now()}
+
+func (health *LoopHealth) LoopCompleted() {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.lastLoopCompleted = time.Now()
+}
+
+func (health *LoopHealth) LastLoopCompleted() time.Time {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	return health.lastLoopCompleted
+}
+
+// Answers 200 if the loop finished a pass within maxAge, and 503 if it looks stuck
+func healthzHandler(health *LoopHealth, maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since := time.Since(health.LastLoopCompleted()).Round(time.Second)
+		if since > maxAge {
+			http.Error(w, fmt.Sprintf("backup loop last completed a pass %v ago", since), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "ok, backup loop last completed a pass %v ago\n", since)
+	}
+}
+
+// Answers 200 if the DB can be reached and every active instance's storage backend can be used, and 503 otherwise
+func readyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		err := db.PingContext(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("DB unreachable: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+
+		instances, err := getInstances(db)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not get instances: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		for _, instance := range instances {
+			if !instance.active {
+				continue
+			}
+			err = checkStorageBackend(instance)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%v: %v", instance.containerName, err), http.StatusServiceUnavailable)
+				return
+			}
+			for _, destination := range instance.destinations {
+				err = checkStorageBackend(destinationInstance(instance, destination))
+				if err != nil {
+					http.Error(w, fmt.Sprintf("%v: %v: %v", instance.containerName, destination, err), http.StatusServiceUnavailable)
+					return
+				}
+			}
+		}
+
+		_, _ = fmt.Fprintln(w, "ok")
+	}
+}
+
+// Checks what an instance's backend needs is in place, without contacting the remote end,
+// since a probe that runs every few seconds shouldn't make S3 requests or SSH connections
+func checkStorageBackend(instance Instance) error {
+
+	switch instance.backend {
+	case backendLocal:
+		info, err := os.Stat(instance.backendDir)
+		if err != nil {
+			return fmt.Errorf("backend directory unusable: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("backend directory %v is not a directory", instance.backendDir)
+		}
+	case backendSFTP:
+		_, err := exec.LookPath("sftp")
+		if err != nil {
+			return fmt.Errorf("sftp client not found: %v", err)
+		}
+	default:
+		return checkAWSCLI()
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// A row of the saves table as exported by "history export"
+// The JSON names are also the CSV header
+type historyRecord struct {
+	ID           int    `json:"id"`
+	Filename     string `json:"filename"`
+	Size         int64  `json:"size"`
+	CreatedAt    string `json:"created_at"`
+	Deleted      bool   `json:"deleted"`
+	StorageClass string `json:"storage_class"`
+	Format       string `json:"format"`
+	Deduped      bool   `json:"deduped"`
+	ParentID     int64  `json:"parent_id"`
+	SaveType     string `json:"save_type"`
+	Players      string `json:"players"`
+	Bucket       string `json:"s3_bucket"`
+	Region       string `json:"region"`
+	Prefix       string `json:"prefix"`
+	Version      string `json:"version"`
+}
+
+var historyHeader = []string{"id", "filename", "size", "created_at", "deleted", "storage_class", "format", "deduped", "parent_id", "save_type", "players", "s3_bucket", "region", "prefix", "version"}
+
+// Handles "history <action>", currently only "history export"
+func historyCommand(db *sql.DB, args []string) error {
+
+	if len(args) == 0 || args[0] != "export" {
+		return fmt.Errorf("usage: history export --instance <name> [--format csv|json] [--since YYYY-MM-DD] [--until YYYY-MM-DD]")
+	}
+
+	flags := flag.NewFlagSet("history export", flag.ContinueOnError)
+	instanceName := flags.String("instance", "", "Container name of the instance to export the save history of")
+	format := flags.String("format", "csv", "Output format, csv or json")
+	since := flags.String("since", "", "Only export saves taken on or after this date (UTC), YYYY-MM-DD")
+	until := flags.String("until", "", "Only export saves taken before the end of this date (UTC), YYYY-MM-DD")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	if *instanceName == "" {
+		return fmt.Errorf("--instance is required")
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("invalid format %v, expected csv or json", *format)
+	}
+
+	// created_at is stored as UTC text, so the range is compared as text in the same layout
+	// The bounds must look like timestamps, a bare number would be compared as one against the BIGINT column
+	from, to := "0000-01-01 00:00:00", "9999-12-31 23:59:59"
+	if *since != "" {
+		day, err := time.Parse("2006-01-02", *since)
+		if err != nil {
+			return fmt.Errorf("invalid --since date: %v", err)
+		}
+		from = day.Format(dbTimeLayout)
+	}
+	if *until != "" {
+		day, err := time.Parse("2006-01-02", *until)
+		if err != nil {
+			return fmt.Errorf("invalid --until date: %v", err)
+		}
+		to = day.Add(24 * time.Hour).Format(dbTimeLayout)
+	}
+
+	instance, err := getInstanceByName(db, *instanceName)
+	if err != nil {
+		return err
+	}
+
+	records, err := getHistory(db, instance, from, to)
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	}
+
+	writer := csv.NewWriter(os.Stdout)
+	err = writer.Write(historyHeader)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		err = writer.Write([]string{
+			strconv.Itoa(record.ID), record.Filename, strconv.FormatInt(record.Size, 10), record.CreatedAt,
+			strconv.FormatBool(record.Deleted), record.StorageClass, record.Format, strconv.FormatBool(record.Deduped),
+			strconv.FormatInt(record.ParentID, 10), record.SaveType, record.Players, record.Bucket, record.Region, record.Prefix, record.Version,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// Returns every save of the instance taken in [from, to), deleted or not, oldest first
+func getHistory(db *sql.DB, instance Instance, from string, to string) ([]historyRecord, error) {
+
+	rows, err := db.Query("SELECT id,filename,size,created_at,deleted,storage_class,format,deduped,COALESCE(parent_id,0),save_type,players,s3_bucket,region,prefix,version FROM saves WHERE instance_id = ? AND created_at >= ? AND created_at < ? ORDER BY created_at, id",
+		instance.id, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query DB: %v", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Error closing rows: %s", err)
+		}
+	}(rows)
+
+	records := []historyRecord{}
+
+	for rows.Next() {
+		var record historyRecord
+		err = rows.Scan(&record.ID, &record.Filename, &record.Size, &record.CreatedAt, &record.Deleted, &record.StorageClass, &record.Format,
+			&record.Deduped, &record.ParentID, &record.SaveType, &record.Players, &record.Bucket, &record.Region, &record.Prefix, &record.Version)
+		if err != nil {
+			return nil, fmt.Errorf("Error scanning row: %s", err)
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Runs one of the instance's pre_backup_cmd or post_backup_cmd with the backup's details added to the environment
+// Like player_count_cmd the command is a single line split on whitespace and run without a shell,
+// so anything that needs quoting or pipes belongs in a script
+func runBackupHook(command string, instance Instance, env ...string) error {
+
+	parts := strings.Fields(command)
+	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.Env = append(os.Environ(), "MCBACKUPER_INSTANCE="+instance.containerName, "MCBACKUPER_WORKING_PATH="+instance.workingPath)
+	cmd.Env = append(cmd.Env, env...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v failed: %v", parts[0], newCommandError(output, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A file in the world as recorded in a save's manifest
+type worldFile struct {
+	size     int64
+	modified int64 // Modification time in Unix nanoseconds
+}
+
+// Walks the world directories under root and returns their files keyed by their path in the archive, e.g. ./world/region/r.0.0.mca
+func scanWorld(root string, dirs []string) (map[string]worldFile, error) {
+
+	files := make(map[string]worldFile)
+
+	for _, dir := range dirs {
+		err := filepath.WalkDir(filepath.Join(root, dir), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() || entry.Name() == "session.lock" {
+				return nil
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			relative, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+
+			files["./"+filepath.ToSlash(relative)] = worldFile{size: info.Size(), modified: info.ModTime().UnixNano()}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Could not scan world: %v", err)
+		}
+	}
+
+	return files, nil
+}
+
+// Returns the files that are new or whose size or modification time changed since the previous manifest, sorted
+func changedFiles(current map[string]worldFile, previous map[string]worldFile) []string {
+
+	var changed []string
+	for path, file := range current {
+		if previousFile, ok := previous[path]; !ok || previousFile != file {
+			changed = append(changed, path)
+		}
+	}
+	slices.Sort(changed)
+
+	return changed
+}
+
+// Returns the save a new delta would be taken against and its manifest
+// The ID is 0 when the next save has to be a full one, because there is no previous manifest or the chain is already full length
+func deltaBase(transaction *sql.Tx, instance Instance) (int, int, map[string]worldFile, error) {
+
+	var id, chainPosition, files int
+
+	err := transaction.QueryRow("SELECT id, chain_position, (SELECT COUNT(*) FROM save_files WHERE save_id = saves.id) FROM saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC, id DESC LIMIT 1",
+		instance.id).Scan(&id, &chainPosition, &files)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil, nil
+	}
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("Could not query latest save: %v", err)
+	}
+
+	// Saves taken before incremental mode was turned on have no manifest to compare against
+	if files == 0 || chainPosition+1 >= instance.fullEvery {
+		return 0, 0, nil, nil
+	}
+
+	manifest, err := readManifest(transaction, id)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return id, chainPosition + 1, manifest, nil
+}
+
+func readManifest(transaction *sql.Tx, saveID int) (map[string]worldFile, error) {
+
+	rows, err := transaction.Query("SELECT path, size, modified FROM save_files WHERE save_id = ?", saveID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query manifest: %v", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Error closing rows: %s", err)
+		}
+	}(rows)
+
+	manifest := make(map[string]worldFile)
+	var path string
+	var file worldFile
+
+	for rows.Next() {
+		err = rows.Scan(&path, &file.size, &file.modified)
+		if err != nil {
+			return nil, fmt.Errorf("Error scanning row: %s", err)
+		}
+		manifest[path] = file
+	}
+
+	return manifest, rows.Err()
+}
+
+// Stores the full list of the world's files with the save, so the next delta and restores know what the world held
+func writeManifest(transaction *sql.Tx, saveID int64, manifest map[string]worldFile) error {
+
+	statement, err := transaction.Prepare("INSERT INTO save_files (save_id,path,size,modified) VALUES (?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Could not prepare manifest insert: %v", err)
+	}
+	defer func(statement *sql.Stmt) {
+		_ = statement.Close()
+	}(statement)
+
+	for path, file := range manifest {
+		_, err = statement.Exec(saveID, path, file.size, file.modified)
+		if err != nil {
+			return fmt.Errorf("Could not insert manifest entry: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Writes the paths to a file for tar -T, one per line
+func writeFileList(paths []string) (string, error) {
+
+	list, err := os.CreateTemp("", "mcbackuper-delta-")
+	if err != nil {
+		return "", fmt.Errorf("Could not create file list: %v", err)
+	}
+
+	_, err = list.WriteString(strings.Join(paths, "\n") + "\n")
+	if closeErr := list.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(list.Name())
+		return "", fmt.Errorf("Could not write file list: %v", err)
+	}
+
+	return list.Name(), nil
+}
+
+// Returns the save and the saves it is a delta of, starting from the full save it is built on
+func saveChain(db *sql.DB, instance Instance, save Save) ([]Save, error) {
+
+	chain := []Save{save}
+
+	for save.parentID.Valid {
+		parent, err := getSave(db, instance, int(save.parentID.Int64))
+		if err != nil {
+			return nil, fmt.Errorf("could not load save %d that save %d is a delta of: %v", save.parentID.Int64, save.id, err)
+		}
+		chain = append(chain, parent)
+		save = parent
+	}
+
+	slices.Reverse(chain)
+	return chain, nil
+}
+
+// Deletes files left behind by earlier saves in the chain that were no longer in the world when the save was taken
+// Saves without a manifest are full saves taken outside incremental mode and are left as extracted
+func removeDeletedFiles(db *sql.DB, saveID int, root string, dirs []string) error {
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer func(transaction *sql.Tx) {
+		_ = transaction.Rollback()
+	}(transaction)
+
+	manifest, err := readManifest(transaction, saveID)
+	if err != nil {
+		return err
+	}
+	if len(manifest) == 0 {
+		return nil
+	}
+
+	// A directory added to dir_name after the save was taken isn't in it
+	var extractedDirs []string
+	for _, dir := range dirs {
+		if fileExists(filepath.Join(root, dir)) {
+			extractedDirs = append(extractedDirs, dir)
+		}
+	}
+
+	extracted, err := scanWorld(root, extractedDirs)
+	if err != nil {
+		return err
+	}
+
+	for path := range extracted {
+		if _, ok := manifest[path]; !ok {
+			err = os.Remove(filepath.Join(root, filepath.FromSlash(path)))
+			if err != nil {
+				return fmt.Errorf("could not remove deleted file %v: %v", path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// How incremental saves find the files that changed, set per instance with incremental_method
+const incrementalManifest = "manifest" // Compare the world against the file list recorded with the previous save
+const incrementalTar = "tar"           // Let tar --listed-incremental compare it against its snapshot file
+
+// What a save holds, recorded in saves.save_type
+const saveTypeFull = "full"
+const saveTypeDelta = "delta"             // Files that changed since its parent, found by comparing manifests
+const saveTypeIncremental = "incremental" // tar --listed-incremental archive of the changes since its parent, deletions included
+
+// Set in main() from snapshot_dir
+var snapshotDir = SNAPSHOT_DIR
+
+// The snapshot file tar --listed-incremental reads and updates while it archives an instance's world
+// tar works on a copy, which only replaces the base save's snapshot once the new save is recorded,
+// so a failed upload or a dry run leaves the next save to be taken against the last recorded one
+type tarSnapshot struct {
+	instanceID int
+	baseID     int    // Save the snapshot was taken with, 0 for a full save
+	workPath   string // Copy tar updates, passed to --listed-incremental
+}
+
+// Snapshot file kept for a save, e.g. snapshots/3-120.snar
+func snapshotPath(instanceID int, saveID int) string {
+	return filepath.Join(snapshotDir, fmt.Sprintf("%d-%d.snar", instanceID, saveID))
+}
+
+// Returns the save the next tar incremental save is taken against and its chain position
+// The ID is 0 when the next save has to be a full one, because the chain is already full length
+// or there is no snapshot for the latest save, e.g. it was taken in manifest mode or the snapshot was lost
+func tarIncrementalBase(transaction *sql.Tx, instance Instance) (int, int, error) {
+
+	var id, chainPosition int
+
+	err := transaction.QueryRow("SELECT id, chain_position FROM saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC, id DESC LIMIT 1",
+		instance.id).Scan(&id, &chainPosition)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not query latest save: %v", err)
+	}
+
+	if chainPosition+1 >= instance.fullEvery || !fileExists(snapshotPath(instance.id, id)) {
+		return 0, 0, nil
+	}
+
+	return id, chainPosition + 1, nil
+}
+
+func newTarSnapshot(instance Instance, baseID int) (*tarSnapshot, error) {
+
+	err := os.MkdirAll(snapshotDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create snapshot directory: %v", err)
+	}
+
+	return &tarSnapshot{
+		instanceID: instance.id,
+		baseID:     baseID,
+		workPath:   filepath.Join(snapshotDir, fmt.Sprintf("%d.snar.partial", instance.id)),
+	}, nil
+}
+
+// Puts the base save's snapshot back in the working copy, or removes it for a full save
+// Run before each tar attempt, as a failed attempt has already updated the copy
+func (s *tarSnapshot) reset() error {
+
+	err := os.Remove(s.workPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove snapshot: %v", err)
+	}
+
+	if s.baseID == 0 {
+		return nil
+	}
+
+	err = copyFile(snapshotPath(s.instanceID, s.baseID), s.workPath)
+	if err != nil {
+		return fmt.Errorf("Could not copy snapshot: %v", err)
+	}
+
+	return nil
+}
+
+// Keeps the working copy as the snapshot of the recorded save, and removes the instance's older snapshots
+// Only the latest save's snapshot is ever used, a restore doesn't need them
+func (s *tarSnapshot) commit(saveID int64) error {
+
+	kept := snapshotPath(s.instanceID, int(saveID))
+
+	err := os.Rename(s.workPath, kept)
+	if err != nil {
+		return fmt.Errorf("Could not keep snapshot, the next save will be a full one: %v", err)
+	}
+
+	snapshots, err := filepath.Glob(filepath.Join(snapshotDir, fmt.Sprintf("%d-*.snar", s.instanceID)))
+	if err != nil {
+		return fmt.Errorf("Could not list snapshots: %v", err)
+	}
+	for _, snapshot := range snapshots {
+		if snapshot == kept {
+			continue
+		}
+		err = os.Remove(snapshot)
+		if err != nil {
+			return fmt.Errorf("Could not remove old snapshot: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Removes the working copy, which is already gone after a commit
+func (s *tarSnapshot) discard() {
+	_ = os.Remove(s.workPath)
+}
+
+// Size of the files modified since the base save's snapshot was written, which is roughly what tar will archive
+func changedSince(files map[string]worldFile, snapshot string) (int64, error) {
+
+	info, err := os.Stat(snapshot)
+	if err != nil {
+		return 0, fmt.Errorf("Could not stat snapshot: %v", err)
+	}
+
+	var size int64
+	for _, file := range files {
+		if file.modified >= info.ModTime().UnixNano() {
+			size = size + file.size
+		}
+	}
+
+	return size, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Holds an exclusive flock on lock_file_path for as long as the backup loop runs, so a second copy of the service
+// can't save-off and tar the same worlds or write to the same DB
+// The kernel drops the lock when the process exits however it exits, so a crash never leaves a stale lock behind
+type LockFile struct {
+	file *os.File
+}
+
+// Takes the lock and writes our PID into the file, failing straight away if another process holds it
+func acquireLockFile(path string) (*LockFile, error) {
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open lock file %v: %v", path, err)
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("another copy of the service is already running (PID %v holds %v)", lockHolder(path), path)
+		}
+		return nil, fmt.Errorf("Could not lock %v: %v", path, err)
+	}
+
+	// The PID is only for people looking at the file, the flock is what guards against a second copy
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("Could not write PID to lock file %v: %v", path, err)
+	}
+
+	return &LockFile{file: file}, nil
+}
+
+// Returns the PID written in the lock file, or "unknown" if it can't be read
+func lockHolder(path string) string {
+
+	contents, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(contents)) == "" {
+		return "unknown"
+	}
+
+	return strings.TrimSpace(string(contents))
+}
+
+// Clears the PID and releases the lock
+// The file itself is left in place: removing it would let a copy that opened it just before lock a file that
+// no longer has a path, while a new copy locks a fresh one at the same path
+func (lock *LockFile) Release() error {
+
+	_ = lock.file.Truncate(0)
+
+	err := syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		_ = lock.file.Close()
+		return err
+	}
+
+	return lock.file.Close()
+}
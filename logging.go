@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats accepted for log_format
+const logFormatText = "text"
+const logFormatJSON = "json"
+
+// Sends the log package's output to w, as the usual plain lines or as one JSON object per line
+func setupLogging(w io.Writer, format string) {
+
+	if format != logFormatJSON {
+		log.SetOutput(w)
+		return
+	}
+
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && attr.Key == slog.TimeKey {
+				attr.Key = "timestamp"
+			}
+			return attr
+		},
+	})
+
+	// Once slog has a handler of its own, log.Printf and friends go through it
+	slog.SetDefault(slog.New(logLineHandler{handler}))
+}
+
+// Turns the service's log lines into structured entries, following the conventions the messages are written in:
+// "<container>: <message>" for messages about an instance, "Warning: " for warnings, and "Could not <do something>: <error>"
+// or "<something> failed: <error>" for errors
+type logLineHandler struct {
+	slog.Handler
+}
+
+func (h logLineHandler) Handle(ctx context.Context, record slog.Record) error {
+
+	message := strings.TrimSpace(record.Message)
+	level := record.Level
+	var attrs []slog.Attr
+
+	if instance, rest, found := strings.Cut(message, ": "); found && instance != "Warning" && !strings.ContainsAny(instance, " []") {
+		attrs = append(attrs, slog.String("instance", instance))
+		message = rest
+	}
+
+	if rest, found := strings.CutPrefix(message, "Warning: "); found {
+		level = slog.LevelWarn
+		message = rest
+	}
+
+	if strings.HasPrefix(message, "Could not") || strings.HasPrefix(message, "Error") || strings.Contains(message, " failed") {
+		level = slog.LevelError
+	}
+
+	if level >= slog.LevelWarn {
+		if text, err, found := strings.Cut(message, ": "); found {
+			message = text
+			attrs = append(attrs, slog.String("error", err))
+		}
+	}
+
+	structured := slog.NewRecord(record.Time, level, message, record.PC)
+	structured.AddAttrs(attrs...)
+	record.Attrs(func(attr slog.Attr) bool {
+		structured.AddAttrs(attr)
+		return true
+	})
+
+	return h.Handler.Handle(ctx, structured)
+}
+
+func (h logLineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logLineHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h logLineHandler) WithGroup(name string) slog.Handler {
+	return logLineHandler{h.Handler.WithGroup(name)}
+}
+
+// Layout of the time added to the names of rotated log files, e.g. log-2024-01-01T00-00-00.000.log
+const rotatedLogTimeLayout = "2006-01-02T15-04-05.000"
+
+// A log file that is renamed aside once it reaches maxSize and replaced with an empty one,
+// keeping at most maxBackups rotated files and none older than maxAge
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int           // 0 keeps every rotated file
+	maxAge     time.Duration // 0 keeps rotated files however old they are
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Opens the log file for appending, creating it if needed
+func newRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*RotatingFile, error) {
+
+	rotating := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, maxAge: maxAge}
+
+	err := rotating.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return rotating, nil
+}
+
+func (r *RotatingFile) open() error {
+
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A line is never split across files, so a single line bigger than maxSize still goes in whole
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			// Carry on in the full file rather than lose the line, the rotation is tried again on the next write
+			fmt.Fprintf(os.Stderr, "Could not rotate log file: %v\n", err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size = r.size + int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// Renames the current file aside with the time in its name, opens a new one and removes the rotated files that are no longer kept
+func (r *RotatingFile) rotate() error {
+
+	err := r.file.Close()
+	if err != nil {
+		return err
+	}
+
+	extension := filepath.Ext(r.path)
+	rotatedPath := fmt.Sprintf("%v-%v%v", strings.TrimSuffix(r.path, extension), time.Now().Format(rotatedLogTimeLayout), extension)
+
+	renameErr := os.Rename(r.path, rotatedPath)
+
+	// The file has to be reopened whether or not the rename worked, the logger still needs somewhere to write
+	err = r.open()
+	if err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	return r.removeOldBackups()
+}
+
+// Deletes rotated files past maxBackups, oldest first, and those older than maxAge
+func (r *RotatingFile) removeOldBackups() error {
+
+	extension := filepath.Ext(r.path)
+	pattern := fmt.Sprintf("%v-*%v", strings.TrimSuffix(r.path, extension), extension)
+
+	// The time in the names sorts them by age, newest first once reversed
+	backups, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	slices.Sort(backups)
+	slices.Reverse(backups)
+
+	for i, backup := range backups {
+
+		expired := false
+		if r.maxAge > 0 {
+			info, err := os.Stat(backup)
+			expired = err == nil && time.Since(info.ModTime()) > r.maxAge
+		}
+
+		if (r.maxBackups > 0 && i >= r.maxBackups) || expired {
+			err = os.Remove(backup)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -1,18 +1,45 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// How long a DB write waits for a lock held elsewhere before failing. Set in main() from the config
+var dbBusyTimeout = DB_BUSY_TIMEOUT_MS * time.Millisecond
+
+// Adds the connection parameters to the DB path, which may be a file: URI or already carry parameters of its own
+// Parameters already in the path win, since the driver reads the first value of each
+func sqliteDSN(path string, params url.Values) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + params.Encode()
+}
+
 // Create the DB connection and create the tables if they don't already exist
 func initDB(path string) *sql.DB {
 
@@ -26,7 +53,7 @@ func initDB(path string) *sql.DB {
 		prefix TEXT NOT NULL,
 		working_path TEXT NOT NULL,
 		active BOOLEAN DEFAULT TRUE NOT NULL,
-		created_at BIGINT DEFAULT CURRENT_TIMESTAMP
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP
 	);
 	
 	CREATE TABLE IF NOT EXISTS saves (
@@ -34,15 +61,128 @@ func initDB(path string) *sql.DB {
 		filename VARCHAR(255) NOT NULL,
 		deleted BOOLEAN NOT NULL DEFAULT FALSE,
 		size BIGINT NOT NULL,
-		created_at BIGINT DEFAULT CURRENT_TIMESTAMP,
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+		instance_id INT NOT NULL,
+		FOREIGN KEY (instance_id) REFERENCES instances(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS backup_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name VARCHAR(255) NOT NULL UNIQUE,
+		s3_bucket VARCHAR(255) NOT NULL,
+		prefix TEXT NOT NULL,
+		working_path TEXT NOT NULL,
+		interval_minutes INT NOT NULL DEFAULT 1440,
+		active BOOLEAN DEFAULT TRUE NOT NULL,
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS group_saves (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename VARCHAR(255) NOT NULL,
+		deleted BOOLEAN NOT NULL DEFAULT FALSE,
+		size BIGINT NOT NULL,
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+		group_id INT NOT NULL,
+		FOREIGN KEY (group_id) REFERENCES backup_groups(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS zstd_dictionaries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename VARCHAR(255) NOT NULL,
+		size BIGINT NOT NULL,
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+		instance_id INT NOT NULL,
+		FOREIGN KEY (instance_id) REFERENCES instances(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS restore_drills (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename VARCHAR(255) NOT NULL,
+		success BOOLEAN NOT NULL,
+		message TEXT,
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+		instance_id INT NOT NULL,
+		FOREIGN KEY (instance_id) REFERENCES instances(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS backup_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind VARCHAR(255) NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+		instance_id INT NOT NULL,
+		FOREIGN KEY (instance_id) REFERENCES instances(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS playerdata_saves (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename VARCHAR(255) NOT NULL,
+		deleted BOOLEAN NOT NULL DEFAULT FALSE,
+		size BIGINT NOT NULL,
+		prefix TEXT NOT NULL,
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+		instance_id INT NOT NULL,
+		FOREIGN KEY (instance_id) REFERENCES instances(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS digests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS database_backups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename VARCHAR(255) NOT NULL,
+		size BIGINT NOT NULL,
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS save_files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		save_id INT NOT NULL,
+		path TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		modified BIGINT NOT NULL,
+		FOREIGN KEY (save_id) REFERENCES saves(id)
+	);
+	CREATE INDEX IF NOT EXISTS save_files_save_id ON save_files (save_id);
+
+	CREATE TABLE IF NOT EXISTS destinations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		backend TEXT NOT NULL,
+		backend_dir TEXT NOT NULL DEFAULT '',
+		s3_bucket TEXT NOT NULL DEFAULT '',
+		region TEXT NOT NULL DEFAULT '',
+		sftp_host TEXT NOT NULL DEFAULT '',
+		sftp_port INT NOT NULL DEFAULT 22,
+		sftp_user TEXT NOT NULL DEFAULT '',
+		sftp_key_path TEXT NOT NULL DEFAULT '',
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP,
 		instance_id INT NOT NULL,
 		FOREIGN KEY (instance_id) REFERENCES instances(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS save_copies (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		save_id INT NOT NULL,
+		destination_id INT NOT NULL,
+		created_at TEXT DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (save_id) REFERENCES saves(id),
+		FOREIGN KEY (destination_id) REFERENCES destinations(id)
 	);`
 
-	db, err := sql.Open("sqlite3", path)
+	// WAL lets the API and the DB backup read while a backup writes, and a lock held by another process is waited for rather than failing straight away
+	db, err := sql.Open("sqlite3", sqliteDSN(path, url.Values{
+		"_busy_timeout": {strconv.FormatInt(dbBusyTimeout.Milliseconds(), 10)},
+		"_journal_mode": {"WAL"},
+	}))
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Could not open DB: %s", err))
 	}
+	// SQLite only has one writer, so concurrent backups, the event log and the API queue up for a single connection
+	// rather than racing each other for the write lock
+	db.SetMaxOpenConns(1)
 	err = db.Ping()
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Could not ping DB: %s", err))
@@ -53,10 +193,179 @@ func initDB(path string) *sql.DB {
 		log.Fatalf("Could not create tables: %s", err)
 	}
 
+	for _, migration := range schemaMigrations {
+		err = addColumnIfMissing(db, migration.table, migration.column, migration.definition)
+		if err != nil {
+			log.Fatalf("Could not migrate DB: %s", err)
+		}
+	}
+
+	err = normalizeCreatedAt(db)
+	if err != nil {
+		log.Fatalf("Could not migrate DB: %s", err)
+	}
+
+	// Deltas recorded before save_type was added are marked by their parent alone
+	_, err = db.Exec("UPDATE saves SET save_type = ? WHERE parent_id IS NOT NULL AND save_type = ?", saveTypeDelta, saveTypeFull)
+	if err != nil {
+		log.Fatalf("Could not migrate DB: %s", err)
+	}
+
 	return db
 
 }
 
+// Columns added after the initial schema.
+// They are applied with ALTER TABLE so that existing databases pick them up as well.
+var schemaMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"instances", "transition_storage_class", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"saves", "storage_class", "VARCHAR(255) NOT NULL DEFAULT 'STANDARD'"},
+	{"instances", "restore_drill_image", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "restore_drill_interval_hours", "INT NOT NULL DEFAULT 24"},
+	{"instances", "nfs_mode", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"instances", "group_id", "INT REFERENCES backup_groups(id)"},
+	{"instances", "write_canary", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"saves", "canary", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "max_load_average", "REAL NOT NULL DEFAULT 0"},
+	{"instances", "tar_blocking_factor", "INT NOT NULL DEFAULT 0"},
+	{"instances", "pause_during_backup", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"instances", "min_backup_gap_minutes", "INT NOT NULL DEFAULT 0"},
+	{"instances", "zstd_dictionary", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"saves", "dictionary_id", "INT REFERENCES zstd_dictionaries(id)"},
+	{"instances", "disk_read_limit_kbps", "INT NOT NULL DEFAULT 0"},
+	{"instances", "failover_bucket", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "failover_region", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"saves", "s3_bucket", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"saves", "region", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "record_players", "BOOL NOT NULL DEFAULT 0"},
+	{"saves", "players", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "save_command", "VARCHAR(255) NOT NULL DEFAULT 'save-all flush'"},
+	{"instances", "empty_confirmations", "INT NOT NULL DEFAULT 1"},
+	{"instances", "dedupe_unchanged", "BOOL NOT NULL DEFAULT 0"},
+	{"saves", "fingerprint", "TEXT NOT NULL DEFAULT ''"},
+	{"saves", "deduped", "BOOL NOT NULL DEFAULT 0"},
+	{"instances", "player_count_cmd", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "player_count_regex", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "key_layout", "VARCHAR(255) NOT NULL DEFAULT 'flat'"},
+	{"saves", "prefix", "TEXT NOT NULL DEFAULT ''"},
+	{"saves", "version", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "playerdata_interval_minutes", "INT NOT NULL DEFAULT 0"},
+	{"instances", "playerdata_prefix", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "playerdata_paths", "TEXT NOT NULL DEFAULT 'playerdata,stats,advancements'"},
+	{"instances", "compression_formats", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "stop_timeout_seconds", "INT NOT NULL DEFAULT 120"},
+	{"saves", "format", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "incremental", "BOOL NOT NULL DEFAULT 0"},
+	{"instances", "full_every", "INT NOT NULL DEFAULT 7"},
+	{"saves", "parent_id", "INT"},
+	{"saves", "chain_position", "INT NOT NULL DEFAULT 0"},
+	{"instances", "presence_notifications", "BOOL NOT NULL DEFAULT 0"},
+	{"instances", "watched_players", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "hash_in_filename", "BOOL NOT NULL DEFAULT 0"},
+	{"instances", "bucket_quota_bytes", "BIGINT NOT NULL DEFAULT 0"},
+	{"instances", "backup_interval_minutes", "INT NOT NULL DEFAULT 0"},
+	{"saves", "checksum", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "verify_uploads", "BOOL NOT NULL DEFAULT 1"},
+	{"instances", "backend", "VARCHAR(255) NOT NULL DEFAULT 's3'"},
+	{"instances", "backend_dir", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "server_type", "VARCHAR(255) NOT NULL DEFAULT 'minecraft'"},
+	{"instances", "backup_when_empty", "BOOL NOT NULL DEFAULT 0"},
+	{"instances", "sftp_host", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "sftp_port", "INT NOT NULL DEFAULT 22"},
+	{"instances", "sftp_user", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "sftp_key_path", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"backup_events", "duration_ms", "BIGINT NOT NULL DEFAULT 0"},
+	{"instances", "storage_class", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "backup_trigger", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "backup_trigger_interval_minutes", "INT NOT NULL DEFAULT 15"},
+	{"instances", "retention_days", "INT NOT NULL DEFAULT 0"},
+	{"instances", "retention_mode", "VARCHAR(16) NOT NULL DEFAULT 'either'"},
+	{"instances", "rcon_host", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"instances", "rcon_port", "INT NOT NULL DEFAULT 25575"},
+	{"instances", "rcon_password", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "pre_backup_cmd", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "post_backup_cmd", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "encrypt", "BOOL NOT NULL DEFAULT 0"},
+	{"saves", "encryption", "VARCHAR(32) NOT NULL DEFAULT ''"},
+	{"instances", "region", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"saves", "world_size", "BIGINT NOT NULL DEFAULT 0"},
+	{"saves", "tar_duration_ms", "INT NOT NULL DEFAULT 0"},
+	{"saves", "upload_duration_ms", "INT NOT NULL DEFAULT 0"},
+	{"instances", "only_when_changed", "BOOL NOT NULL DEFAULT 0"},
+	{"instances", "cron", "TEXT NOT NULL DEFAULT ''"},
+	{"instances", "incremental_method", "VARCHAR(16) NOT NULL DEFAULT 'manifest'"},
+	{"saves", "save_type", "VARCHAR(16) NOT NULL DEFAULT 'full'"},
+}
+
+// addColumnIfMissing adds the column to the table unless the table already has it
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("could not read columns of %v: %v", table, err)
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Error closing rows: %s", err)
+		}
+	}(rows)
+
+	var cid, notNull, primaryKey int
+	var name, columnType string
+	var defaultValue sql.NullString
+
+	for rows.Next() {
+		err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey)
+		if err != nil {
+			return fmt.Errorf("could not scan columns of %v: %v", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("could not add column %v to %v: %v", column, table, err)
+	}
+
+	return nil
+}
+
+// Timestamps written by CURRENT_TIMESTAMP are UTC strings in this layout
+const dbTimeLayout = "2006-01-02 15:04:05"
+
+// Tables with a created_at column
+var createdAtTables = []string{"instances", "saves", "backup_groups", "group_saves", "zstd_dictionaries", "restore_drills", "backup_events", "playerdata_saves", "digests", "database_backups"}
+
+// created_at used to be declared BIGINT, but CURRENT_TIMESTAMP has always filled it with dbTimeLayout text, which the
+// service sorts, compares and parses as such. SQLite can't change a column's type in place, so databases created
+// before it was declared TEXT keep the old declaration, and this converts any Unix timestamps written into them by
+// hand or by other tools to the same text, so they sort and parse with the rest. A TEXT column stores such a number
+// as text, so all-digit text is converted as well
+func normalizeCreatedAt(db *sql.DB) error {
+
+	for _, table := range createdAtTables {
+		_, err := db.Exec(fmt.Sprintf("UPDATE %s SET created_at = datetime(created_at, 'unixepoch') WHERE typeof(created_at) IN ('integer', 'real') OR (created_at != '' AND created_at NOT GLOB '*[^0-9]*')", table))
+		if err != nil {
+			return fmt.Errorf("could not normalize created_at of %v: %v", table, err)
+		}
+	}
+
+	return nil
+}
+
+// parseDBTime parses a created_at value written by the DB
+func parseDBTime(value string) (time.Time, error) {
+	return time.ParseInLocation(dbTimeLayout, value, time.UTC)
+}
+
 func fileExists(filename string) bool {
 	_, err := os.Stat(filename)
 	if err == nil {
@@ -68,266 +377,1388 @@ func fileExists(filename string) bool {
 	return false // Error occurred (e.g., permission denied)
 }
 
-// runCommand takes a command string, executes it, and returns the output or an error
-func runCommand(command string) (string, error) {
-	// Split the command string into command name and arguments
-	parts := strings.Fields(command)
-	cmd := exec.Command(parts[0], parts[1:]...)
+// commandError is returned by runCommand when the command fails
+// The message is the command's output, the exit code is kept for callers that care about it
+type commandError struct {
+	output   string
+	exitCode int
+}
+
+func (e *commandError) Error() string {
+	return e.output
+}
+
+func newCommandError(output []byte, err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &commandError{output: string(output), exitCode: exitErr.ExitCode()}
+	}
+	return &commandError{output: err.Error(), exitCode: -1}
+}
+
+// Returns the exit code of a failed runCommand, or -1 if the command never ran
+func commandExitCode(err error) int {
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.exitCode
+	}
+	return -1
+}
+
+// runCommand executes the command with its arguments passed as they are, and returns the output or an error
+// Nothing is split or interpreted by a shell, so paths and prefixes may contain spaces
+func runCommand(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
 
 	// Run the command and capture the output
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return "", fmt.Errorf(string(output))
+		return "", newCommandError(output, err)
 	}
 
 	// Return the output as a string
 	return string(output), nil
 }
 
-func runDockerCommand(command string, container string) (string, error) {
-	output, err := runCommand(fmt.Sprintf("/usr/bin/docker exec %s rcon-cli %s", container, command))
+// runPipeline runs two commands with the output of the first piped into the second, like "first | second"
+// Each command is its name followed by its arguments. It returns the second command's output
+func runPipeline(first []string, second []string) (string, error) {
+	var output bytes.Buffer
+	err := pipeCommands(first, second, 0, &output)
 	if err != nil {
-		return "", fmt.Errorf("failed to run docker command: %v, error: %v", command, err)
+		return "", err
 	}
-
-	return output, nil
+	return output.String(), nil
 }
 
-func getNumberOfPlayers(container string) (int32, error) {
-	output, err := runDockerCommand("/list", container)
+// writePipeline runs "first | second > outputPath", limiting the data passed between them to bytesPerSecond (0 for unlimited)
+func writePipeline(first []string, second []string, bytesPerSecond int64, outputPath string) error {
+	outputFile, err := os.Create(outputPath)
 	if err != nil {
-		return -1, err
+		return err
 	}
 
-	number, err := strconv.Atoi(strings.Split(output, " ")[2])
+	err = pipeCommands(first, second, bytesPerSecond, outputFile)
+	closeErr := outputFile.Close()
 	if err != nil {
-		return -1, err
+		return err
 	}
-
-	return int32(number), nil
+	return closeErr
 }
 
-func say(input string, container string) error {
-	_, err := runDockerCommand(fmt.Sprintf("/say %v", input), container)
+// Runs "first | second" with the second command's stdout written to stdout
+// A failure of the second command is reported over the first's, since it usually causes the first to fail with a broken pipe.
+// Failures are returned as a commandError like runCommand.
+func pipeCommands(first []string, second []string, bytesPerSecond int64, stdout io.Writer) error {
+	firstCmd := exec.Command(first[0], first[1:]...)
+	secondCmd := exec.Command(second[0], second[1:]...)
+
+	var firstOutput, secondOutput bytes.Buffer
+	firstCmd.Stderr = &firstOutput
+	secondCmd.Stdout = stdout
+	secondCmd.Stderr = &secondOutput
+
+	pipe, err := firstCmd.StdoutPipe()
 	if err != nil {
 		return err
 	}
-	return nil
-}
+	secondCmd.Stdin = pipe
+	if bytesPerSecond > 0 {
+		secondCmd.Stdin = &rateLimitedReader{reader: pipe, bytesPerSecond: bytesPerSecond}
+	}
+
+	err = firstCmd.Start()
+	if err != nil {
+		return newCommandError(nil, err)
+	}
+
+	err = secondCmd.Start()
+	if err != nil {
+		_ = firstCmd.Process.Kill()
+		_ = firstCmd.Wait()
+		return newCommandError(nil, err)
+	}
 
-// checkAWSCLI checks if the AWS CLI is installed and configured
-func checkAWSCLI() error {
+	secondErr := secondCmd.Wait()
+	_ = pipe.Close() // Unblocks the first command if the second one stopped reading early
+	firstErr := firstCmd.Wait()
 
-	// Check if AWS CLI is installed
-	if !fileExists("/usr/bin/aws") {
-		return fmt.Errorf("AWS CLI is not installed or not found in /usr/bin")
+	if secondErr != nil {
+		return newCommandError(secondOutput.Bytes(), secondErr)
+	}
+	if firstErr != nil {
+		return newCommandError(firstOutput.Bytes(), firstErr)
 	}
+
 	return nil
 }
 
-// Returns the time as a string in the desired format
-func getTime() string {
-	currentTime := time.Now()
-	formattedTime := fmt.Sprint(currentTime.Format("2006-01-02_15:04:05"))
-	formattedTime = strings.Replace(formattedTime, ":", "_", -1)
-	return formattedTime
+// rateLimitedReader slows reads down to at most bytesPerSecond on average
+type rateLimitedReader struct {
+	reader         io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	total          int64
 }
 
-// Storage class options:
-// STANDARD
-// INTELLIGENT_TIERING
-// STANDARD_IA
-// ONEZONE_IA
-// GLACIER
-// DEEP_ARCHIVE
-// REDUCED_REDUNDANCY
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
 
-// Backs up the file to the S3 bucket
-func backUpToS3(fileName string, bucket string, prefix string, storageClass string) error {
+	// Keep each read to a tenth of a second's worth so the rate stays smooth
+	if limit := r.bytesPerSecond/10 + 1; int64(len(p)) > limit {
+		p = p[:limit]
+	}
 
-	s3Path := fmt.Sprintf("s3://%v/%v", bucket, prefix)
+	n, err := r.reader.Read(p)
+	r.total += int64(n)
 
-	_, err := runCommand(fmt.Sprintf("aws s3 cp %v %v/%v --storage-class %v", fileName, s3Path, fileName, storageClass))
-	if err != nil {
-		return err
+	expected := time.Duration(float64(r.total) / float64(r.bytesPerSecond) * float64(time.Second))
+	if wait := expected - time.Since(r.start); wait > 0 {
+		time.Sleep(wait)
 	}
-	return nil
 
+	return n, err
 }
 
-func deleteS3File(fileName string, bucket string, prefix string) error {
+// Container runtimes accepted for container_runtime, their CLIs take the same commands and flags
+const containerRuntimeDocker = "docker"
+const containerRuntimePodman = "podman"
 
-	s3Path := fmt.Sprintf("s3://%v/%v/%v", bucket, prefix, fileName)
+// CLI every container command is run with, set in main() from container_runtime
+var containerBinary = "/usr/bin/docker"
 
-	_, err := runCommand(fmt.Sprintf("aws s3 rm %v", s3Path))
+// Finds the runtime's CLI, in /usr/bin or elsewhere on the PATH, e.g. for a rootless Podman installed per user
+func findContainerBinary(runtime string) (string, error) {
+
+	path, err := exec.LookPath(runtime)
 	if err != nil {
-		return fmt.Errorf("could not delete save file in S3: %v", err)
+		return "", fmt.Errorf("%v is not installed or not on the PATH: %v", runtime, err)
 	}
 
-	return nil
+	return path, nil
 }
 
-func deleteFile(filePath string) error {
-	// Attempt to remove the file
-	err := os.Remove(filePath)
-	if err != nil {
-		return err
-	}
-	return nil
-}
+// How many times a docker exec that failed because of the daemon is retried, and the wait before the first retry
+// The wait doubles on each retry. Set in main() from the config
+var dockerExecRetries = DOCKER_EXEC_RETRIES
+var dockerExecBackoff = DOCKER_EXEC_BACKOFF_SECONDS * time.Second
 
-func backupInstance(db *sql.DB, instance Instance) error {
+// How many times the world is tarred before the backup fails, set in main() from the config
+// The wait before each retry starts at tarRetryBackoff and doubles
+var tarAttempts = TAR_ATTEMPTS
 
-	transaction, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("Could not start transaction: %s", err)
-	}
+const tarRetryBackoff = 5 * time.Second
 
-	// If the function errors out, call rollback.
-	// If everything is successful and tx is committed, rollback should have no effect
-	defer func(transaction *sql.Tx) {
-		_ = transaction.Rollback()
-	}(transaction)
+// Output tar prints for failures that retrying won't fix, unlike files changing while they are read
+var fatalTarMessages = []string{
+	"No space left on device",
+	"Permission denied",
+}
 
-	err = os.Chdir(instance.workingPath)
-	if err != nil {
-		return fmt.Errorf("Could not change working directory: %s", err)
+// Reports whether a failed tar is worth trying again
+func isRetryableTarError(err error) bool {
+	for _, message := range fatalTarMessages {
+		if strings.Contains(err.Error(), message) {
+			return false
+		}
 	}
+	return true
+}
 
-	// Disable command output
-	// This is so there isn't a ton of output to the console all the time
-	output, err := runDockerCommand("/gamerule sendCommandFeedback false", instance.containerName)
-	if err != nil {
-		return fmt.Errorf("Could not disable command feedback: %v, error: %v", output, err)
-	}
+// Output docker and podman print when the container itself can't run the command, which retrying won't fix
+var containerNotRunningMessages = []string{
+	"is not running",
+	"No such container",
+	"no such container",
+	"is paused",
+	"is restarting",
+	"container state improper",
+}
 
-	var currentTime string
-	var tarFileName string
-	var playerCount int32
+// Output docker and podman print when the daemon or service is briefly busy or unreachable
+var transientDockerMessages = []string{
+	"Cannot connect to the Docker daemon",
+	"unable to connect to Podman",
+	"context deadline exceeded",
+	"connection reset by peer",
+	"i/o timeout",
+	"resource temporarily unavailable",
+}
 
-	currentTime = getTime()
-	tarFileName = fmt.Sprintf("world%v.tar.gz", currentTime)
+// Reports whether a failed docker exec is worth retrying
+// docker exec exits 125 when the daemon couldn't create the exec, other exit codes come from the command itself
+func isTransientDockerError(err error) bool {
 
-	// Check if there are players online
-	// We don't want to save if there aren't even any players playing
-	playerCount, err = getNumberOfPlayers(instance.containerName)
-	if err != nil {
-		return fmt.Errorf("Could not get playerCount of players: %v", err)
+	for _, message := range containerNotRunningMessages {
+		if strings.Contains(err.Error(), message) {
+			return false
+		}
 	}
 
-	// If there are no players, wait the wait interval, else print the saving message
-	if playerCount == 0 {
-		fmt.Printf("%v: No players online, skipping...\n", instance.containerName)
-		return nil
-	} else if playerCount == 1 {
-		fmt.Printf("%v: There is %d player online, saving...\n", instance.containerName, playerCount)
-	} else {
-		fmt.Printf("%v: There are %d players online, saving...\n", instance.containerName, playerCount)
+	if commandExitCode(err) == 125 {
+		return true
 	}
 
-	// Save the mc world
-	_ = say("Saving world...", instance.containerName) // Tell players that the world is saving
-	output, err = runDockerCommand("/save-all", instance.containerName)
-	if err != nil {
-		_ = say("Failed to save world", instance.containerName)
-		return fmt.Errorf("Could not save world: %v", err)
+	for _, message := range transientDockerMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
 	}
 
-	// Buffer time to let things save
-	time.Sleep(10 * time.Second)
+	return false
+}
 
-	// Disable saving
-	// This ensures the save file doesn't change during the copy
-	output, err = runDockerCommand("/save-off", instance.containerName)
-	if err != nil {
-		return fmt.Errorf("Could not save world: %v", err)
-	}
+// Runs a command on a Minecraft server through the rcon-cli shipped in the itzg/minecraft-server image
+func runDockerCommand(command string, instance Instance) (string, error) {
+	return runRconCommand("rcon-cli", command, instance)
+}
 
-	// Buffer to make sure the files aren't being accessed anymore
-	time.Sleep(5 * time.Second)
+// Runs a command through the rcon client inside the container, retrying transient docker errors,
+// or straight over RCON for instances with an rcon_host
+func runRconCommand(client string, command string, instance Instance) (string, error) {
 
-	// Tar the world
-	// If it fails due to a changed during access, try again until it works
-	for {
-		output, err = runCommand(fmt.Sprintf("/bin/tar -czf ./%v ./%v", tarFileName, instance.dirName))
-		if err != nil {
-			log.Printf("Could not compress world: %v, error: %v\n", output, err)
+	if instance.rconHost != "" {
+		return runRconTCPCommand(instance, command)
+	}
 
-			err = deleteFile(tarFileName)
-			if err != nil {
-				return fmt.Errorf("Could not delete file: %v", err)
-			}
+	container := instance.containerName
+	backoff := dockerExecBackoff
 
-			time.Sleep(5 * time.Second) // Time buffer to hopefully allow whatever happened to clear up
-			continue
+	for attempt := 0; ; attempt++ {
+		output, err := runCommand(containerBinary, "exec", container, client, command)
+		if err == nil {
+			return output, nil
 		}
-		break
-	}
 
-	var storageClass = "STANDARD" // Storage class used for the S3 storage
+		if attempt >= dockerExecRetries || !isTransientDockerError(err) {
+			return "", fmt.Errorf("failed to run docker command: %v, error: %v", command, err)
+		}
 
-	// Upload the save to S3
-	err = backUpToS3(tarFileName, instance.s3Bucket, instance.prefix, storageClass)
-	if err != nil {
-		return fmt.Errorf("Could not backup to S3: %v", err)
+		log.Printf("%v: docker exec of %v failed, retrying in %v (%d/%d): %v", container, command, backoff, attempt+1, dockerExecRetries, strings.TrimSpace(err.Error()))
+		time.Sleep(backoff)
+		backoff = backoff * 2
 	}
+}
 
-	tarFileStats, err := os.Stat(tarFileName)
+func say(input string, instance Instance) error {
+	_, err := runDockerCommand(fmt.Sprintf("/say %v", input), instance)
 	if err != nil {
-		return fmt.Errorf("Could not stat tar file: %v", err)
+		return err
 	}
+	return nil
+}
 
-	_, err = transaction.Exec("INSERT INTO saves (filename,size,instance_id) VALUES (?,?,?)", tarFileName, tarFileStats.Size(), instance.id)
+// Returns the 1-minute load average from /proc/loadavg
+func loadAverage() (float64, error) {
+	content, err := os.ReadFile("/proc/loadavg")
 	if err != nil {
-		return fmt.Errorf("Could not insert save record: %v", err)
+		return 0, err
 	}
 
-	// Delete the tar file
-	err = deleteFile(tarFileName)
-	if err != nil {
-		return fmt.Errorf("Could not delete tar file: %v", err)
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/loadavg content: %q", content)
 	}
 
-	// Re-enable saving
-	output, err = runDockerCommand("/save-on", instance.containerName)
-	if err != nil {
-		return fmt.Errorf("Could not re-enable mc saving: %v, error: %v", output, err)
-	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// Returns the time as a string in the desired format
+func getTime() string {
+	currentTime := time.Now()
+	formattedTime := fmt.Sprint(currentTime.Format("2006-01-02_15:04:05"))
+	formattedTime = strings.Replace(formattedTime, ":", "_", -1)
+	return formattedTime
+}
 
-	_ = say("Save successful!", instance.containerName)
-	fmt.Printf("%v: Save success!\n", instance.containerName)
+// Sub-prefix used by the version layout when the server version can't be detected
+const unknownVersion = "unknown"
 
-	err = transaction.Commit()
-	if err != nil {
-		return fmt.Errorf("Could not commit transaction: %v", err)
+// Time between the player checks that confirm a server is empty
+const emptyConfirmationInterval = 15 * time.Second
+
+// Buffers after the save command and /save-off, set in main() from the config
+var saveAllDelay = SAVE_ALL_DELAY_SECONDS * time.Second
+var saveOffDelay = SAVE_OFF_DELAY_SECONDS * time.Second
+
+// Shortest buffers used when the world lives on a network filesystem
+const nfsSaveAllDelay = 30 * time.Second
+const nfsSaveOffDelay = 15 * time.Second
+
+// What the server answers or logs once a save has been written
+const savedGameMessage = "Saved the game"
+
+// Save command that blocks until the world is written
+const flushSaveCommand = "save-all flush"
+
+// How often the container's logs are checked for savedGameMessage
+const savePollInterval = time.Second
+
+// Returns the directories under working_path that make up the world, dir_name can list several separated by commas,
+// e.g. "world,world_nether,world_the_end" for servers that keep each dimension in its own directory
+// The first is the main world, the one with level.dat
+func worldDirs(instance Instance) []string {
+
+	var dirs []string
+	for _, dir := range strings.Split(instance.dirName, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
 	}
-	return nil
 
+	return dirs
 }
 
-func getInstances(db *sql.DB) ([]Instance, error) {
+// Returns the directory of the main world, the first in dir_name
+func mainWorldDir(instance Instance) string {
+	dirs := worldDirs(instance)
+	if len(dirs) == 0 {
+		return instance.dirName
+	}
+	return dirs[0]
+}
 
-	var containerName, description, dirName, s3Bucket, prefix, workingPath string
-	var keepInventory, active bool
-	var instances []Instance
-	var id int
+// Returns the world's directories as tar arguments relative to root, e.g. ./world ./world_nether
+func worldTarSources(instance Instance) []string {
 
-	rows, err := db.Query("SELECT id,container_name,description,dir_name,s3_bucket,prefix,working_path,active,keep_inventory FROM instances")
-	if err != nil {
-		log.Fatalf("Could not query DB: %s", err)
+	var sources []string
+	for _, dir := range worldDirs(instance) {
+		sources = append(sources, "./"+dir)
 	}
 
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-			log.Printf("Error closing rows: %s", err)
-		}
-	}(rows)
+	return sources
+}
 
-	for rows.Next() {
-		err = rows.Scan(&id, &containerName, &description, &dirName, &s3Bucket, &prefix, &workingPath, &active, &keepInventory)
+// Checks every world directory is there, so a typo in dir_name fails the backup rather than quietly leaving a dimension out
+func checkWorldDirs(instance Instance) error {
+
+	for _, dir := range worldDirs(instance) {
+		info, err := os.Stat(filepath.Join(instance.workingPath, dir))
 		if err != nil {
-			return nil, fmt.Errorf("Error scanning row: %s", err)
+			return fmt.Errorf("World directory %v is missing: %v", dir, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("World directory %v is not a directory", dir)
+		}
+	}
+
+	return nil
+}
+
+// Copies the world directories to a local staging directory with rsync and returns the staging directory
+func stageWorld(instance Instance) (string, error) {
+
+	stagingDir, err := os.MkdirTemp("", "mcbackuper-staging-")
+	if err != nil {
+		return "", fmt.Errorf("Could not create staging directory: %v", err)
+	}
+
+	for _, dir := range worldDirs(instance) {
+
+		source := fmt.Sprintf("%v/%v/", strings.TrimRight(instance.workingPath, "/"), dir)
+		destination := fmt.Sprintf("%v/%v/", stagingDir, dir)
+
+		output, err := runCommand("/usr/bin/rsync", "-a", source, destination)
+
+		// Exit code 24 means some source files vanished during the copy, which is harmless with saving disabled
+		if err != nil && commandExitCode(err) != 24 {
+			_ = os.RemoveAll(stagingDir)
+			return "", fmt.Errorf("Could not copy world to staging directory: %v, error: %v", output, err)
+		}
+	}
+
+	return stagingDir, nil
+}
+
+func deleteFile(filePath string) error {
+	// Attempt to remove the file
+	err := os.Remove(filePath)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Waits for the duration, returning early with the context's error if it is cancelled first
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns a context for the wait between passes that is also cancelled by a signal on reloads
+func untilReload(ctx context.Context, reloads <-chan os.Signal) (context.Context, context.CancelFunc) {
+
+	waitCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case received := <-reloads:
+			log.Printf("Received %v, reloading instances", received)
+			cancel()
+		case <-waitCtx.Done():
+		}
+	}()
+
+	return waitCtx, cancel
+}
+
+// Backs up the instance
+// Cancelling the context cuts the waits in the backup short and aborts it, a tar or upload already running is left to finish
+func backupInstance(ctx context.Context, db *sql.DB, instance Instance) error {
+
+	startTime := time.Now()
+
+	// Anything that returns early without setting a result is a failure
+	outcome := backupResultFailure
+	defer func() {
+		backupMetrics.ObserveBackup(instance.containerName, outcome, time.Since(startTime))
+	}()
+
+	// Archives are written next to the world and always referred to by absolute path,
+	// backups can run concurrently so nothing may depend on the process's working directory
+	archivePath := func(fileName string) string {
+		return filepath.Join(instance.workingPath, fileName)
+	}
+
+	server := gameServer(instance)
+
+	err := checkWorldDirs(instance)
+	if err != nil {
+		return err
+	}
+
+	// A backup aborted for shutdown leaves the server as it found it
+	defer func() {
+		if ctx.Err() != nil && instance.serverType == serverTypeMinecraft {
+			_, err := runDockerCommand("/gamerule sendCommandFeedback true", instance)
+			if err != nil {
+				log.Printf("%v: Could not re-enable command feedback: %v\n", instance.containerName, err)
+			}
+		}
+	}()
+
+	var currentTime string
+	var tarFileName string
+
+	currentTime = getTime()
+
+	// Check if there are players online
+	// We don't want to save if there aren't even any players playing
+	playerCount, players, err := getOnlinePlayers(instance)
+	if err != nil {
+		return fmt.Errorf("Could not get playerCount of players: %v", err)
+	}
+
+	// Players can briefly read as gone after a restart or network blip, so confirm the server is really empty
+	// That only matters when an empty server is skipped
+	for i := 1; playerCount == 0 && !instance.backupWhenEmpty && i < instance.emptyConfirmations; i++ {
+		err = sleepContext(ctx, emptyConfirmationInterval)
+		if err != nil {
+			return fmt.Errorf("Backup interrupted: %v", err)
+		}
+		playerCount, players, err = getOnlinePlayers(instance)
+		if err != nil {
+			return fmt.Errorf("Could not get playerCount of players: %v", err)
+		}
+	}
+
+	// Names are stored comma separated with the save, they can't contain commas
+	recordedPlayers := ""
+	if instance.recordPlayers {
+		recordedPlayers = strings.Join(players, ",")
+	}
+
+	// If there are no players, wait the wait interval, else print the saving message
+	if playerCount == 0 && !instance.backupWhenEmpty {
+		log.Printf("%v: No players online, skipping...\n", instance.containerName)
+		events.Record(instance.id, eventSkipped, "no players online", time.Since(startTime))
+		outcome = backupResultSkipped
+		return nil
+	}
+
+	// Saving stalls the server for a moment, which some players would rather not have happen mid-session
+	if watched := watchedPlayerOnline(instance, players); watched != "" {
+		log.Printf("%v: Watched player %v is online, deferring backup...\n", instance.containerName, watched)
+		events.Record(instance.id, eventSkipped, fmt.Sprintf("watched player %v online", watched), time.Since(startTime))
+		outcome = backupResultSkipped
+		return nil
+	}
+
+	// Nothing written since the last save means the new one would be the same, so don't save or upload at all
+	if instance.onlyWhenChanged {
+		since, found, err := lastSaveStarted(db, instance)
+		if err != nil {
+			return err
+		}
+		if found {
+			changed, err := worldChangedSince(instance.workingPath, worldDirs(instance), since)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				log.Printf("%v: No world files changed since the last save, skipping...\n", instance.containerName)
+				events.Record(instance.id, eventSkipped, "world unchanged since last save", time.Since(startTime))
+				outcome = backupResultSkipped
+				return nil
+			}
+		}
+	}
+
+	if playerCount == 1 {
+		log.Printf("%v: There is %d player online, saving...\n", instance.containerName, playerCount)
+	} else {
+		log.Printf("%v: There are %d players online, saving...\n", instance.containerName, playerCount)
+	}
+
+	// Training reads the whole world, so it happens before saving is disabled to keep that window short
+	var dictionaryID sql.NullInt64
+	dictionaryPath := ""
+	if instance.zstdDictionary {
+		id, path, err := currentDictionary(db, instance)
+		if err != nil {
+			log.Printf("%v: Could not prepare zstd dictionary, falling back to %v: %v\n", instance.containerName, defaultCompression, err)
+		} else {
+			dictionaryID = sql.NullInt64{Int64: int64(id), Valid: true}
+			dictionaryPath = path
+		}
+	}
+
+	// Archive formats to write, tar writes the first and the rest are converted from it
+	formats := []string{defaultCompression}
+	if dictionaryPath != "" {
+		formats = []string{"zstd"}
+	}
+	if instance.compressionFormats != "" {
+		formats, err = parseCompressionFormats(instance.compressionFormats)
+		if err != nil {
+			return err
+		}
+	}
+	tarFileName = fmt.Sprintf("world%v%v", currentTime, compressionExtensions[formats[0]])
+
+	// A hook that fails, e.g. a filesystem snapshot that couldn't be taken, stops the backup before the server is touched
+	if instance.preBackupCmd != "" {
+		err = runBackupHook(instance.preBackupCmd, instance, "MCBACKUPER_FILENAME="+tarFileName)
+		if err != nil {
+			return fmt.Errorf("Pre-backup command %v", err)
+		}
+	}
+
+	// Runs once the backup is over, after saving is back on and the archive is uploaded or the backup has failed
+	// It only warns when it fails, the backup's outcome is already settled by then
+	if instance.postBackupCmd != "" {
+		defer func() {
+			result := backupResultFailure
+			if outcome == backupResultSuccess {
+				result = backupResultSuccess
+			}
+			err := runBackupHook(instance.postBackupCmd, instance, "MCBACKUPER_FILENAME="+tarFileName, "MCBACKUPER_RESULT="+result)
+			if err != nil {
+				log.Printf("%v: Warning: post-backup command %v\n", instance.containerName, err)
+			}
+		}()
+	}
+
+	err = server.PreBackup(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	// Saving has to come back on however the backup ends, the success paths resume it themselves before reporting success
+	resumed := false
+	defer func() {
+		if !resumed {
+			err := server.PostBackup(instance)
+			if err != nil {
+				log.Printf("%v: %v\n", instance.containerName, err)
+			}
+		}
+	}()
+
+	// A paused server is frozen for players, so it's unpaused as soon as the tar is written
+	// The deferred unpause makes sure it comes back even if anything fails before then
+	paused := instance.pauseDuringBackup
+	defer func() {
+		if paused {
+			err := unpauseContainer(instance.containerName)
+			if err != nil {
+				log.Printf("%v: %v\n", instance.containerName, err)
+			}
+		}
+	}()
+
+	// An unchanged world gets a save row pointing at the previous save's object, so the timeline stays continuous
+	fingerprint := ""
+	if instance.dedupeUnchanged {
+		fingerprint, err = worldFingerprint(instance.workingPath, worldDirs(instance))
+		if err != nil {
+			return err
+		}
+
+		deduped, err := dedupeSave(db, instance, fingerprint, recordedPlayers)
+		if err != nil {
+			return err
+		}
+		if deduped != "" {
+			resumed = true
+			err = server.PostBackup(instance)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("%v: World unchanged since %v, recorded a reference instead of uploading\n", instance.containerName, deduped)
+			_ = say("Save successful!", instance)
+			notifier.NotifySuccess(NotificationData{
+				Instance: instance.containerName,
+				Filename: deduped,
+				Duration: time.Since(startTime),
+			})
+
+			events.Record(instance.id, eventSuccess, fmt.Sprintf("unchanged, referenced %v", deduped), time.Since(startTime))
+			outcome = backupResultSuccess
+			return nil
+		}
+	}
+
+	// Record size tuning for sequential/tape-like targets, tar's default is used when unset
+	var tarOptions []string
+	if instance.tarBlockingFactor > 0 {
+		tarOptions = []string{fmt.Sprintf("--blocking-factor=%d", instance.tarBlockingFactor)}
+	}
+
+	tarSources := append([]string{"-C", instance.workingPath}, worldTarSources(instance)...)
+	tarRoot := instance.workingPath
+
+	// On network storage, copy the world to local disk first and tar the stable local copy
+	if instance.nfsMode {
+		stagingDir, err := stageWorld(instance)
+		if err != nil {
+			return err
+		}
+		defer func(stagingDir string) {
+			err := os.RemoveAll(stagingDir)
+			if err != nil {
+				log.Printf("%v: Could not remove staging directory: %v\n", instance.containerName, err)
+			}
+		}(stagingDir)
+
+		tarSources = append([]string{"-C", stagingDir}, worldTarSources(instance)...)
+		tarRoot = stagingDir
+	}
+
+	// In incremental mode every save records the world's files, and the saves between full ones only archive what changed
+	var manifest map[string]worldFile
+	var archivedBytes int64 // Size of the files going into the archive before compression
+	var parentID sql.NullInt64
+	chainPosition := 0
+	saveType := saveTypeFull
+	var snapshot *tarSnapshot
+	if instance.incremental && instance.incrementalMethod == incrementalTar {
+		// tar finds the changes itself from the snapshot it wrote for the previous save, deleted files included
+		transaction, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("Could not start transaction: %v", err)
+		}
+		baseID, position, err := tarIncrementalBase(transaction, instance)
+		_ = transaction.Rollback()
+		if err != nil {
+			return err
+		}
+
+		snapshot, err = newTarSnapshot(instance, baseID)
+		if err != nil {
+			return err
+		}
+		defer snapshot.discard()
+		tarOptions = append(tarOptions, "--listed-incremental="+snapshot.workPath)
+
+		if baseID != 0 {
+			files, err := scanWorld(tarRoot, worldDirs(instance))
+			if err != nil {
+				return err
+			}
+			archivedBytes, err = changedSince(files, snapshotPath(instance.id, baseID))
+			if err != nil {
+				return err
+			}
+
+			log.Printf("%v: Taking an incremental save against save %d\n", instance.containerName, baseID)
+
+			tarFileName = fmt.Sprintf("world%v-incremental%v", currentTime, compressionExtensions[formats[0]])
+			parentID = sql.NullInt64{Int64: int64(baseID), Valid: true}
+			chainPosition = position
+			saveType = saveTypeIncremental
+		}
+	} else if instance.incremental {
+		manifest, err = scanWorld(tarRoot, worldDirs(instance))
+		if err != nil {
+			return err
+		}
+
+		// Only read, and rolled back straight away so the DB isn't locked for the rest of the backup
+		transaction, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("Could not start transaction: %v", err)
+		}
+		baseID, position, baseManifest, err := deltaBase(transaction, instance)
+		_ = transaction.Rollback()
+		if err != nil {
+			return err
+		}
+
+		if baseID != 0 {
+			changed := changedFiles(manifest, baseManifest)
+
+			listPath, err := writeFileList(changed)
+			if err != nil {
+				return err
+			}
+			defer func(listPath string) {
+				err := deleteFile(listPath)
+				if err != nil {
+					log.Printf("%v: Could not delete file list: %v\n", instance.containerName, err)
+				}
+			}(listPath)
+
+			log.Printf("%v: %d of %d files changed since save %d, uploading a delta\n", instance.containerName, len(changed), len(manifest), baseID)
+
+			for _, path := range changed {
+				archivedBytes = archivedBytes + manifest[path].size
+			}
+
+			tarSources = []string{"-C", tarRoot, "-T", listPath}
+			tarFileName = fmt.Sprintf("world%v-delta%v", currentTime, compressionExtensions[formats[0]])
+			parentID = sql.NullInt64{Int64: int64(baseID), Valid: true}
+			chainPosition = position
+			saveType = saveTypeDelta
+		}
+	}
+
+	// A full save archives the whole world, which only incremental mode has already scanned
+	if !parentID.Valid {
+		files := manifest
+		if files == nil {
+			files, err = scanWorld(tarRoot, worldDirs(instance))
+			if err != nil {
+				return err
+			}
+		}
+		for _, file := range files {
+			archivedBytes = archivedBytes + file.size
+		}
+	}
+
+	// Streamed saves are uploaded as tar writes them, so there is no local archive to stat or checksum afterwards
+	stream := streamUpload && canStreamUpload(instance)
+
+	// Returning runs the deferred resume, so saving comes back on
+	if !stream {
+		err = checkDiskSpace(instance.workingPath, archivedBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Append a marker as the very last member of the archive
+	// If it is missing or altered when the save is verified, the archive was truncated
+	canary := ""
+	if instance.writeCanary {
+		canary, err = writeCanary(instance.workingPath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := deleteFile(filepath.Join(instance.workingPath, canaryFileName))
+			if err != nil {
+				log.Printf("%v: Could not delete canary file: %v\n", instance.containerName, err)
+			}
+		}()
+
+		tarSources = append(tarSources, "-C", instance.workingPath, "./"+canaryFileName)
+	}
+
+	// With the version layout, saves go under a sub-prefix for the server's Minecraft version, e.g. prefix/1.20.4
+	keyPrefix := instance.prefix
+	version := ""
+	if instance.keyLayout == "version" {
+		version, err = detectServerVersion(instance.containerName)
+		if err != nil {
+			log.Printf("%v: Could not detect server version, using %v: %v\n", instance.containerName, unknownVersion, err)
+			version = unknownVersion
+		}
+		keyPrefix = fmt.Sprintf("%v/%v", instance.prefix, version)
+	}
+
+	var streamedSize int64
+	var streamedChecksum, streamedExpected string
+
+	// tar writing the archive to stdout, for when it is compressed in a separate process
+	tarCommand := slices.Concat([]string{"/bin/tar"}, tarOptions, []string{"-cf", "-"}, tarSources)
+	var output string
+
+	// Tar the world
+	// If it fails due to a changed during access, try again up to tarAttempts times
+	tarStart := time.Now()
+	// A streamed save that keeps failing is more likely S3 than tar, so those give up after as many attempts as an upload
+	for attempt := 1; ; attempt++ {
+		if snapshot != nil {
+			err = snapshot.reset()
+			if err != nil {
+				return err
+			}
+		}
+		if stream {
+			s3Path := fmt.Sprintf("s3://%v/%v/%v", instance.s3Bucket, keyPrefix, tarFileName)
+			streamedSize, streamedChecksum, streamedExpected, err = streamToS3(func(w io.Writer) error {
+				err := pipeCommands(tarCommand, compressCommand(formats[0], dictionaryPath),
+					int64(instance.diskReadLimitKBps)*1024, w)
+				if err != nil && instance.nfsMode && commandExitCode(err) == 1 {
+					log.Printf("%v: tar reported files changed while reading, accepting archive in NFS mode: %v\n", instance.containerName, err)
+					return nil
+				}
+				return err
+			}, s3Path, instance.region, instanceStorageClass(instance))
+		} else if formats[0] != "gzip" || compressionLevel > 0 && defaultCompression == "gzip" || instance.diskReadLimitKBps > 0 {
+			// Compress in a separate process so the uncompressed stream, and with it tar's reads, can be throttled
+			err = writePipeline(tarCommand, compressCommand(formats[0], dictionaryPath),
+				int64(instance.diskReadLimitKBps)*1024, archivePath(tarFileName))
+		} else {
+			output, err = runCommand("/bin/tar", slices.Concat(tarOptions, []string{"-czf", archivePath(tarFileName)}, tarSources)...)
+		}
+
+		// Exit code 1 means some files changed while being read, which NFS reports spuriously
+		// The archive is still complete, so accept it rather than retrying forever
+		if err != nil && !stream && instance.nfsMode && commandExitCode(err) == 1 {
+			log.Printf("%v: tar reported files changed while reading, accepting archive in NFS mode: %v\n", instance.containerName, err)
+			err = nil
+		}
+
+		if err != nil {
+			if stream {
+				if attempt >= s3UploadAttempts {
+					return fmt.Errorf("Could not stream save to S3: %v", err)
+				}
+				log.Printf("Could not stream save to S3: %v\n", err)
+			} else {
+				log.Printf("Could not compress world: %v, error: %v\n", output, err)
+
+				tarErr := err
+				err = deleteFile(archivePath(tarFileName))
+				if err != nil {
+					return fmt.Errorf("Could not delete file: %v", err)
+				}
+
+				// Returning runs the deferred resume, so saving comes back on
+				if !isRetryableTarError(tarErr) {
+					return fmt.Errorf("Could not compress world: %v", tarErr)
+				}
+				if attempt >= tarAttempts {
+					return fmt.Errorf("Could not compress world after %d attempts: %v", attempt, tarErr)
+				}
+			}
+
+			// Nothing can change in a paused container, so retrying won't help
+			if instance.pauseDuringBackup {
+				return fmt.Errorf("Could not compress world while paused")
+			}
+
+			// Back off to hopefully allow whatever happened to clear up
+			err = sleepContext(ctx, tarRetryBackoff*time.Duration(1<<(attempt-1)))
+			if err != nil {
+				return fmt.Errorf("Backup interrupted: %v", err)
+			}
+			continue
+		}
+		break
+	}
+	tarDuration := time.Since(tarStart) // A streamed save's upload happens during the tar, so it is counted here
+
+	if paused {
+		paused = false
+		err = unpauseContainer(instance.containerName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Convert the archive into any other formats, from the finished archive rather than reading the world again
+	// The copies keep the archive's name apart from the extension, so a delta or incremental save still says so
+	archives := []string{tarFileName}
+	for _, format := range formats[1:] {
+		fileName := strings.TrimSuffix(tarFileName, compressionExtensions[formats[0]]) + compressionExtensions[format]
+
+		err = writePipeline(decompressCommand(archivePath(tarFileName), archiveDictionaryPath(tarFileName, dictionaryPath)), compressCommand(format, dictionaryPath), 0, archivePath(fileName))
+		if err != nil {
+			_ = deleteFile(archivePath(fileName))
+			return fmt.Errorf("Could not convert save to %v: %v", format, err)
+		}
+		archives = append(archives, fileName)
+	}
+
+	// Renamed before anything is uploaded, so the name in the bucket and in saves is the hashed one
+	if instance.hashInFilename {
+		for i, fileName := range archives {
+			hashedPath, err := hashedArchiveName(archivePath(fileName))
+			if err == nil {
+				err = os.Rename(archivePath(fileName), hashedPath)
+			}
+			if err != nil {
+				for _, archive := range archives {
+					_ = deleteFile(archivePath(archive))
+				}
+				return fmt.Errorf("Could not add hash to archive name: %v", err)
+			}
+			archives[i] = filepath.Base(hashedPath)
+		}
+		tarFileName = archives[0]
+	}
+
+	// Encrypted last, so the hash in the name and the format conversions work on the plaintext archive
+	encryption := ""
+	if instance.encrypt {
+		encryption = encryptionAES256GCM
+		for i, fileName := range archives {
+			err = encryptFile(archivePath(fileName), archivePath(fileName+encryptedExtension), encryptionKey)
+			if err == nil {
+				err = deleteFile(archivePath(fileName))
+			}
+			if err != nil {
+				for _, archive := range archives {
+					_ = deleteFile(archivePath(archive))
+					_ = deleteFile(archivePath(archive + encryptedExtension))
+				}
+				return fmt.Errorf("Could not encrypt save: %v", err)
+			}
+			archives[i] = fileName + encryptedExtension
+		}
+		tarFileName = archives[0]
+	}
+
+	// Delete the archives whether or not the upload works
+	if !stream {
+		defer func(archives []string) {
+			for _, fileName := range archives {
+				err := deleteFile(archivePath(fileName))
+				if err != nil {
+					log.Printf("Could not delete tar file: %v\n", err)
+				}
+			}
+		}(archives)
+	}
+
+	// Providers with quotas fail the upload part way through once it's hit, so refuse up front with a clear reason
+	// Retention has already run for this cycle, so this is after freeing what it could
+	if instance.bucketQuotaBytes > 0 {
+		err = checkBucketQuota(db, instance, archives)
+		if err != nil {
+			return err
+		}
+	}
+
+	bucket, region := instance.s3Bucket, instance.region
+	var totalSize int64
+	var uploaded []uploadedArchive
+
+	// Each format is its own save, so retention and restores treat them independently
+	uploadStart := time.Now()
+	for i, fileName := range archives {
+
+		var storageClass = instanceStorageClass(instance) // Storage class used for the S3 storage
+
+		// A streamed save is already in the bucket, its size and checksums were taken from the stream
+		size, checksum, expected := streamedSize, streamedChecksum, streamedExpected
+		if !stream {
+			// Upload the save to the instance's backend
+			// If the primary region is down, fall back to the failover bucket so the backup still happens
+			err = instanceStorage(instance, bucket, keyPrefix, region, storageClass).Upload(archivePath(fileName), fileName)
+			if err != nil && bucket == instance.s3Bucket && instance.failoverBucket != "" && isRegionalFailure(err) {
+				log.Printf("%v: Primary bucket unreachable, failing over to %v: %v\n", instance.containerName, instance.failoverBucket, err)
+				bucket, region = instance.failoverBucket, instance.failoverRegion
+				err = instanceStorage(instance, bucket, keyPrefix, region, storageClass).Upload(archivePath(fileName), fileName)
+			}
+			if err != nil {
+				return fmt.Errorf("Could not upload save: %v", err)
+			}
+
+			checksum, expected, err = fileChecksums(archivePath(fileName))
+			if err != nil {
+				return err
+			}
+
+			fileStats, err := os.Stat(archivePath(fileName))
+			if err != nil {
+				return fmt.Errorf("Could not stat tar file: %v", err)
+			}
+			size = fileStats.Size()
+		}
+
+		// Check what S3 stored before anything refers to it, the transition below copies the object and changes its checksum
+		if instance.verifyUploads && instance.backend == backendS3 && !dryRun {
+			err = verifyS3Upload(instance, fileName, bucket, keyPrefix, region, expected)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Move the save to its long term storage class now rather than waiting on bucket lifecycle rules
+		// A failed transition still leaves a good save behind, so it only warns
+		if instance.transitionStorageClass != "" && instance.transitionStorageClass != storageClass {
+			err = transitionS3File(fileName, bucket, keyPrefix, region, instance.transitionStorageClass)
+			if err != nil {
+				log.Printf("%v: %v\n", instance.containerName, err)
+			} else {
+				storageClass = instance.transitionStorageClass
+			}
+		}
+
+		totalSize = totalSize + size
+
+		// Only saves that failed over record their bucket, the rest live in the instance's bucket
+		saveBucket := ""
+		if bucket != instance.s3Bucket {
+			saveBucket = bucket
+		}
+
+		// Only zstd archives are compressed with the dictionary
+		archiveDictionaryID := dictionaryID
+		if archiveDictionaryPath(fileName, dictionaryPath) == "" {
+			archiveDictionaryID = sql.NullInt64{}
+		}
+
+		uploaded = append(uploaded, uploadedArchive{
+			fileName:     fileName,
+			size:         size,
+			storageClass: storageClass,
+			dictionaryID: archiveDictionaryID,
+			bucket:       saveBucket,
+			region:       region,
+			format:       formats[i],
+			checksum:     checksum,
+		})
+	}
+
+	// The save is kept on the instance's own backend whatever happens to the copies, a failed copy is reported once it is recorded
+	copiedTo, copyFailures := copyToDestinations(instance, archives, archivePath, keyPrefix)
+
+	uploadDuration := time.Since(uploadStart)
+	if stream {
+		uploadDuration = 0
+	}
+
+	// The saves are only recorded once everything is uploaded, so the DB isn't locked while other backups need it
+	transaction, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %s", err)
+	}
+
+	// If the function errors out, call rollback.
+	// If everything is successful and tx is committed, rollback should have no effect
+	defer func(transaction *sql.Tx) {
+		_ = transaction.Rollback()
+	}(transaction)
+
+	var recordedID int64
+	for _, archive := range uploaded {
+		result, err := transaction.Exec("INSERT INTO saves (filename,size,storage_class,canary,dictionary_id,s3_bucket,region,players,fingerprint,prefix,version,format,parent_id,chain_position,save_type,checksum,encryption,world_size,tar_duration_ms,upload_duration_ms,instance_id) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+			archive.fileName, archive.size, archive.storageClass, canary, archive.dictionaryID, archive.bucket, archive.region, recordedPlayers, fingerprint, keyPrefix, version, archive.format, parentID, chainPosition, saveType, archive.checksum, encryption,
+			archivedBytes, tarDuration.Milliseconds(), uploadDuration.Milliseconds(), instance.id)
+		if err != nil {
+			return fmt.Errorf("Could not insert save record: %v", err)
+		}
+
+		saveID, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("Could not get save ID: %v", err)
+		}
+		recordedID = saveID
+
+		if manifest != nil {
+			err = writeManifest(transaction, saveID, manifest)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, destinationID := range copiedTo {
+			_, err = transaction.Exec("INSERT INTO save_copies (save_id,destination_id) VALUES (?,?)", saveID, destinationID)
+			if err != nil {
+				return fmt.Errorf("Could not insert save copy record: %v", err)
+			}
+		}
+	}
+
+	resumed = true
+	err = server.PostBackup(instance)
+	if err != nil {
+		return err
+	}
+
+	err = commitUnlessDryRun(transaction, fmt.Sprintf("%d saves of %v", len(uploaded), instance.containerName))
+	if err != nil {
+		return fmt.Errorf("Could not commit transaction: %v", err)
+	}
+
+	// The save is recorded, so the next one can be taken against it
+	if snapshot != nil && !dryRun {
+		err = snapshot.commit(recordedID)
+		if err != nil {
+			log.Printf("%v: Warning: %v\n", instance.containerName, err)
+		}
+	}
+
+	// Only reported once the save is recorded, and the webhooks aren't waited on while the transaction holds the DB's only connection
+	_ = say("Save successful!", instance)
+	notifier.NotifySuccess(NotificationData{
+		Instance: instance.containerName,
+		Filename: strings.Join(archives, ", "),
+		Size:     totalSize,
+		Duration: time.Since(startTime),
+	})
+	// One line with everything needed to tune compression and spot slow phases, the ratio is of the first format's archive
+	ratio := 0.0
+	if uploaded[0].size > 0 {
+		ratio = float64(archivedBytes) / float64(uploaded[0].size)
+	}
+	log.Printf("%v: Backup summary: archive=%v world_bytes=%d archive_bytes=%d ratio=%.2f tar_seconds=%.1f upload_seconds=%.1f total_seconds=%.1f\n",
+		instance.containerName, tarFileName, archivedBytes, uploaded[0].size, ratio, tarDuration.Seconds(), uploadDuration.Seconds(), time.Since(startTime).Seconds())
+
+	// Recorded after the commit, the event log would otherwise wait on the transaction for the DB's only connection
+	events.Record(instance.id, eventSuccess, tarFileName, time.Since(startTime))
+	backupMetrics.SetLastSaveSize(instance.containerName, totalSize)
+	outcome = backupResultSuccess
+
+	// The backup itself succeeded, but destinations missing their copy are reported so they get looked at
+	if len(copyFailures) > 0 {
+		notifier.NotifyFailure(NotificationData{
+			Instance: instance.containerName,
+			Error:    fmt.Sprintf("saved, but could not copy to %d of %d destinations: %v", len(copyFailures), len(instance.destinations), strings.Join(copyFailures, "; ")),
+		})
+	}
+
+	return nil
+
+}
+
+// Saves the world and disables saving so the world files don't change while they are copied
+// If the context is cancelled during the waits, saving is left on and the context's error returned
+func quiesceInstance(ctx context.Context, instance Instance) error {
+
+	// Save the mc world
+	_ = say("Saving world...", instance) // Tell players that the world is saving
+	sentAt := time.Now()
+	output, err := runDockerCommand(instance.saveCommand, instance)
+	if err != nil {
+		_ = say("Failed to save world", instance)
+		return fmt.Errorf("Could not save world: %v", err)
+	}
+
+	// Network filesystems flush and update timestamps lazily, so give them longer to settle
+	allDelay, offDelay := saveAllDelay, saveOffDelay
+	if instance.nfsMode {
+		allDelay = max(allDelay, nfsSaveAllDelay)
+		offDelay = max(offDelay, nfsSaveOffDelay)
+	}
+
+	// Wait for the save to finish
+	// A confirmed save on NFS may not have reached the share yet, so those always wait out the delay
+	if instance.nfsMode {
+		err = sleepContext(ctx, allDelay)
+	} else {
+		var confirmed bool
+		confirmed, err = waitForSave(ctx, instance.containerName, output, sentAt, allDelay)
+		if err == nil && !confirmed {
+			confirmed = confirmSave(instance)
+			if !confirmed {
+				log.Printf("%v: The save wasn't confirmed within %v, archiving anyway\n", instance.containerName, allDelay)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Backup interrupted: %v", err)
+	}
+
+	// Freeze the whole container instead of disabling saving, so nothing in the world can change during the copy
+	if instance.pauseDuringBackup {
+		return pauseContainer(instance.containerName)
+	}
+
+	// Disable saving
+	// This ensures the save file doesn't change during the copy
+	_, err = runDockerCommand("/save-off", instance)
+	if err != nil {
+		return fmt.Errorf("Could not save world: %v", err)
+	}
+
+	// Buffer to make sure the files aren't being accessed anymore
+	err = sleepContext(ctx, offDelay)
+	if err != nil {
+		_ = resumeInstance(instance)
+		return fmt.Errorf("Backup interrupted: %v", err)
+	}
+
+	return nil
+}
+
+// Waits until the server confirms the save, or for the delay if it doesn't in time, and reports whether it was confirmed
+// "save-all flush" only answers once the world is written, so its output usually confirms it straight away,
+// other save commands are confirmed by the server logging savedGameMessage, which is polled for in the container's logs
+func waitForSave(ctx context.Context, container string, output string, sentAt time.Time, delay time.Duration) (bool, error) {
+
+	if strings.Contains(output, savedGameMessage) {
+		return true, nil
+	}
+
+	since := fmt.Sprintf("%d.%09d", sentAt.Unix(), sentAt.Nanosecond())
+	deadline := time.Now().Add(delay)
+
+	for time.Now().Before(deadline) {
+		err := sleepContext(ctx, min(savePollInterval, time.Until(deadline)))
+		if err != nil {
+			return false, err
+		}
+
+		logs, err := runCommand(containerBinary, "logs", "--since", since, container)
+		if err == nil && strings.Contains(logs, savedGameMessage) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Asks the server to finish any save in progress with "save-all flush", which only answers once the world is written,
+// and reports whether it confirmed the save
+// Instances whose save_command is already that got their answer the first time, and servers that don't accept flush can't confirm it
+func confirmSave(instance Instance) bool {
+
+	if instance.saveCommand == flushSaveCommand {
+		return false
+	}
+
+	output, err := runDockerCommand(flushSaveCommand, instance)
+	return err == nil && strings.Contains(output, savedGameMessage)
+}
+
+func pauseContainer(container string) error {
+	output, err := runCommand(containerBinary, "pause", container)
+	if err != nil {
+		return fmt.Errorf("Could not pause container: %v, error: %v", output, err)
+	}
+	return nil
+}
+
+func unpauseContainer(container string) error {
+	output, err := runCommand(containerBinary, "unpause", container)
+	if err != nil {
+		return fmt.Errorf("Could not unpause container: %v, error: %v", output, err)
+	}
+	return nil
+}
+
+// Re-enables saving after quiesceInstance
+func resumeInstance(instance Instance) error {
+	output, err := runDockerCommand("/save-on", instance)
+	if err != nil {
+		return fmt.Errorf("Could not re-enable mc saving: %v, error: %v", output, err)
+	}
+	return nil
+}
+
+// Compares the SHA-256 checksum S3 stored for an uploaded save with the one expected from its data
+// A corrupt object is deleted, so the save fails without leaving anything behind that looks like a good backup
+func verifyS3Upload(instance Instance, fileName string, bucket string, keyPrefix string, region string, expected string) error {
+
+	checksum, err := s3ChecksumSHA256(fileName, bucket, keyPrefix, region)
+	if err != nil {
+		return err
+	}
+
+	if checksum == "" {
+		log.Printf("%v: Could not verify upload of %v, S3 stored it without a SHA-256 checksum\n", instance.containerName, fileName)
+		return nil
+	}
+
+	comparable, match := compareChecksums(checksum, expected)
+	if !comparable {
+		log.Printf("%v: Could not verify upload of %v, it was uploaded in a different number of parts than expected\n", instance.containerName, fileName)
+	} else if !match {
+		err = deleteS3File(fileName, bucket, keyPrefix, region)
+		if err != nil {
+			log.Printf("%v: Could not delete corrupt upload: %v\n", instance.containerName, err)
+		}
+		return fmt.Errorf("Upload of %v is corrupt, S3 has checksum %v but the data should give %v", fileName, checksum, expected)
+	}
+
+	return nil
+}
+
+// Returns how long until the instance's minimum backup gap has passed, or 0 if a backup may start now
+func backupGapRemaining(db *sql.DB, instance Instance) (time.Duration, error) {
+
+	if instance.minBackupGapMinutes == 0 {
+		return 0, nil
+	}
+
+	var createdAt string
+
+	err := db.QueryRow("SELECT created_at FROM saves WHERE instance_id = ? ORDER BY created_at DESC, id DESC LIMIT 1", instance.id).Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	lastBackup, err := parseDBTime(createdAt)
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := time.Duration(instance.minBackupGapMinutes)*time.Minute - time.Since(lastBackup)
+	if remaining < 0 {
+		return 0, nil
+	}
+
+	return remaining, nil
+}
+
+func getInstances(db *sql.DB) ([]Instance, error) {
+
+	var containerName, description, dirName, s3Bucket, prefix, workingPath, transitionStorageClass, restoreDrillImage string
+	var failoverBucket, failoverRegion, saveCommand, playerCountCmd, playerCountRegex, keyLayout, playerDataPrefix, playerDataPaths, compressionFormats, watchedPlayers, backend, backendDir, serverType, sftpHost, sftpUser, sftpKeyPath, storageClass, backupTrigger, retentionMode, rconHost, rconPassword, preBackupCmd, postBackupCmd, region, cron, incrementalMethod string
+	var keepInventory, active, nfsMode, writeCanary, pauseDuringBackup, zstdDictionary, recordPlayers, dedupeUnchanged, incremental, presenceNotifications, hashInFilename, verifyUploads, backupWhenEmpty, encrypt, onlyWhenChanged bool
+	var instances []Instance
+	var id, restoreDrillIntervalHours, tarBlockingFactor, minBackupGapMinutes, diskReadLimitKBps, emptyConfirmations, playerDataIntervalMinutes, stopTimeoutSeconds, fullEvery, backupIntervalMinutes, sftpPort, backupTriggerIntervalMinutes, retentionDays, rconPort int
+	var groupID sql.NullInt64
+	var maxLoadAverage float64
+	var bucketQuotaBytes int64
+
+	rows, err := db.Query("SELECT id,container_name,description,dir_name,s3_bucket,prefix,working_path,active,keep_inventory,transition_storage_class,restore_drill_image,restore_drill_interval_hours,nfs_mode,group_id,write_canary,max_load_average,tar_blocking_factor,pause_during_backup,min_backup_gap_minutes,zstd_dictionary,disk_read_limit_kbps,failover_bucket,failover_region,record_players,save_command,empty_confirmations,dedupe_unchanged,player_count_cmd,player_count_regex,key_layout,playerdata_interval_minutes,playerdata_prefix,playerdata_paths,compression_formats,stop_timeout_seconds,incremental,full_every,presence_notifications,watched_players,hash_in_filename,bucket_quota_bytes,backup_interval_minutes,verify_uploads,backend,backend_dir,server_type,backup_when_empty,sftp_host,sftp_port,sftp_user,sftp_key_path,storage_class,backup_trigger,backup_trigger_interval_minutes,retention_days,retention_mode,rcon_host,rcon_port,rcon_password,pre_backup_cmd,post_backup_cmd,encrypt,region,only_when_changed,cron,incremental_method FROM instances")
+	if err != nil {
+		return nil, fmt.Errorf("could not query instances: %v", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Error closing rows: %s", err)
+		}
+	}(rows)
+
+	for row := 1; rows.Next(); row++ {
+		err = rows.Scan(&id, &containerName, &description, &dirName, &s3Bucket, &prefix, &workingPath, &active, &keepInventory, &transitionStorageClass, &restoreDrillImage, &restoreDrillIntervalHours, &nfsMode, &groupID, &writeCanary, &maxLoadAverage, &tarBlockingFactor, &pauseDuringBackup, &minBackupGapMinutes, &zstdDictionary, &diskReadLimitKBps, &failoverBucket, &failoverRegion, &recordPlayers, &saveCommand, &emptyConfirmations, &dedupeUnchanged, &playerCountCmd, &playerCountRegex, &keyLayout, &playerDataIntervalMinutes, &playerDataPrefix, &playerDataPaths, &compressionFormats, &stopTimeoutSeconds, &incremental, &fullEvery, &presenceNotifications, &watchedPlayers, &hashInFilename, &bucketQuotaBytes, &backupIntervalMinutes, &verifyUploads, &backend, &backendDir, &serverType, &backupWhenEmpty, &sftpHost, &sftpPort, &sftpUser, &sftpKeyPath, &storageClass, &backupTrigger, &backupTriggerIntervalMinutes, &retentionDays, &retentionMode, &rconHost, &rconPort, &rconPassword, &preBackupCmd, &postBackupCmd, &encrypt, &region, &onlyWhenChanged, &cron, &incrementalMethod)
+		// A bad row, e.g. a NULL or text where a number belongs after a manual insert, only takes that instance out
+		if err != nil {
+			log.Printf("Skipping instance row %d that can't be read: %s", row, err)
+			continue
 		}
 
 		// Append the instance to the instances slice
@@ -341,92 +1772,646 @@ func getInstances(db *sql.DB) ([]Instance, error) {
 			workingPath:   workingPath,
 			active:        active,
 			keepInventory: keepInventory,
+
+			transitionStorageClass:    transitionStorageClass,
+			restoreDrillImage:         restoreDrillImage,
+			restoreDrillIntervalHours: restoreDrillIntervalHours,
+			nfsMode:                   nfsMode,
+			groupID:                   int(groupID.Int64),
+			writeCanary:               writeCanary,
+			maxLoadAverage:            maxLoadAverage,
+			tarBlockingFactor:         tarBlockingFactor,
+			pauseDuringBackup:         pauseDuringBackup,
+			minBackupGapMinutes:       minBackupGapMinutes,
+			zstdDictionary:            zstdDictionary,
+			diskReadLimitKBps:         diskReadLimitKBps,
+			failoverBucket:            failoverBucket,
+			failoverRegion:            failoverRegion,
+			recordPlayers:             recordPlayers,
+			saveCommand:               saveCommand,
+			emptyConfirmations:        emptyConfirmations,
+			dedupeUnchanged:           dedupeUnchanged,
+			playerCountCmd:            playerCountCmd,
+			playerCountRegex:          playerCountRegex,
+			keyLayout:                 keyLayout,
+			playerDataIntervalMinutes: playerDataIntervalMinutes,
+			playerDataPrefix:          playerDataPrefix,
+			playerDataPaths:           playerDataPaths,
+			compressionFormats:        compressionFormats,
+			stopTimeoutSeconds:        stopTimeoutSeconds,
+			incremental:               incremental,
+			fullEvery:                 fullEvery,
+			incrementalMethod:         incrementalMethod,
+			presenceNotifications:     presenceNotifications,
+			watchedPlayers:            watchedPlayers,
+			hashInFilename:            hashInFilename,
+			bucketQuotaBytes:          bucketQuotaBytes,
+			backupIntervalMinutes:     backupIntervalMinutes,
+			verifyUploads:             verifyUploads,
+			backend:                   backend,
+			backendDir:                backendDir,
+			serverType:                serverType,
+			backupWhenEmpty:           backupWhenEmpty,
+			sftpHost:                  sftpHost,
+			sftpPort:                  sftpPort,
+			sftpUser:                  sftpUser,
+			sftpKeyPath:               sftpKeyPath,
+			storageClass:              storageClass,
+
+			backupTrigger:                backupTrigger,
+			backupTriggerIntervalMinutes: backupTriggerIntervalMinutes,
+
+			retentionDays: retentionDays,
+			retentionMode: retentionMode,
+
+			rconHost:     rconHost,
+			rconPort:     rconPort,
+			rconPassword: rconPassword,
+
+			preBackupCmd:  preBackupCmd,
+			postBackupCmd: postBackupCmd,
+
+			encrypt: encrypt,
+			region:  region,
+
+			onlyWhenChanged: onlyWhenChanged,
+
+			cron: cron,
 		})
 
 	}
-	return instances, nil
-}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read instances: %v", err)
+	}
+
+	destinations, err := getDestinations(db)
+	if err != nil {
+		return nil, err
+	}
+	for i := range instances {
+		instances[i].destinations = destinations[instances[i].id]
+	}
+
+	return instances, nil
+}
+
+func removeOldSaves(db *sql.DB, instance Instance, saveRetention int) error {
+
+	// Decide what to prune up front, with the same logic simulate-retention uses
+	saves, err := getRetainedSaves(db, instance)
+	if err != nil {
+		return err
+	}
+
+	policy := retentionPolicy{
+		keepCount:  saveRetention,
+		keepAge:    time.Duration(instance.retentionDays) * 24 * time.Hour,
+		keepEither: instance.retentionMode == retentionModeEither,
+	}
+
+	// An instance writing several formats keeps saveRetention saves of each, rather than of all of them together
+	groups := map[string][]retainedSave{"": saves}
+	formats, _ := parseCompressionFormats(instance.compressionFormats)
+	if len(formats) > 1 {
+		groups = map[string][]retainedSave{}
+		for _, save := range saves {
+			format := archiveFormat(save.fileName)
+			groups[format] = append(groups[format], save)
+		}
+	}
+
+	var pruned []retainedSave
+	for _, group := range groups {
+		_, groupPruned := pruneSaves(group, policy, time.Now())
+		pruned = append(pruned, groupPruned...)
+	}
+	if len(pruned) == 0 {
+		return nil
+	}
+
+	prunedIDs := make(map[int]bool)
+	for _, save := range pruned {
+		prunedIDs[save.id] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	// If the function errors out, call rollback.
+	// If everything is successful and tx is committed, rollback should have no effect
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	// The saves are read through the transaction, the DB's only connection can't serve a query and a transaction at once
+	saveRecords, err := tx.Query("SELECT id,filename,size,s3_bucket,region,prefix FROM saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC", instance.id)
+	if err != nil {
+		return fmt.Errorf("Could not query DB: %v", err)
+	}
+
+	defer func(saveRecords *sql.Rows) {
+		err := saveRecords.Close()
+		if err != nil {
+			log.Printf("Error closing saves: %s", err)
+		}
+	}(saveRecords)
+
+	var fileName, bucket, region, prefix string
+	var id int
+	var size int64
+	var failures []string          // A save whose file couldn't be deleted stays recorded, so it is tried again next cycle
+	var deleted []NotificationData // Reported once the deletions are committed
+
+	for saveRecords.Next() {
+
+		err = saveRecords.Scan(&id, &fileName, &size, &bucket, &region, &prefix)
+		if err != nil {
+			return fmt.Errorf("Error scanning row: %s", err)
+		}
+
+		if !prunedIDs[id] {
+			continue
+		}
+
+		// Deduped saves share their object with another save, which may still be kept
+		var references int
+		err = tx.QueryRow("SELECT COUNT(*) FROM saves WHERE deleted = 0 AND instance_id = ? AND filename = ? AND s3_bucket = ? AND prefix = ? AND id != ?",
+			instance.id, fileName, bucket, prefix, id).Scan(&references)
+		if err != nil {
+			return fmt.Errorf("Could not query DB: %v", err)
+		}
+
+		if references == 0 {
+			err = instanceStorage(instance, bucket, prefix, region, "").Delete(fileName)
+			if err != nil {
+				log.Printf("%v: Could not delete save file %v: %v\n", instance.containerName, fileName, err)
+				failures = append(failures, fmt.Sprintf("%v: %v", fileName, err))
+				continue
+			}
+
+			err = deleteSaveCopies(tx, instance, fileName, prefix)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec("UPDATE saves SET deleted = 1 WHERE id = ?", id)
+		if err != nil {
+			return fmt.Errorf("Could not update save record: %v", err)
+		}
+		deleted = append(deleted, NotificationData{Instance: instance.containerName, Filename: fileName, Size: size})
+
+	}
+	if err = saveRecords.Err(); err != nil {
+		return fmt.Errorf("Error reading saves: %v", err)
+	}
+
+	err = commitUnlessDryRun(tx, fmt.Sprintf("%d saves of %v as deleted", len(pruned)-len(failures), instance.containerName))
+	if err != nil {
+		return fmt.Errorf("Could not commit transaction: %v", err)
+	}
+	notifyDeletions(deleted)
+
+	return pruneFailuresError(failures)
+}
+
+// Records a save that reuses the previous save's object when the world's fingerprint hasn't changed since
+// Returns the reused filename, or an empty string when the world changed and needs a real backup
+func dedupeSave(db *sql.DB, instance Instance, fingerprint string, players string) (string, error) {
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("Could not start transaction: %v", err)
+	}
+	defer func(transaction *sql.Tx) {
+		_ = transaction.Rollback()
+	}(transaction)
+
+	var previousFingerprint, fileName, storageClass, canary, bucket, region, prefix, version, checksum, encryption string
+	var size int64
+	var dictionaryID sql.NullInt64
+
+	err = transaction.QueryRow("SELECT fingerprint,filename,size,storage_class,canary,dictionary_id,s3_bucket,region,prefix,version,checksum,encryption FROM saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC, id DESC LIMIT 1",
+		instance.id).Scan(&previousFingerprint, &fileName, &size, &storageClass, &canary, &dictionaryID, &bucket, &region, &prefix, &version, &checksum, &encryption)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Could not query latest save: %v", err)
+	}
 
-func removeOldSaves(db *sql.DB, instance Instance, saveRetention int) error {
+	if previousFingerprint == "" || previousFingerprint != fingerprint {
+		return "", nil
+	}
 
-	saveRecords, err := db.Query("SELECT id,filename FROM saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC", instance.id)
+	_, err = transaction.Exec("INSERT INTO saves (filename,size,storage_class,canary,dictionary_id,s3_bucket,region,players,fingerprint,prefix,version,checksum,encryption,deduped,instance_id) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,1,?)",
+		fileName, size, storageClass, canary, dictionaryID, bucket, region, players, fingerprint, prefix, version, checksum, encryption, instance.id)
 	if err != nil {
-		return fmt.Errorf("Could not query DB: %v", err)
+		return "", fmt.Errorf("Could not insert save record: %v", err)
 	}
 
-	defer func(saveRecords *sql.Rows) {
-		err := saveRecords.Close()
+	err = commitUnlessDryRun(transaction, fmt.Sprintf("a deduped save of %v referencing %v", instance.containerName, fileName))
+	if err != nil {
+		return "", fmt.Errorf("Could not commit transaction: %v", err)
+	}
+
+	return fileName, nil
+}
+
+// An archive that has been uploaded and is waiting for its save record
+type uploadedArchive struct {
+	fileName     string
+	size         int64
+	storageClass string
+	dictionaryID sql.NullInt64
+	bucket       string // Bucket the archive failed over to, empty for the instance's bucket
+	region       string
+	format       string
+	checksum     string
+}
+
+// The parts of a save record needed to fetch it back from S3
+type Save struct {
+	id           int
+	fileName     string
+	dictionaryID sql.NullInt64 // Dictionary the save was compressed with, if any
+	bucket       string        // Bucket the save failed over to, empty for the instance's bucket
+	region       string        // Region of the bucket, empty for the default region
+	prefix       string        // Key prefix the save was uploaded under, empty for the instance's prefix
+	parentID     sql.NullInt64 // Save this one is a delta of, if it is a delta
+	deleted      bool          // Removed by retention, the object is gone from S3
+	encryption   string        // Algorithm the archive is encrypted with, empty if it isn't
+	saveType     string        // full, delta or incremental
+}
+
+type Instance struct {
+	id            int
+	containerName string
+	description   string
+	dirName       string
+	keepInventory bool
+	prefix        string
+	s3Bucket      string
+	active        bool
+	workingPath   string
+
+	transitionStorageClass    string  // Storage class to move the save to after upload, empty to leave it as uploaded
+	restoreDrillImage         string  // Image used to boot the latest save in a throwaway container, empty to disable restore drills
+	restoreDrillIntervalHours int     // How often a restore drill runs
+	nfsMode                   bool    // The world lives on a network filesystem, see README for what this changes
+	groupID                   int     // Backup group the instance is archived with, 0 for individual backups
+	writeCanary               bool    // Append a marker file to each archive to detect truncation
+	maxLoadAverage            float64 // Defer the backup while the 1-minute load average is above this, 0 to disable
+	tarBlockingFactor         int     // tar --blocking-factor (records of N x 512 bytes), 0 for tar's default
+	pauseDuringBackup         bool    // docker pause the container during the tar instead of using /save-off
+	minBackupGapMinutes       int     // Refuse to start a backup this soon after the last successful one, 0 to disable
+	zstdDictionary            bool    // Compress with zstd using a dictionary trained on the world instead of gzip
+	diskReadLimitKBps         int     // Limit how fast the world is read while archiving, in KiB/s, 0 for unlimited
+	failoverBucket            string  // Bucket to upload to when the primary bucket's region is unreachable, empty to disable failover
+	failoverRegion            string  // Region of the failover bucket
+	recordPlayers             bool    // Store the names of the players online with each save
+	saveCommand               string  // Command sent to save the world before the archive is taken, e.g. "save-all flush"
+	emptyConfirmations        int     // Consecutive empty player checks needed before a backup is skipped
+	dedupeUnchanged           bool    // Record an unchanged world as a reference to the previous save instead of uploading it again
+	playerCountCmd            string  // Command run instead of /list to get the player count, for servers that don't answer /list
+	playerCountRegex          string  // Regex whose first group captures the count in playerCountCmd's output
+	keyLayout                 string  // How saves are laid out under the prefix, "flat" or "version"
+	playerDataIntervalMinutes int     // Back up just the player data this often, 0 to disable
+	playerDataPrefix          string  // Prefix player data backups are uploaded to, empty for prefix/playerdata
+	playerDataPaths           string  // Comma separated directories in the world that make up the player data
+	compressionFormats        string  // Comma separated archive formats to upload each save in, e.g. "zstd,gzip", empty for just one
+	stopTimeoutSeconds        int     // How long a restore waits for the container to stop before giving up
+	incremental               bool    // Upload only the files that changed since the previous save, with a full save every fullEvery saves
+	fullEvery                 int     // Length of a chain of saves in incremental mode, counting the full save it starts with
+	incrementalMethod         string  // How incremental saves find what changed, "manifest" or "tar"
+	presenceNotifications     bool    // Notify when the server goes from empty to having players online and back
+	watchedPlayers            string  // Comma separated player names that defer the backup while any of them is online
+	hashInFilename            bool    // Add a prefix of the archive's SHA-256 to its name, so identical archives are obvious in the bucket
+	bucketQuotaBytes          int64   // Skip the upload if it would take the instance's stored saves past this many bytes, 0 to disable
+	backupIntervalMinutes     int     // How often the instance is backed up, 0 for the global saveInterval
+	verifyUploads             bool    // Compare each uploaded object's SHA-256 checksum with the archive's and fail the backup on a mismatch
+	backend                   string  // Where saves are stored, s3 or local
+	backendDir                string  // Directory the local backend copies saves to
+	serverType                string  // Game the container runs, minecraft or factorio, which decides how it is saved before a backup
+	backupWhenEmpty           bool    // Back up even when no players are online
+	sftpHost                  string  // Host the sftp backend uploads to
+	sftpPort                  int
+	sftpUser                  string
+	sftpKeyPath               string // Private key for the sftp backend, empty for the user's default keys
+	storageClass              string // S3 storage class saves are uploaded with, empty for the config file's s3_storage_class
+
+	backupTrigger                string // Text that starts a backup when it shows up in the container's log, empty to disable
+	backupTriggerIntervalMinutes int    // Least time between two backups started by backupTrigger
+
+	retentionDays int    // Keep saves younger than this many days, 0 to only go by save_retention_count
+	retentionMode string // How retentionDays and save_retention_count combine, retentionModeEither or retentionModeBoth
+
+	rconHost     string // Send server commands over RCON to this host instead of through the rcon client in the container, empty for docker exec
+	rconPort     int
+	rconPassword string
+
+	preBackupCmd  string // Run on the host before the server is saved, a failure aborts the backup
+	postBackupCmd string // Run on the host once the backup is over, with MCBACKUPER_RESULT set to success or failure
+
+	encrypt bool   // Encrypt saves with the config file's key before they are uploaded
+	region  string // Region of s3_bucket, empty for the AWS CLI's default region
+
+	onlyWhenChanged bool // Skip the backup when no world file was modified since the last save
+
+	cron string // Cron expression the instance is backed up at instead of every backupIntervalMinutes, empty to use the interval
+
+	destinations []Destination // Other backends saves are copied to, from the destinations table
+}
+
+// Largest accepted tar blocking factor, which gives 2 MiB records
+const maxTarBlockingFactor = 4096
+
+// validateInstance checks the instance's settings before it is backed up
+func validateInstance(instance Instance) error {
+
+	if instance.storageClass != "" && !storageClasses[instance.storageClass] {
+		return fmt.Errorf("unknown storage class: %v", instance.storageClass)
+	}
+
+	if instance.transitionStorageClass != "" && !storageClasses[instance.transitionStorageClass] {
+		return fmt.Errorf("unknown transition storage class: %v", instance.transitionStorageClass)
+	}
+
+	if instance.tarBlockingFactor < 0 || instance.tarBlockingFactor > maxTarBlockingFactor {
+		return fmt.Errorf("tar blocking factor must be between 0 and %d", maxTarBlockingFactor)
+	}
+
+	if instance.failoverBucket != "" && instance.failoverRegion == "" {
+		return fmt.Errorf("a failover region is required with a failover bucket")
+	}
+
+	if instance.diskReadLimitKBps < 0 {
+		return fmt.Errorf("disk read limit can't be negative")
+	}
+
+	if instance.minBackupGapMinutes < 0 {
+		return fmt.Errorf("minimum backup gap can't be negative")
+	}
+
+	if instance.backupTrigger != "" && strings.TrimSpace(instance.backupTrigger) == "" {
+		return fmt.Errorf("backup trigger is only whitespace")
+	}
+	if instance.backupTriggerIntervalMinutes < 0 {
+		return fmt.Errorf("backup trigger interval can't be negative")
+	}
+
+	if instance.rconHost != "" && (instance.rconPort < 1 || instance.rconPort > 65535) {
+		return fmt.Errorf("rcon port must be between 1 and 65535")
+	}
+
+	if instance.preBackupCmd != "" && strings.TrimSpace(instance.preBackupCmd) == "" {
+		return fmt.Errorf("pre-backup command is only whitespace")
+	}
+	if instance.postBackupCmd != "" && strings.TrimSpace(instance.postBackupCmd) == "" {
+		return fmt.Errorf("post-backup command is only whitespace")
+	}
+
+	if strings.ContainsAny(instance.region, " \t\r\n") {
+		return fmt.Errorf("region %q can't contain whitespace", instance.region)
+	}
+
+	if instance.encrypt && encryptionKey == nil {
+		return fmt.Errorf("encrypt is on but no encryption_key or encryption_key_file is configured")
+	}
+
+	if instance.retentionDays < 0 {
+		return fmt.Errorf("retention days can't be negative")
+	}
+	if instance.retentionMode != retentionModeEither && instance.retentionMode != retentionModeBoth {
+		return fmt.Errorf("invalid retention mode %v, expected %v or %v", instance.retentionMode, retentionModeEither, retentionModeBoth)
+	}
+
+	if len(worldDirs(instance)) == 0 {
+		return fmt.Errorf("dir_name must name at least one world directory")
+	}
+
+	if instance.keyLayout != "flat" && instance.keyLayout != "version" {
+		return fmt.Errorf("invalid key layout %v, expected flat or version", instance.keyLayout)
+	}
+
+	if instance.playerCountCmd != "" {
+		if strings.TrimSpace(instance.playerCountCmd) == "" {
+			return fmt.Errorf("player_count_cmd is only whitespace")
+		}
+		_, err := playerCountPattern(instance)
 		if err != nil {
-			log.Printf("Error closing saves: %s", err)
+			return err
 		}
-	}(saveRecords)
+	}
 
-	var fileName string
-	var id int
-	i := 0
+	if instance.compressionFormats != "" {
+		formats, err := parseCompressionFormats(instance.compressionFormats)
+		if err != nil {
+			return err
+		}
+		if len(formats) == 0 {
+			return fmt.Errorf("no compression formats listed")
+		}
+	}
 
-	tx, _ := db.Begin()
-	// If the function errors out, call rollback.
-	// If everything is successful and tx is committed, rollback should have no effect
-	defer func(tx *sql.Tx) {
-		_ = tx.Rollback()
-	}(tx)
+	if instance.playerDataIntervalMinutes < 0 {
+		return fmt.Errorf("player data interval can't be negative")
+	}
 
-	for saveRecords.Next() {
+	if instance.incremental {
+		if instance.fullEvery < 1 {
+			return fmt.Errorf("full every must be at least 1")
+		}
+		if instance.dedupeUnchanged {
+			return fmt.Errorf("incremental mode can't be combined with dedupe unchanged, an unchanged world already uploads an almost empty delta")
+		}
+		formats, _ := parseCompressionFormats(instance.compressionFormats)
+		if len(formats) > 1 {
+			return fmt.Errorf("incremental mode only supports a single compression format")
+		}
+		switch instance.incrementalMethod {
+		case incrementalManifest:
+		case incrementalTar:
+			// The staged copy's files are new every backup, so tar would take each of them for changed
+			if instance.nfsMode {
+				return fmt.Errorf("incremental method tar can't be combined with NFS mode, every save would archive the whole world")
+			}
+		default:
+			return fmt.Errorf("invalid incremental method %v, expected manifest or tar", instance.incrementalMethod)
+		}
+	}
 
-		if i < saveRetention {
-			i = i + 1
-			continue
+	if instance.watchedPlayers != "" && instance.playerCountCmd != "" {
+		return fmt.Errorf("watched players need player names from /list, which aren't available with a player count command")
+	}
+
+	switch instance.backend {
+	case backendS3:
+	case backendLocal:
+		if instance.backendDir == "" {
+			return fmt.Errorf("a backend directory is required with the local backend")
+		}
+		if instance.failoverBucket != "" || instance.transitionStorageClass != "" || instance.storageClass != "" {
+			return fmt.Errorf("failover buckets and storage classes only work with the s3 backend")
+		}
+		if instance.zstdDictionary || instance.playerDataIntervalMinutes > 0 {
+			return fmt.Errorf("zstd dictionaries and player data backups are still uploaded to S3 and need the s3 backend")
+		}
+	case backendSFTP:
+		if instance.backendDir == "" || instance.sftpHost == "" || instance.sftpUser == "" {
+			return fmt.Errorf("a backend directory, SFTP host and SFTP user are required with the sftp backend")
+		}
+		if instance.sftpPort < 1 || instance.sftpPort > 65535 {
+			return fmt.Errorf("invalid SFTP port %d", instance.sftpPort)
+		}
+		if instance.failoverBucket != "" || instance.transitionStorageClass != "" || instance.storageClass != "" {
+			return fmt.Errorf("failover buckets and storage classes only work with the s3 backend")
 		}
+		if instance.zstdDictionary || instance.playerDataIntervalMinutes > 0 {
+			return fmt.Errorf("zstd dictionaries and player data backups are still uploaded to S3 and need the s3 backend")
+		}
+	default:
+		return fmt.Errorf("invalid backend %v, expected s3, local or sftp", instance.backend)
+	}
 
-		err = saveRecords.Scan(&id, &fileName)
+	for _, destination := range instance.destinations {
+		err := validateDestination(destination)
 		if err != nil {
-			return fmt.Errorf("Error scanning row: %s", err)
+			return err
 		}
+	}
 
-		err = deleteS3File(fileName, instance.s3Bucket, instance.prefix)
-		if err != nil {
-			return fmt.Errorf("Could not delete save file: %v", err)
+	switch instance.serverType {
+	case serverTypeMinecraft:
+	case serverTypeFactorio:
+		if instance.restoreDrillImage != "" || instance.playerDataIntervalMinutes > 0 {
+			return fmt.Errorf("restore drills and player data backups only work with minecraft servers")
 		}
+	default:
+		return fmt.Errorf("invalid server type %v, expected minecraft or factorio", instance.serverType)
+	}
 
-		_, err = tx.Exec("UPDATE saves SET deleted = 1 WHERE id = ?", id)
+	if instance.backupIntervalMinutes < 0 {
+		return fmt.Errorf("backup interval can't be negative")
+	}
+
+	if instance.cron != "" {
+		_, err := parseCronSchedule(instance.cron)
 		if err != nil {
-			return fmt.Errorf("Could not update save record: %v", err)
+			return fmt.Errorf("invalid cron: %v", err)
 		}
+		if instance.backupIntervalMinutes > 0 {
+			return fmt.Errorf("set only one of cron and backup_interval_minutes")
+		}
+	}
 
+	if instance.bucketQuotaBytes < 0 {
+		return fmt.Errorf("bucket quota can't be negative")
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("Could not commit transaction: %v", err)
+	if instance.stopTimeoutSeconds < 1 {
+		return fmt.Errorf("stop timeout must be at least 1 second")
+	}
+
+	if instance.emptyConfirmations < 1 {
+		return fmt.Errorf("empty confirmations must be at least 1")
 	}
 
-	i = i + 1
+	if instance.restoreDrillImage != "" && instance.restoreDrillIntervalHours < 1 {
+		return fmt.Errorf("restore drill interval must be at least 1 hour")
+	}
 
 	return nil
 }
 
-type Instance struct {
-	id            int
-	containerName string
-	description   string
-	dirName       string
-	keepInventory bool
-	prefix        string
-	s3Bucket      string
-	active        bool
-	workingPath   string
+// Returns the active instances whose saves are stored in the same place as another active instance's, keyed by ID
+// Each is mapped to the name of the first other instance it collides with
+// Retention is counted per instance, so instances sharing a bucket and prefix prune each other's saves as their own
+func conflictingInstances(instances []Instance) map[int]string {
+
+	locations := make(map[int]string) // Where each active instance's saves are stored
+
+	for _, instance := range instances {
+		if !instance.active {
+			continue
+		}
+		location := fmt.Sprintf("s3://%v/%v", instance.s3Bucket, instance.prefix)
+		switch instance.backend {
+		case backendLocal:
+			location = filepath.Join(instance.backendDir, instance.prefix)
+		case backendSFTP:
+			location = fmt.Sprintf("sftp://%v/%v", instance.sftpHost, path.Join(instance.backendDir, instance.prefix))
+		}
+		locations[instance.id] = location
+	}
+
+	conflicts := make(map[int]string)
+	for _, instance := range instances {
+		location, ok := locations[instance.id]
+		if !ok {
+			continue
+		}
+		for _, other := range instances {
+			if other.id != instance.id && other.active && locations[other.id] == location {
+				conflicts[instance.id] = other.containerName
+				break
+			}
+		}
+	}
+
+	return conflicts
 }
 
 func main() {
 
-	var saveInterval int32 = 30 // 30 minutes by default
+	configPath := flag.String("config", "", "Path to a JSON or YAML config file, the built-in defaults are used without one")
+	dryRunFlag := flag.Bool("dry-run", false, "Save and archive worlds as usual but only log uploads, deletes and save records")
+	flag.Parse()
+	dryRun = *dryRunFlag
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	saveInterval := int32(config.SaveIntervalMinutes) // Instances can set their own backup_interval_minutes
 	waitDuration := time.Duration(saveInterval) * time.Minute
-	dbPath := "./db.sqlite" // The path to the sqlite file
-	saveRetention := 5      // How many saves that should be held on to at any given point for each instance
+	dbPath := config.DBPath
+	saveRetention := config.SaveRetentionCount // How many saves that should be held on to at any given point for each instance
+	s3StorageClass = config.S3StorageClass
+	setDefaultCompression(config.Compression, config.CompressionLevel)
+	streamUpload = config.StreamUpload
+	freeSpaceMargin = int64(config.FreeSpaceMarginMB) * 1024 * 1024
+	uploadBandwidth, _ := parseBandwidth(config.MaxUploadBandwidth) // Already checked when the config was loaded
+	uploadLimiter = newBandwidthLimiter(uploadBandwidth)
+	tarAttempts = config.TarAttempts
+	snapshotDir = config.SnapshotDir
+	saveAllDelay = time.Duration(config.SaveAllDelaySeconds) * time.Second
+	saveOffDelay = time.Duration(config.SaveOffDelaySeconds) * time.Second
+	logFilePath := config.LogFilePath
+	maxLoadAverage := config.MaxLoadAverage
+	playerDataRetention := config.PlayerDataRetentionCount
+	crashLoopRestarts := config.CrashLoopRestarts
+	crashLoopWindow := time.Duration(config.CrashLoopWindowMinutes) * time.Minute
+	eventBatchInterval := time.Duration(config.EventBatchIntervalSeconds) * time.Second
+	digestEnabled := config.DigestEnabled
+	dockerExecRetries = config.DockerExecRetries
+	dockerExecBackoff = time.Duration(config.DockerExecBackoffSeconds) * time.Second
+	s3UploadAttempts = config.S3UploadAttempts
+	s3UploadBackoff = time.Duration(config.S3UploadBackoffSeconds) * time.Second
+	dbBusyTimeout = time.Duration(config.DBBusyTimeoutMS) * time.Millisecond
+
+	// Commands that only read the DB work without the runtime, so a missing one only stops the backup loop below
+	containerBinary = config.ContainerRuntime
+	containerPath, containerErr := findContainerBinary(config.ContainerRuntime)
+	if containerErr == nil {
+		containerBinary = containerPath
+	}
 
-	// Make sure AWS CLI is installed and configured
-	err := checkAWSCLI()
+	// Commands need the key too, to restore and verify encrypted saves
+	encryptionKey, err = loadEncryptionKey(config)
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
@@ -440,7 +2425,165 @@ func main() {
 		}
 	}(db)
 
+	// Run a one-off command instead of the backup loop if one was given
+	if flag.NArg() > 0 {
+		err := runSubcommand(db, flag.Args())
+		if err != nil {
+			log.Fatalf("%s: %s", flag.Arg(0), err)
+		}
+		return
+	}
+
+	// Commands above can run alongside the service, but only one copy of the backup loop may run at a time
+	lockFile, err := acquireLockFile(config.LockFilePath)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	if containerErr != nil {
+		log.Fatalf(containerErr.Error())
+	}
+
+	// Make sure AWS CLI is installed and configured
+	err = checkAWSCLI()
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	notifiers, err := configuredNotifiers(config)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	notifier, err = newNotifier(notificationTemplates(config), notifiers)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	logFile, err := newRotatingFile(logFilePath, int64(config.LogMaxSizeMB)*1024*1024, config.LogMaxBackups, time.Duration(config.LogMaxAgeDays)*24*time.Hour)
+	if err != nil {
+		log.Fatalf("Could not open log file: %s", err)
+	}
+	defer func(logFile *RotatingFile) {
+		_ = logFile.Close()
+	}(logFile)
+	setupLogging(io.MultiWriter(os.Stdout, logFile), config.LogFormat)
+
+	if dryRun {
+		log.Printf("[DRY RUN] Nothing will be uploaded, deleted or recorded as a save\n")
+	}
+
+	var metricsServer *http.Server
+	if config.MetricsPort != 0 {
+		// A pass can take up to the save interval plus the backups themselves, so allow two before reporting the loop as stuck
+		metricsServer = startMetricsServer(config.MetricsPort, backupMetrics, db, 2*waitDuration)
+	}
+
+	// Resolve where the DB lives up front, its backups are written next to it
+	dbDir, err := filepath.Abs(filepath.Dir(dbPath))
+	if err != nil {
+		log.Fatalf("Could not resolve DB path: %s", err)
+	}
+
+	// Catch configuration mistakes, such as an invalid player count regex, at startup rather than on the first cycle
+	instances, err := getInstances(db)
+	if err != nil {
+		log.Fatalf("Could not get instances: %s", err)
+	}
+	for _, instance := range instances {
+		if !instance.active {
+			continue
+		}
+		err = validateInstance(instance)
+		if err != nil {
+			log.Fatalf("%v: Invalid instance configuration: %v", instance.containerName, err)
+		}
+	}
+	conflicts := conflictingInstances(instances)
+	for _, instance := range instances {
+		if other, ok := conflicts[instance.id]; ok {
+			log.Fatalf("%v: Invalid instance configuration: saves are stored under the same bucket and prefix as %v, give each instance its own prefix", instance.containerName, other)
+		}
+	}
+
+	crashLoops := newCrashLoopDetector(crashLoopRestarts, crashLoopWindow)
+
+	digestAt, _ := parseDigestTime(config.DigestTime) // Already checked when the config was loaded
+
+	events = newEventLog(db, eventBatchInterval)
+	defer func(events *EventLog) {
+		_ = events.Close()
+	}(events)
+
+	// On Ctrl+C or docker stop, let the backup in progress finish or abort cleanly before exiting
+	// A second signal exits straight away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		received := <-signals
+		log.Printf("Received %v, shutting down once the current backup is finished", received)
+		cancel()
+
+		received = <-signals
+		log.Printf("Received %v again, exiting immediately", received)
+		_ = events.Close()
+		os.Exit(1)
+	}()
+
+	// SIGHUP starts the next pass straight away, e.g. to pick up an instance just added to the DB
+	// A signal during a pass is held on to and ends the wait after it
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+
+	// Backups triggered through the API or in game run outside the loop, the shutdown waits for them separately
+	var manualBackups sync.WaitGroup
+
+	var apiServer *http.Server
+
+	// Exits after a shutdown signal, non-zero if the backup that was running had to be aborted
+	shutdown := func(aborted bool) {
+		manualBackups.Wait()
+		if apiServer != nil {
+			stopAPIServer(apiServer)
+		}
+		if metricsServer != nil {
+			stopMetricsServer(metricsServer)
+		}
+		err := events.Close()
+		if err != nil {
+			log.Printf("Could not flush backup events: %v", err)
+		}
+		err = lockFile.Release()
+		if err != nil {
+			log.Printf("Could not release lock file: %v", err)
+		}
+		if aborted {
+			log.Printf("Exiting, the backup in progress was aborted")
+			os.Exit(1)
+		}
+		log.Printf("Exiting")
+		os.Exit(0)
+	}
+
+	// Up to backupWorkers instances are backed up at once, the rest of the loop runs on this goroutine
+	workerSlots := make(chan struct{}, config.BackupWorkers)
+	var backups sync.WaitGroup
+	var backupAborted atomic.Bool // Set when a backup failed during a shutdown
+
+	if config.APIAddress != "" {
+		apiServer, err = startAPIServer(ctx, config.APIAddress, config.APIToken, logFilePath, db, &manualBackups)
+		if err != nil {
+			log.Fatalf("Could not start API: %s", err)
+		}
+	}
+
+	go watchBackupTriggers(ctx, db, &manualBackups)
+
 	// An example of an insert for a new instance into the database
+	// When each instance is next due, instances that haven't run since startup are due straight away
+	nextRun := make(map[int]time.Time)
+
 	/*
 		_, err = db.Exec("INSERT INTO instances (container_name,description,dir_name,s3_bucket,prefix,working_path,keep_inventory) VALUES (?,?,?,?,?,?,?)",
 			"test-container", "Description of world", "world", "bucket-name", "prefix-to-upload-to", "/home/example/folder", true)
@@ -450,38 +2593,260 @@ func main() {
 	*/
 
 	for {
+		if ctx.Err() != nil {
+			shutdown(false)
+		}
+
+		// Don't pile backups onto a box that is already struggling
+		if maxLoadAverage > 0 {
+			load, err := loadAverage()
+			if err != nil {
+				log.Printf("Could not read load average: %v", err)
+			} else if load > maxLoadAverage {
+				log.Printf("Load average %.2f is above %.2f, deferring backups to the next cycle", load, maxLoadAverage)
+				// Deferring is the loop working as intended, not a hung one
+				loopHealth.LoopCompleted()
+				waitCtx, stopWaiting := untilReload(ctx, reloads)
+				_ = sleepContext(waitCtx, waitDuration)
+				stopWaiting()
+				continue
+			}
+		}
+
+		// A failed read, usually the sqlite file being locked for a moment, skips this cycle rather than stopping every instance's backups
 		instances, err := getInstances(db)
 		if err != nil {
-			log.Fatalf("Could not get instances: %s", err)
+			log.Printf("Could not get instances, retrying next cycle: %s", err)
+			waitCtx, stopWaiting := untilReload(ctx, reloads)
+			_ = sleepContext(waitCtx, waitDuration)
+			stopWaiting()
+			continue
 		}
+		conflicts = conflictingInstances(instances)
+		var cronRuns []Instance        // Cron instances backed up this cycle
+		backedUp := make(map[int]bool) // Instances dispatched this cycle, whose backups already check the players
 
 		for _, instance := range instances {
 
+			if ctx.Err() != nil {
+				backups.Wait()
+				shutdown(backupAborted.Load())
+			}
+
 			if instance.active == false {
 				continue
 			}
 
-			err = removeOldSaves(db, instance, saveRetention-1) // The minus one is to account for the save that is about to happen
+			// Every instance runs on its own interval, counted from when its last backup was dispatched or skipped
+			// Instances with a cron schedule wait for its first time instead of running at startup
+			if _, scheduled := nextRun[instance.id]; !scheduled && instance.cron != "" {
+				nextRun[instance.id] = nextBackupTime(instance, time.Now(), waitDuration)
+			}
+			if time.Now().Before(nextRun[instance.id]) {
+				continue
+			}
+			// Backups that are skipped wait for the next time like a dispatched one, ones deferred for the load or the gap are retried sooner below
+			next := nextBackupTime(instance, time.Now(), waitDuration)
+
+			err = validateInstance(instance)
+			if err != nil {
+				log.Printf("%v: Invalid instance configuration, skipping: %v", instance.containerName, err)
+				nextRun[instance.id] = next
+				continue
+			}
+			if other, ok := conflicts[instance.id]; ok {
+				log.Printf("%v: Invalid instance configuration, skipping: saves are stored under the same bucket and prefix as %v", instance.containerName, other)
+				nextRun[instance.id] = next
+				continue
+			}
+
+			// A server that keeps restarting may have a corrupt world, which shouldn't rotate out good saves
+			crashLooping, firstDetected, restarts, err := crashLoops.Check(instance.containerName)
 			if err != nil {
-				log.Printf("Could not remove old saves: %v", err)
+				log.Printf("%v: Could not check for a crash loop: %v", instance.containerName, err)
+			} else if crashLooping {
+				message := fmt.Sprintf("CRASH LOOP: container restarted %d times in the last %v, skipping backup", restarts, crashLoopWindow)
+				log.Printf("%v: %v", instance.containerName, message)
+				if firstDetected {
+					notifier.NotifyFailure(NotificationData{Instance: instance.containerName, Error: message})
+				}
+				events.Record(instance.id, eventSkipped, message, 0)
+				nextRun[instance.id] = next
+				continue
 			}
 
 			// Set the keepInventory setting based on the that field in the instance
-			if instance.keepInventory == true {
-				_, _ = runDockerCommand("/gamerule keepInventory true", instance.containerName)
-			} else {
-				_, _ = runDockerCommand("/gamerule keepInventory false", instance.containerName)
+			// Only Minecraft has the gamerule
+			if instance.serverType == serverTypeMinecraft {
+				if instance.keepInventory == true {
+					_, _ = runDockerCommand("/gamerule keepInventory true", instance)
+				} else {
+					_, _ = runDockerCommand("/gamerule keepInventory false", instance)
+				}
+			}
+
+			// Grouped instances are backed up together with the rest of their group below
+			if instance.groupID != 0 {
+				nextRun[instance.id] = next
+				continue
+			}
+
+			if instance.maxLoadAverage > 0 {
+				load, err := loadAverage()
+				if err != nil {
+					log.Printf("Could not read load average: %v", err)
+				} else if load > instance.maxLoadAverage {
+					log.Printf("%v: Load average %.2f is above %.2f, deferring backup to the next cycle", instance.containerName, load, instance.maxLoadAverage)
+					events.Record(instance.id, eventSkipped, fmt.Sprintf("load average %.2f is above %.2f", load, instance.maxLoadAverage), 0)
+					nextRun[instance.id] = time.Now().Add(min(loadRetryDelay, backupInterval(instance, waitDuration)))
+					continue
+				}
+			}
+
+			remaining, err := backupGapRemaining(db, instance)
+			if err != nil {
+				log.Printf("%v: Could not check time since last backup: %v", instance.containerName, err)
+				nextRun[instance.id] = next
+				continue
+			}
+			if remaining > 0 {
+				log.Printf("%v: Last backup was less than %d minutes ago, skipping for another %v", instance.containerName, instance.minBackupGapMinutes, remaining.Round(time.Second))
+				nextRun[instance.id] = time.Now().Add(remaining)
+				continue
+			}
+
+			nextRun[instance.id] = next
+			if instance.cron != "" {
+				cronRuns = append(cronRuns, instance)
+			}
+			backedUp[instance.id] = true
+
+			workerSlots <- struct{}{}
+			backups.Add(1)
+			go func(instance Instance) {
+				defer backups.Done()
+				defer func() { <-workerSlots }()
+				// Waits for a backup of the instance triggered through the API, or with a cron schedule skips this run
+				instanceLock := backupLocks.get(instance.id)
+				if instance.cron == "" {
+					instanceLock.Lock()
+				} else if !instanceLock.TryLock() {
+					log.Printf("%v: A backup is already running at the scheduled time, skipping this one\n", instance.containerName)
+					events.Record(instance.id, eventSkipped, "a backup was already running at the scheduled time", 0)
+					return
+				}
+				defer instanceLock.Unlock()
+
+				// Instances sharing a working path would write their archives and canaries over each other, so they take turns
+				pathLock := pathLocks.get(instance.workingPath)
+				pathLock.Lock()
+				defer pathLock.Unlock()
+
+				// A backup started through the API or a trigger while this one waited for the locks may have only just finished
+				remaining, err := backupGapRemaining(db, instance)
+				if err != nil {
+					log.Printf("%v: Could not check time since last backup: %v", instance.containerName, err)
+					return
+				}
+				if remaining > 0 {
+					log.Printf("%v: Last backup was less than %d minutes ago, skipping for another %v", instance.containerName, instance.minBackupGapMinutes, remaining.Round(time.Second))
+					return
+				}
+
+				err = removeOldSaves(db, instance, saveRetention-1) // The minus one is to account for the save that is about to happen
+				if err != nil {
+					log.Printf("Could not remove old saves: %v", err)
+				}
+
+				// Begin the actual backup of the instance
+				backupStart := time.Now()
+				err = backupInstance(ctx, db, instance)
+				if err != nil {
+					log.Printf("%v: Backup failed: %v\n", instance.containerName, err)
+					notifier.NotifyFailure(NotificationData{Instance: instance.containerName, Error: err.Error()})
+					events.Record(instance.id, eventFailure, err.Error(), time.Since(backupStart))
+				}
+				if ctx.Err() != nil {
+					if err != nil {
+						backupAborted.Store(true)
+					}
+					return
+				}
+
+				if instance.restoreDrillImage != "" {
+					due, err := restoreDrillDue(db, instance)
+					if err != nil {
+						log.Printf("%v: Could not check restore drill schedule: %v", instance.containerName, err)
+					} else if due {
+						runRestoreDrill(db, instance)
+					}
+				}
+			}(instance)
+
+		}
+
+		// Groups, the DB backup and the digest run once the cycle's instance backups are done
+		backups.Wait()
+
+		// Scheduled times that passed while the cycle a cron instance ran in was still running are skipped rather than run late
+		for _, instance := range cronRuns {
+			if scheduled := nextRun[instance.id]; scheduled.Before(time.Now()) {
+				log.Printf("%v: The backup cycle was still running at the next scheduled time %v, skipping it\n", instance.containerName, scheduled.Format(time.DateTime))
+				events.Record(instance.id, eventSkipped, fmt.Sprintf("the backup cycle was still running at the next scheduled time %v", scheduled.Format(time.DateTime)), 0)
+			}
+			nextRun[instance.id] = nextBackupTime(instance, time.Now(), waitDuration)
+		}
+		if ctx.Err() != nil {
+			shutdown(backupAborted.Load())
+		}
+
+		// The rest are checked here, so a server filling up or emptying is noticed within a cycle rather than at its next backup
+		for _, instance := range instances {
+			if !instance.active || !instance.presenceNotifications || backedUp[instance.id] {
+				continue
+			}
+			_, _, err := getOnlinePlayers(instance)
+			if err != nil {
+				log.Printf("%v: Could not check players for presence notifications: %v", instance.containerName, err)
 			}
+		}
 
-			// Begin the actual backup of the instance
-			err = backupInstance(db, instance)
+		runGroupBackups(db, instances, saveRetention)
+
+		// The DB holds every instance's save history, so it gets backed up on its own schedule
+		if config.DBBackupBucket != "" {
+			due, err := databaseBackupDue(db, config.DBBackupIntervalHours)
 			if err != nil {
-				fmt.Printf("Could not backup the instance: %v", err)
+				log.Printf("Could not check DB backup schedule: %v", err)
+			} else if due {
+				err = backupDatabase(db, dbDir, config.DBBackupBucket, config.DBBackupPrefix)
+				if err != nil {
+					log.Printf("Could not back up the DB: %v", err)
+				}
 			}
+		}
 
+		if digestEnabled {
+			due, err := digestDue(db, digestAt, time.Now())
+			if err != nil {
+				log.Printf("Could not check digest schedule: %v", err)
+			} else if due {
+				err = sendDigest(db)
+				if err != nil {
+					log.Printf("Could not send digest: %v", err)
+				}
+			}
 		}
 
-		time.Sleep(waitDuration)
+		// One email for everything that failed this pass, rather than one per instance
+		notifier.Flush()
+
+		loopHealth.LoopCompleted()
+
+		// Wake for the next instance that is due, or after the global interval for groups, DB backups and the digest
+		waitCtx, stopWaiting := untilReload(ctx, reloads)
+		waitRunningPlayerDataBackups(waitCtx, db, untilNextBackup(instances, nextRun, time.Now(), waitDuration), playerDataRetention)
+		stopWaiting()
 	}
 
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Metrics for a single instance
+// The JSON names match the metric names used in the text output, apart from last_failure_error which has no numeric form
+// The counts are of rows in the DB, so they are named _recorded rather than _total, which the /metrics counters since startup use
+type instanceMetrics struct {
+	Instance                    string  `json:"instance"`
+	Active                      bool    `json:"active"`
+	LastBackupTimestampSeconds  int64   `json:"mcbackuper_last_backup_timestamp_seconds"`
+	LastBackupDurationSeconds   float64 `json:"mcbackuper_last_backup_duration_seconds"`
+	LastTarDurationSeconds      float64 `json:"mcbackuper_last_tar_duration_seconds"`
+	LastUploadDurationSeconds   float64 `json:"mcbackuper_last_upload_duration_seconds"`
+	LastSaveSizeBytes           int64   `json:"mcbackuper_last_save_size_bytes"`
+	SavesRecorded               int64   `json:"mcbackuper_saves_recorded"`
+	StoredSaves                 int64   `json:"mcbackuper_stored_saves"`
+	StoredBytes                 int64   `json:"mcbackuper_stored_bytes"`
+	FailuresRecorded            int64   `json:"mcbackuper_failures_recorded"`
+	LastFailureTimestampSeconds int64   `json:"mcbackuper_last_failure_timestamp_seconds"`
+	LastFailureError            string  `json:"last_failure_error"`
+}
+
+// Snapshot of every instance's metrics at a point in time
+type metricsSnapshot struct {
+	TimestampSeconds int64             `json:"timestamp_seconds"`
+	Instances        []instanceMetrics `json:"instances"`
+}
+
+// Prints a one-shot snapshot of the backup metrics, as JSON with --json or in the Prometheus text format otherwise
+func metricsCommand(db *sql.DB, args []string) error {
+
+	flags := flag.NewFlagSet("metrics", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print the metrics as a JSON document")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := collectMetrics(db)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(snapshot)
+	}
+
+	for _, metrics := range snapshot.Instances {
+		labels := fmt.Sprintf("{instance=%q}", metrics.Instance)
+		fmt.Printf("mcbackuper_last_backup_timestamp_seconds%v %d\n", labels, metrics.LastBackupTimestampSeconds)
+		fmt.Printf("mcbackuper_last_backup_duration_seconds%v %v\n", labels, metrics.LastBackupDurationSeconds)
+		fmt.Printf("mcbackuper_last_tar_duration_seconds%v %v\n", labels, metrics.LastTarDurationSeconds)
+		fmt.Printf("mcbackuper_last_upload_duration_seconds%v %v\n", labels, metrics.LastUploadDurationSeconds)
+		fmt.Printf("mcbackuper_last_save_size_bytes%v %d\n", labels, metrics.LastSaveSizeBytes)
+		fmt.Printf("mcbackuper_saves_recorded%v %d\n", labels, metrics.SavesRecorded)
+		fmt.Printf("mcbackuper_stored_saves%v %d\n", labels, metrics.StoredSaves)
+		fmt.Printf("mcbackuper_stored_bytes%v %d\n", labels, metrics.StoredBytes)
+		fmt.Printf("mcbackuper_failures_recorded%v %d\n", labels, metrics.FailuresRecorded)
+		fmt.Printf("mcbackuper_last_failure_timestamp_seconds%v %d\n", labels, metrics.LastFailureTimestampSeconds)
+	}
+
+	return nil
+}
+
+// Reads the per-instance metrics from the DB
+func collectMetrics(db *sql.DB) (metricsSnapshot, error) {
+
+	snapshot := metricsSnapshot{TimestampSeconds: time.Now().Unix(), Instances: []instanceMetrics{}}
+
+	instances, err := getInstances(db)
+	if err != nil {
+		return snapshot, err
+	}
+
+	for _, instance := range instances {
+
+		metrics := instanceMetrics{
+			Instance: instance.containerName,
+			Active:   instance.active,
+		}
+
+		err = db.QueryRow("SELECT COUNT(*), COUNT(CASE WHEN deleted = 0 THEN 1 END), COALESCE(SUM(CASE WHEN deleted = 0 THEN size END), 0) FROM saves WHERE instance_id = ?",
+			instance.id).Scan(&metrics.SavesRecorded, &metrics.StoredSaves, &metrics.StoredBytes)
+		if err != nil {
+			return snapshot, fmt.Errorf("could not query save totals: %v", err)
+		}
+
+		var createdAt string
+		var tarMillis, uploadMillis int64
+		err = db.QueryRow("SELECT created_at, size, tar_duration_ms, upload_duration_ms FROM saves WHERE instance_id = ? ORDER BY created_at DESC, id DESC LIMIT 1",
+			instance.id).Scan(&createdAt, &metrics.LastSaveSizeBytes, &tarMillis, &uploadMillis)
+		if err != nil && err != sql.ErrNoRows {
+			return snapshot, fmt.Errorf("could not query last save: %v", err)
+		}
+		if err == nil {
+			lastBackup, err := parseDBTime(createdAt)
+			if err != nil {
+				return snapshot, fmt.Errorf("could not parse last save time: %v", err)
+			}
+			metrics.LastBackupTimestampSeconds = lastBackup.Unix()
+			metrics.LastTarDurationSeconds = float64(tarMillis) / 1000
+			metrics.LastUploadDurationSeconds = float64(uploadMillis) / 1000
+		}
+
+		// The whole backup's duration, save commands and waits included, is only recorded with its event
+		var durationMillis int64
+		err = db.QueryRow("SELECT duration_ms FROM backup_events WHERE instance_id = ? AND kind = ? ORDER BY created_at DESC, id DESC LIMIT 1",
+			instance.id, eventSuccess).Scan(&durationMillis)
+		if err != nil && err != sql.ErrNoRows {
+			return snapshot, fmt.Errorf("could not query last backup event: %v", err)
+		}
+		metrics.LastBackupDurationSeconds = float64(durationMillis) / 1000
+
+		err = db.QueryRow("SELECT COUNT(*) FROM backup_events WHERE instance_id = ? AND kind = ?", instance.id, eventFailure).Scan(&metrics.FailuresRecorded)
+		if err != nil {
+			return snapshot, fmt.Errorf("could not query failure count: %v", err)
+		}
+
+		var failedAt string
+		err = db.QueryRow("SELECT created_at, message FROM backup_events WHERE instance_id = ? AND kind = ? ORDER BY created_at DESC, id DESC LIMIT 1",
+			instance.id, eventFailure).Scan(&failedAt, &metrics.LastFailureError)
+		if err != nil && err != sql.ErrNoRows {
+			return snapshot, fmt.Errorf("could not query last failure: %v", err)
+		}
+		if err == nil {
+			lastFailure, err := parseDBTime(failedAt)
+			if err != nil {
+				return snapshot, fmt.Errorf("could not parse last failure time: %v", err)
+			}
+			metrics.LastFailureTimestampSeconds = lastFailure.Unix()
+		}
+
+		snapshot.Instances = append(snapshot.Instances, metrics)
+	}
+
+	return snapshot, nil
+}
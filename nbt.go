@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// NBT tag types
+const (
+	nbtEnd = iota
+	nbtByte
+	nbtShort
+	nbtInt
+	nbtLong
+	nbtFloat
+	nbtDouble
+	nbtByteArray
+	nbtString
+	nbtList
+	nbtCompound
+	nbtIntArray
+	nbtLongArray
+)
+
+// Compounds nested deeper than this are treated as corrupt, Minecraft itself refuses anything past 512
+const nbtMaxDepth = 512
+
+// Walks an uncompressed NBT document and checks that it is structurally valid
+// Only the structure is checked, so values are skipped rather than decoded
+// Returns the names of the root compound's children, e.g. "Data" for level.dat
+func parseNBT(data []byte) ([]string, error) {
+
+	reader := bytes.NewReader(data)
+
+	tagType, err := reader.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("empty NBT document")
+	}
+	if tagType != nbtCompound {
+		return nil, fmt.Errorf("root tag is type %d, not a compound", tagType)
+	}
+
+	_, err = readNBTString(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return readNBTCompound(reader, 1)
+}
+
+// Reads a compound's children up to and including its end tag and returns their names
+func readNBTCompound(reader *bytes.Reader, depth int) ([]string, error) {
+
+	if depth > nbtMaxDepth {
+		return nil, fmt.Errorf("NBT nested deeper than %d", nbtMaxDepth)
+	}
+
+	var names []string
+
+	for {
+		tagType, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("compound is missing its end tag")
+		}
+		if tagType == nbtEnd {
+			return names, nil
+		}
+
+		name, err := readNBTString(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		err = skipNBTPayload(reader, tagType, depth)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+
+		names = append(names, name)
+	}
+}
+
+// Skips over the value of a tag of the given type
+func skipNBTPayload(reader *bytes.Reader, tagType byte, depth int) error {
+
+	switch tagType {
+	case nbtByte:
+		return skipNBTBytes(reader, 1)
+	case nbtShort:
+		return skipNBTBytes(reader, 2)
+	case nbtInt, nbtFloat:
+		return skipNBTBytes(reader, 4)
+	case nbtLong, nbtDouble:
+		return skipNBTBytes(reader, 8)
+	case nbtByteArray:
+		return skipNBTArray(reader, 1)
+	case nbtIntArray:
+		return skipNBTArray(reader, 4)
+	case nbtLongArray:
+		return skipNBTArray(reader, 8)
+	case nbtString:
+		_, err := readNBTString(reader)
+		return err
+	case nbtCompound:
+		_, err := readNBTCompound(reader, depth+1)
+		return err
+	case nbtList:
+		elementType, err := reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("truncated list")
+		}
+
+		length, err := readNBTLength(reader)
+		if err != nil {
+			return err
+		}
+		if length > 0 && (elementType == nbtEnd || elementType > nbtLongArray) {
+			return fmt.Errorf("list of invalid tag type %d", elementType)
+		}
+
+		for i := 0; i < length; i++ {
+			err = skipNBTPayload(reader, elementType, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid tag type %d", tagType)
+	}
+}
+
+func readNBTString(reader *bytes.Reader) (string, error) {
+
+	var length uint16
+	err := binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		return "", fmt.Errorf("truncated string length")
+	}
+
+	if reader.Len() < int(length) {
+		return "", fmt.Errorf("truncated string")
+	}
+
+	value := make([]byte, length)
+	_, err = reader.Read(value)
+	if err != nil && length > 0 {
+		return "", fmt.Errorf("truncated string")
+	}
+
+	return string(value), nil
+}
+
+// Reads an array or list length, which is a signed 32-bit integer
+func readNBTLength(reader *bytes.Reader) (int, error) {
+
+	var length int32
+	err := binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		return 0, fmt.Errorf("truncated length")
+	}
+	if length < 0 {
+		return 0, fmt.Errorf("negative length %d", length)
+	}
+
+	return int(length), nil
+}
+
+func skipNBTArray(reader *bytes.Reader, elementSize int) error {
+
+	length, err := readNBTLength(reader)
+	if err != nil {
+		return err
+	}
+
+	return skipNBTBytes(reader, length*elementSize)
+}
+
+func skipNBTBytes(reader *bytes.Reader, count int) error {
+
+	if reader.Len() < count {
+		return fmt.Errorf("truncated value")
+	}
+
+	_, err := reader.Seek(int64(count), io.SeekCurrent)
+	return err
+}
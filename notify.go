@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NotificationData holds the fields available to notification templates
+type NotificationData struct {
+	Instance  string
+	Filename  string
+	Size      int64
+	Duration  time.Duration
+	Result    string // success, failure or deletion
+	Error     string
+	Timestamp time.Time // When the notification was sent
+}
+
+// NotificationTemplates are Go text/template bodies for each notification event
+// Empty templates fall back to the built-in defaults
+type NotificationTemplates struct {
+	Success  string
+	Failure  string
+	Deletion string
+}
+
+var defaultNotificationTemplates = NotificationTemplates{
+	Success:  "{{.Instance}}: Save success! {{.Filename}} ({{.Size}} bytes)",
+	Failure:  "{{.Instance}}: Could not backup the instance: {{.Error}}",
+	Deletion: "{{.Instance}}: Deleted old save {{.Filename}}",
+}
+
+// Notifier is somewhere notifications are sent, such as a Discord or Slack webhook or email
+type Notifier interface {
+	// Name of the sink, for the warning logged when sending fails
+	Name() string
+	// Sends the rendered message. data.Result is success, failure or deletion for those events,
+	// which the sink can style the message by, and empty for other messages such as the digest
+	Notify(message string, data NotificationData) error
+}
+
+// Implemented by notifiers that hold messages back to send together, such as email, and flushed after each loop pass
+type flushingNotifier interface {
+	Flush() error
+}
+
+// Results notifications are sent for, which notifiers colour their messages by
+const (
+	resultSuccess  = "success"
+	resultFailure  = "failure"
+	resultDeletion = "deletion"
+)
+
+// MultiNotifier renders notification templates and sends the resulting messages to every configured notifier
+type MultiNotifier struct {
+	success   *template.Template
+	failure   *template.Template
+	deletion  *template.Template
+	notifiers []Notifier // Messages are also sent to each of these, none to only log them
+}
+
+// The notifier used by the backup loop, replaced in main() once the templates are validated
+var notifier, _ = newNotifier(NotificationTemplates{}, nil)
+
+// Returns a notifier for each sink set up in the config
+func configuredNotifiers(config Config) ([]Notifier, error) {
+
+	var notifiers []Notifier
+	if config.DiscordWebhookURL != "" {
+		notifiers = append(notifiers, DiscordNotifier{webhookURL: config.DiscordWebhookURL})
+	}
+	if config.SlackWebhookURL != "" {
+		notifiers = append(notifiers, SlackNotifier{webhookURL: config.SlackWebhookURL})
+	}
+	if email := newEmailNotifier(config); email != nil {
+		notifiers = append(notifiers, email)
+	}
+	if config.WebhookURL != "" {
+		webhook, err := newWebhookNotifier(config)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, webhook)
+	}
+
+	return notifiers, nil
+}
+
+// Parses the templates, falling back to the defaults for empty ones
+// Each template is also rendered once with sample data so mistakes like unknown fields are caught at startup
+func newNotifier(templates NotificationTemplates, notifiers []Notifier) (*MultiNotifier, error) {
+
+	sample := NotificationData{
+		Instance:  "example",
+		Filename:  "world2024-01-01_00_00_00.tar.gz",
+		Size:      1024,
+		Duration:  time.Minute,
+		Result:    "success",
+		Error:     "example error",
+		Timestamp: time.Now(),
+	}
+
+	parse := func(name string, text string, fallback string) (*template.Template, error) {
+		if text == "" {
+			text = fallback
+		}
+
+		tmpl, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v notification template: %v", name, err)
+		}
+
+		err = tmpl.Execute(&strings.Builder{}, sample)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v notification template: %v", name, err)
+		}
+
+		return tmpl, nil
+	}
+
+	n := MultiNotifier{notifiers: notifiers}
+	var err error
+
+	n.success, err = parse("success", templates.Success, defaultNotificationTemplates.Success)
+	if err != nil {
+		return nil, err
+	}
+	n.failure, err = parse("failure", templates.Failure, defaultNotificationTemplates.Failure)
+	if err != nil {
+		return nil, err
+	}
+	n.deletion, err = parse("deletion", templates.Deletion, defaultNotificationTemplates.Deletion)
+	if err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+func (n *MultiNotifier) NotifySuccess(data NotificationData) {
+	data.Result = resultSuccess
+	n.notify(n.success, data)
+}
+
+func (n *MultiNotifier) NotifyFailure(data NotificationData) {
+	data.Result = resultFailure
+	n.notify(n.failure, data)
+}
+
+// Sends whatever the notifiers held back since the last call, such as one email for every failure of the pass
+func (n *MultiNotifier) Flush() {
+	for _, notifier := range n.notifiers {
+		flusher, ok := notifier.(flushingNotifier)
+		if !ok {
+			continue
+		}
+		// Flush errors already say what couldn't be sent
+		err := flusher.Flush()
+		if err != nil {
+			log.Printf("Warning: %v\n", err)
+		}
+	}
+}
+
+func (n *MultiNotifier) NotifyDeletion(data NotificationData) {
+	data.Result = resultDeletion
+	n.notify(n.deletion, data)
+}
+
+// Restore drills aren't backups, so they get their own message instead of the backup templates
+// A failed drill has data.Error set, and is sent as a failure so the notifiers style it like a failed backup
+func (n *MultiNotifier) NotifyRestoreDrill(data NotificationData, message string) {
+
+	fileName := data.Filename
+	if fileName == "" {
+		fileName = "the latest save"
+	}
+
+	data.Result = resultSuccess
+	outcome := "succeeded"
+	if data.Error != "" {
+		data.Result = resultFailure
+		outcome = "failed"
+	}
+
+	n.send(fmt.Sprintf("%v: Restore drill of %v %v: %v", data.Instance, fileName, outcome, message), data)
+}
+
+// Renders the template and sends the message
+func (n *MultiNotifier) notify(tmpl *template.Template, data NotificationData) {
+
+	var message strings.Builder
+	data.Timestamp = time.Now()
+
+	err := tmpl.Execute(&message, data)
+	if err != nil {
+		log.Printf("Could not render %v notification: %v\n", tmpl.Name(), err)
+		return
+	}
+
+	n.send(message.String(), data)
+}
+
+// Sends an already rendered message
+func (n *MultiNotifier) Send(message string) {
+	n.send(message, NotificationData{})
+}
+
+// Logs the message and posts it to each notifier, one after the other
+// A failed post is only logged, notifications must never stop the backup loop or keep the other notifiers from posting
+func (n *MultiNotifier) send(message string, data NotificationData) {
+
+	log.Println(message)
+	data.Timestamp = time.Now()
+
+	for _, notifier := range n.notifiers {
+		err := notifier.Notify(message, data)
+		if err != nil {
+			log.Printf("Warning: could not send %v notification: %v\n", notifier.Name(), err)
+		}
+	}
+}
+
+// Posts to a Discord webhook, results as a coloured embed and other messages as plain text
+type DiscordNotifier struct {
+	webhookURL string
+}
+
+// Colours of the Discord embeds for each kind of notification
+var discordColors = map[string]int{
+	resultSuccess:  0x2ecc71,
+	resultFailure:  0xe74c3c,
+	resultDeletion: 0x95a5a6,
+}
+
+func (d DiscordNotifier) Name() string {
+	return "Discord"
+}
+
+func (d DiscordNotifier) Notify(message string, data NotificationData) error {
+	if color, ok := discordColors[data.Result]; ok {
+		return postDiscordEmbed(d.webhookURL, message, color)
+	}
+	return notifyDiscord(d.webhookURL, message)
+}
+
+// Timeout for Discord webhook posts, so an unreachable Discord can't hold up a backup
+const discordTimeout = 10 * time.Second
+
+var discordClient = &http.Client{Timeout: discordTimeout}
+
+// Posts a plain message to a Discord webhook
+func notifyDiscord(webhookURL string, message string) error {
+	return postDiscord(webhookURL, map[string]any{"content": message})
+}
+
+// Posts the message to a Discord webhook as an embed with a coloured bar
+func postDiscordEmbed(webhookURL string, message string, color int) error {
+	return postDiscord(webhookURL, map[string]any{
+		"embeds": []map[string]any{{"description": message, "color": color}},
+	})
+}
+
+func postDiscord(webhookURL string, payload map[string]any) error {
+	return postWebhook(discordClient, webhookURL, payload)
+}
+
+// Posts the payload as JSON, treating any status other than 2xx as a failure
+func postWebhook(client *http.Client, webhookURL string, payload map[string]any) error {
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Returns the prefix player data backups are uploaded to, prefix/playerdata unless one is configured
+func playerDataPrefix(instance Instance) string {
+	if instance.playerDataPrefix != "" {
+		return instance.playerDataPrefix
+	}
+	return fmt.Sprintf("%v/playerdata", instance.prefix)
+}
+
+// Checks whether enough time has passed since the instance's last player data backup
+func playerDataBackupDue(db *sql.DB, instance Instance) (bool, error) {
+
+	var createdAt string
+
+	err := db.QueryRow("SELECT created_at FROM playerdata_saves WHERE instance_id = ? ORDER BY created_at DESC, id DESC LIMIT 1", instance.id).Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	lastSave, err := parseDBTime(createdAt)
+	if err != nil {
+		return false, err
+	}
+
+	return time.Since(lastSave) >= time.Duration(instance.playerDataIntervalMinutes)*time.Minute, nil
+}
+
+// Backs up just the player data directories of the world, which are small and change far more often than the rest of it
+func backupPlayerData(db *sql.DB, instance Instance) error {
+
+	startTime := time.Now()
+
+	// Player data only changes while someone is online
+	playerCount, _, err := getOnlinePlayers(instance)
+	if err != nil {
+		return fmt.Errorf("Could not get playerCount of players: %v", err)
+	}
+	if playerCount == 0 {
+		return nil
+	}
+
+	// Only archive the directories that exist, a world no one has earned an advancement in has no advancements directory
+	var tarSources []string
+	for _, path := range strings.Split(instance.playerDataPaths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if fileExists(filepath.Join(instance.workingPath, mainWorldDir(instance), path)) {
+			tarSources = append(tarSources, fmt.Sprintf("./%v/%v", mainWorldDir(instance), path))
+		}
+	}
+	if len(tarSources) == 0 {
+		return fmt.Errorf("none of the player data paths %v exist", instance.playerDataPaths)
+	}
+
+	err = quiesceInstance(context.Background(), instance)
+	if err != nil {
+		return err
+	}
+
+	paused := instance.pauseDuringBackup
+	defer func() {
+		if paused {
+			err := unpauseContainer(instance.containerName)
+			if err != nil {
+				log.Printf("%v: %v\n", instance.containerName, err)
+			}
+		}
+		err := resumeInstance(instance)
+		if err != nil {
+			log.Printf("%v: %v\n", instance.containerName, err)
+		}
+	}()
+
+	tarFileName := fmt.Sprintf("playerdata%v.tar.gz", getTime())
+	tarFilePath := filepath.Join(instance.workingPath, tarFileName)
+
+	output, err := runCommand("/bin/tar", append([]string{"-czf", tarFilePath, "-C", instance.workingPath}, tarSources...)...)
+	if err != nil {
+		_ = deleteFile(tarFilePath)
+		return fmt.Errorf("Could not compress player data: %v, error: %v", output, err)
+	}
+
+	defer func(tarFilePath string) {
+		err := deleteFile(tarFilePath)
+		if err != nil {
+			log.Printf("Could not delete tar file: %v\n", err)
+		}
+	}(tarFilePath)
+
+	if paused {
+		paused = false
+		err = unpauseContainer(instance.containerName)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = S3Backend{bucket: instance.s3Bucket, prefix: playerDataPrefix(instance), region: instance.region, storageClass: s3StorageClass}.Upload(tarFilePath, tarFileName)
+	if err != nil {
+		return fmt.Errorf("Could not backup to S3: %v", err)
+	}
+
+	tarFileStats, err := os.Stat(tarFilePath)
+	if err != nil {
+		return fmt.Errorf("Could not stat tar file: %v", err)
+	}
+
+	// Only started once the upload is done, the DB has a single connection and would be held for the whole backup
+	transaction, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %s", err)
+	}
+
+	// If the function errors out, call rollback.
+	// If everything is successful and tx is committed, rollback should have no effect
+	defer func(transaction *sql.Tx) {
+		_ = transaction.Rollback()
+	}(transaction)
+
+	_, err = transaction.Exec("INSERT INTO playerdata_saves (filename,size,prefix,instance_id) VALUES (?,?,?,?)",
+		tarFileName, tarFileStats.Size(), playerDataPrefix(instance), instance.id)
+	if err != nil {
+		return fmt.Errorf("Could not insert player data save record: %v", err)
+	}
+
+	err = commitUnlessDryRun(transaction, fmt.Sprintf("player data save %v of %v", tarFileName, instance.containerName))
+	if err != nil {
+		return fmt.Errorf("Could not commit transaction: %v", err)
+	}
+
+	log.Printf("%v: Backed up player data to %v (%d bytes) in %v\n", instance.containerName, tarFileName, tarFileStats.Size(), time.Since(startTime).Round(time.Second))
+
+	return nil
+}
+
+func removeOldPlayerDataSaves(db *sql.DB, instance Instance, saveRetention int) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	// If the function errors out, call rollback.
+	// If everything is successful and tx is committed, rollback should have no effect
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	// The saves are read through the transaction, the DB's only connection can't serve a query and a transaction at once
+	saveRecords, err := tx.Query("SELECT id,filename,prefix FROM playerdata_saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC", instance.id)
+	if err != nil {
+		return fmt.Errorf("Could not query DB: %v", err)
+	}
+
+	defer func(saveRecords *sql.Rows) {
+		err := saveRecords.Close()
+		if err != nil {
+			log.Printf("Error closing saves: %s", err)
+		}
+	}(saveRecords)
+
+	var fileName, prefix string
+	var id int
+	var failures []string // A save whose file couldn't be deleted stays recorded, so it is tried again next cycle
+	i := 0
+
+	for saveRecords.Next() {
+
+		err = saveRecords.Scan(&id, &fileName, &prefix)
+		if err != nil {
+			return fmt.Errorf("Error scanning row: %s", err)
+		}
+
+		// The newest saveRetention saves are kept
+		i++
+		if i <= saveRetention {
+			continue
+		}
+
+		err = deleteS3File(fileName, instance.s3Bucket, prefix, instance.region)
+		if err != nil {
+			log.Printf("%v: Could not delete player data save file %v: %v\n", instance.containerName, fileName, err)
+			failures = append(failures, fmt.Sprintf("%v: %v", fileName, err))
+			continue
+		}
+
+		_, err = tx.Exec("UPDATE playerdata_saves SET deleted = 1 WHERE id = ?", id)
+		if err != nil {
+			return fmt.Errorf("Could not update player data save record: %v", err)
+		}
+	}
+	if err = saveRecords.Err(); err != nil {
+		return fmt.Errorf("Error reading saves: %v", err)
+	}
+
+	err = commitUnlessDryRun(tx, fmt.Sprintf("old player data saves of %v as deleted", instance.containerName))
+	if err != nil {
+		return fmt.Errorf("Could not commit transaction: %v", err)
+	}
+
+	return pruneFailuresError(failures)
+}
+
+// Backs up the instance's player data if it is due, then prunes old player data saves
+func runPlayerDataBackup(db *sql.DB, instance Instance, saveRetention int) {
+
+	due, err := playerDataBackupDue(db, instance)
+	if err != nil {
+		log.Printf("%v: Could not check player data schedule: %v", instance.containerName, err)
+		return
+	}
+	if !due {
+		return
+	}
+
+	err = backupPlayerData(db, instance)
+	if err != nil {
+		notifier.NotifyFailure(NotificationData{Instance: instance.containerName, Error: fmt.Sprintf("player data backup: %v", err)})
+		return
+	}
+
+	err = removeOldPlayerDataSaves(db, instance, saveRetention)
+	if err != nil {
+		log.Printf("%v: Could not remove old player data saves: %v", instance.containerName, err)
+	}
+}
+
+// How often player data schedules are checked while waiting for the next cycle
+const playerDataCheckInterval = time.Minute
+
+// Sleeps until the next cycle, running player data backups as they come due in the meantime
+// Player data is usually backed up more often than the cycle, so it can't wait for the next one
+// Returns early once the context is cancelled
+func waitRunningPlayerDataBackups(ctx context.Context, db *sql.DB, wait time.Duration, saveRetention int) {
+
+	deadline := time.Now().Add(wait)
+
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+
+		instances, err := getInstances(db)
+		if err != nil {
+			log.Printf("Could not get instances: %s", err)
+		}
+
+		for _, instance := range instances {
+			if !instance.active || instance.playerDataIntervalMinutes <= 0 {
+				continue
+			}
+			if validateInstance(instance) != nil {
+				continue
+			}
+			runPlayerDataBackup(db, instance, saveRetention)
+		}
+
+		_ = sleepContext(ctx, min(playerDataCheckInterval, time.Until(deadline)))
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches the player count in the /list output of vanilla, Spigot/Paper, Forge and older servers, e.g.
+// "There are 2 of a max of 20 players online: ...", "There are 2 of a max 20 players online", "There are 2 out of maximum 20 players online.",
+// "There are 2/20 players online:" or, from servers and proxies that leave out the maximum, "There is 1 player online"
+var listCountPattern = regexp.MustCompile(`(?i)there (?:are|is) (\d+)(?:\s*(?:/|of a max(?:imum)?(?: of)?|out of (?:a )?max(?:imum)?)\s*\d+)?\s*players?`)
+
+// Matches Minecraft formatting codes, which some servers and plugins leave in the /list output
+var formattingCodePattern = regexp.MustCompile(`§[0-9a-fk-or]`)
+
+// Parses the output of /list into the number of players online and their names
+// The names come either after the colon on the count line or on the following lines, which Paper groups by rank ("default: Alice, Bob")
+func parsePlayerList(output string) (int32, []string, error) {
+
+	output = formattingCodePattern.ReplaceAllString(output, "")
+
+	match := listCountPattern.FindStringSubmatchIndex(output)
+	if match == nil {
+		return -1, nil, fmt.Errorf("could not find a player count in %q", output)
+	}
+
+	count, err := strconv.Atoi(output[match[2]:match[3]])
+	if err != nil {
+		return -1, nil, err
+	}
+
+	// Everything after "players online" on the count line, then any following lines
+	rest := output[match[1]:]
+	if index := strings.Index(rest, "online"); index != -1 {
+		rest = rest[index+len("online"):]
+	}
+
+	var players []string
+	for _, line := range strings.Split(rest, "\n") {
+
+		// Drop the group name, or the colon ending the count line
+		if index := strings.Index(line, ":"); index != -1 {
+			line = line[index+1:]
+		}
+
+		for _, name := range strings.Split(line, ",") {
+			// Ranks and tags such as "[Admin] Alice" come before the name, and names can't contain spaces
+			fields := strings.Fields(name)
+			if len(fields) == 0 {
+				continue
+			}
+			name = strings.Trim(fields[len(fields)-1], ".")
+			if name != "" {
+				players = append(players, name)
+			}
+		}
+	}
+
+	return int32(count), players, nil
+}
+
+// Returns the number of players online and their names
+// Names are only known from /list or Factorio's /players, instances with a player_count_cmd only get the count
+func getOnlinePlayers(instance Instance) (int32, []string, error) {
+
+	var count int32
+	var players []string
+	var err error
+
+	if instance.playerCountCmd != "" {
+		count, err = customPlayerCount(instance)
+	} else if instance.serverType == serverTypeFactorio {
+		count, players, err = factorioOnlinePlayers(instance)
+	} else {
+		var output string
+		output, err = runDockerCommand("/list", instance)
+		if err != nil {
+			return -1, nil, err
+		}
+		count, players, err = parsePlayerList(output)
+	}
+	if err != nil {
+		return count, nil, err
+	}
+
+	if instance.presenceNotifications {
+		presence.Observe(instance, count, players)
+	}
+
+	return count, players, nil
+}
+
+// Returns the first of the instance's watched players who is online, or an empty string if none are
+// Minecraft names are case insensitive, so they are compared that way
+func watchedPlayerOnline(instance Instance, players []string) string {
+
+	for _, watched := range strings.Split(instance.watchedPlayers, ",") {
+		watched = strings.TrimSpace(watched)
+		if watched == "" {
+			continue
+		}
+		for _, player := range players {
+			if strings.EqualFold(player, watched) {
+				return player
+			}
+		}
+	}
+
+	return ""
+}
+
+// Used when player_count_regex is empty, the first number in the output
+const defaultPlayerCountRegex = `(\d+)`
+
+// Compiles the instance's player count regex, which must capture the count in its first group
+func playerCountPattern(instance Instance) (*regexp.Regexp, error) {
+
+	expression := instance.playerCountRegex
+	if expression == "" {
+		expression = defaultPlayerCountRegex
+	}
+
+	pattern, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid player count regex: %v", err)
+	}
+	if pattern.NumSubexp() < 1 {
+		return nil, fmt.Errorf("player count regex needs a capture group for the count")
+	}
+
+	return pattern, nil
+}
+
+// Runs the instance's player_count_cmd and reads the count from its output with player_count_regex
+func customPlayerCount(instance Instance) (int32, error) {
+
+	pattern, err := playerCountPattern(instance)
+	if err != nil {
+		return -1, err
+	}
+
+	// The command is configured as a single line, so a shell parses it and arguments containing spaces can be quoted
+	output, err := runCommand("/bin/sh", "-c", instance.playerCountCmd)
+	if err != nil {
+		return -1, fmt.Errorf("player count command failed: %v, error: %v", output, err)
+	}
+
+	match := pattern.FindStringSubmatch(output)
+	if match == nil {
+		return -1, fmt.Errorf("player count regex did not match %q", output)
+	}
+
+	count, err := strconv.Atoi(match[1])
+	if err != nil {
+		return -1, fmt.Errorf("player count regex captured %q, which is not a number", match[1])
+	}
+
+	return int32(count), nil
+}
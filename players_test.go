@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePlayerList(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		output  string
+		count   int32
+		players []string
+	}{
+		{"vanilla", "There are 2 of a max of 20 players online: Alice, Bob", 2, []string{"Alice", "Bob"}},
+		{"vanilla empty", "There are 0 of a max of 20 players online: ", 0, nil},
+		{"vanilla before 1.13", "There are 1/20 players online:\nAlice", 1, []string{"Alice"}},
+		{"paper grouped by rank", "There are 3 out of maximum 50 players online.\nadmins: [Owner] Alice\ndefault: Bob, Carol", 3, []string{"Alice", "Bob", "Carol"}},
+		{"paper with formatting codes", "§6There are §c2§6 out of maximum §c20§6 players online.\n§6default§r: Alice, Bob", 2, []string{"Alice", "Bob"}},
+		{"forge", "There are 1 of a max 20 players online: Steve", 1, []string{"Steve"}},
+		{"proxy without a maximum", "There is 1 player online: Alex", 1, []string{"Alex"}},
+		{"trailing newline", "There are 1 of a max of 10 players online: Alice\n", 1, []string{"Alice"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count, players, err := parsePlayerList(test.output)
+			if err != nil {
+				t.Fatalf("parsePlayerList: %v", err)
+			}
+			if count != test.count {
+				t.Errorf("count: got %d, want %d", count, test.count)
+			}
+			if !reflect.DeepEqual(players, test.players) {
+				t.Errorf("players: got %q, want %q", players, test.players)
+			}
+		})
+	}
+}
+
+func TestParsePlayerListErrors(t *testing.T) {
+
+	for _, output := range []string{"", "Unknown command", "error: failed to connect to RCON"} {
+		if _, _, err := parsePlayerList(output); err == nil {
+			t.Errorf("expected an error for %q", output)
+		}
+	}
+}
+
+func TestPlayerCountPattern(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		regex   string
+		output  string
+		want    string
+		invalid bool
+	}{
+		{"default takes the first number", "", "online: 4 / 10", "4", false},
+		{"custom capture group", `players=(\d+)`, "max=10 players=3", "3", false},
+		{"no capture group", `\d+`, "", "", true},
+		{"doesn't compile", `(\d+`, "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pattern, err := playerCountPattern(Instance{playerCountRegex: test.regex})
+			if test.invalid {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("playerCountPattern: %v", err)
+			}
+			match := pattern.FindStringSubmatch(test.output)
+			if match == nil || match[1] != test.want {
+				t.Errorf("got %q, want %q", match, test.want)
+			}
+		})
+	}
+}
+
+// player_count_cmd goes through a shell, so quoted arguments with spaces reach the command whole
+func TestCustomPlayerCountQuoting(t *testing.T) {
+
+	instance := Instance{
+		playerCountCmd:   `printf '%s\n' 'There are 3 players online'`,
+		playerCountRegex: `There are (\d+) players`,
+	}
+
+	count, err := customPlayerCount(instance)
+	if err != nil {
+		t.Fatalf("customPlayerCount: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("got %d players, want 3", count)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// PresenceTracker remembers each instance's last player count to notify when a server becomes active or empty
+// Counts are observed whenever the players are checked, which the loop does every cycle for instances it didn't back up
+type PresenceTracker struct {
+	mu     sync.Mutex
+	counts map[int]int32
+}
+
+var presence = newPresenceTracker()
+
+func newPresenceTracker() *PresenceTracker {
+	return &PresenceTracker{counts: make(map[int]int32)}
+}
+
+// Records the instance's player count and notifies if the server went from empty to active or back
+// The first count seen for an instance is only remembered, it isn't known what it changed from
+func (p *PresenceTracker) Observe(instance Instance, count int32, players []string) {
+
+	p.mu.Lock()
+	previous, seen := p.counts[instance.id]
+	p.counts[instance.id] = count
+	p.mu.Unlock()
+
+	if !seen {
+		return
+	}
+
+	if previous == 0 && count > 0 {
+		message := fmt.Sprintf("%v: Players are online (%d)", instance.containerName, count)
+		if len(players) > 0 {
+			message = fmt.Sprintf("%v: Players are online: %v", instance.containerName, strings.Join(players, ", "))
+		}
+		notifier.Send(message)
+	} else if previous > 0 && count == 0 {
+		notifier.Send(fmt.Sprintf("%v: Server is now empty", instance.containerName))
+	}
+}
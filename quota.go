@@ -0,0 +1,42 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Returns an error if uploading the archives, named files in the instance's working path, would take the instance past its bucket quota
+// Usage is what the database says is stored in the instance's bucket, S3 itself has no way to report a quota
+func checkBucketQuota(db *sql.DB, instance Instance, archives []string) error {
+
+	var stored, playerData int64
+
+	// Saves that failed over to another bucket don't count against this one, and deduped saves share an object that is already counted
+	err := db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM saves WHERE deleted = 0 AND deduped = 0 AND s3_bucket = '' AND instance_id = ?", instance.id).Scan(&stored)
+	if err != nil {
+		return fmt.Errorf("Could not query stored saves: %v", err)
+	}
+
+	err = db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM playerdata_saves WHERE deleted = 0 AND instance_id = ?", instance.id).Scan(&playerData)
+	if err != nil {
+		return fmt.Errorf("Could not query stored player data saves: %v", err)
+	}
+
+	var upload int64
+	for _, fileName := range archives {
+		fileStats, err := os.Stat(filepath.Join(instance.workingPath, fileName))
+		if err != nil {
+			return fmt.Errorf("Could not stat tar file: %v", err)
+		}
+		upload = upload + fileStats.Size()
+	}
+
+	if stored+playerData+upload > instance.bucketQuotaBytes {
+		return fmt.Errorf("upload skipped, it would exceed the bucket quota: %v stored + %v new > %v quota",
+			formatBytes(stored+playerData), formatBytes(upload), formatBytes(instance.bucketQuotaBytes))
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Timeout for a whole RCON exchange, from connecting to reading the reply
+const rconTimeout = 10 * time.Second
+
+// Packet types of the Source RCON protocol, which Minecraft and Factorio both speak
+const rconTypeResponse = 0
+const rconTypeCommand = 2
+const rconTypeAuth = 3
+
+// Longest packet accepted from the server, Minecraft splits replies into bodies of at most 4096 bytes
+const rconMaxPacketSize = 4096 + 10
+
+// Runs a command on the instance's RCON port directly, for images without an rcon client inside
+// and servers that don't run in a container at all
+// Each command gets its own connection, commands are far enough apart that keeping one open isn't worth it
+func runRconTCPCommand(instance Instance, command string) (string, error) {
+
+	address := net.JoinHostPort(instance.rconHost, strconv.Itoa(instance.rconPort))
+
+	conn, err := net.DialTimeout("tcp", address, rconTimeout)
+	if err != nil {
+		return "", fmt.Errorf("Could not connect to RCON at %v: %v", address, err)
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	err = conn.SetDeadline(time.Now().Add(rconTimeout))
+	if err != nil {
+		return "", err
+	}
+
+	// A failed login is answered with the id -1 instead of the request's
+	err = writeRconPacket(conn, 1, rconTypeAuth, instance.rconPassword)
+	if err != nil {
+		return "", fmt.Errorf("Could not send RCON login: %v", err)
+	}
+	id, _, err := readRconPacket(conn)
+	if err != nil {
+		return "", fmt.Errorf("Could not read RCON login reply: %v", err)
+	}
+	if id != 1 {
+		return "", fmt.Errorf("RCON login to %v failed, check rcon_password", address)
+	}
+
+	err = writeRconPacket(conn, 2, rconTypeCommand, command)
+	if err != nil {
+		return "", fmt.Errorf("Could not send RCON command: %v", err)
+	}
+	id, body, err := readRconPacket(conn)
+	if err != nil {
+		return "", fmt.Errorf("Could not read RCON reply: %v", err)
+	}
+	if id != 2 {
+		return "", fmt.Errorf("unexpected RCON reply id %d", id)
+	}
+
+	// Only the first part of a reply split over several packets is read, the commands sent here all have short replies
+	return body, nil
+}
+
+// Writes a packet: its length, id and type as little endian int32s, then the body and two null bytes
+func writeRconPacket(w io.Writer, id int32, packetType int32, body string) error {
+
+	var packet bytes.Buffer
+	_ = binary.Write(&packet, binary.LittleEndian, int32(4+4+len(body)+2))
+	_ = binary.Write(&packet, binary.LittleEndian, id)
+	_ = binary.Write(&packet, binary.LittleEndian, packetType)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+
+	_, err := w.Write(packet.Bytes())
+	return err
+}
+
+// Reads a packet and returns its id and body
+func readRconPacket(r io.Reader) (int32, string, error) {
+
+	var size int32
+	err := binary.Read(r, binary.LittleEndian, &size)
+	if err != nil {
+		return 0, "", err
+	}
+	if size < 10 || size > rconMaxPacketSize {
+		return 0, "", fmt.Errorf("invalid RCON packet size %d", size)
+	}
+
+	packet := make([]byte, size)
+	_, err = io.ReadFull(r, packet)
+	if err != nil {
+		return 0, "", err
+	}
+
+	id := int32(binary.LittleEndian.Uint32(packet[0:4]))
+	body := packet[8 : size-2]
+
+	return id, string(body), nil
+}
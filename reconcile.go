@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A save whose size in the DB doesn't match its object in S3
+type sizeMismatch struct {
+	id       int
+	fileName string
+	bucket   string
+	region   string
+	prefix   string
+	dbSize   int64
+	s3Size   int64
+	missing  bool // The object no longer exists in S3
+}
+
+// Compares the size recorded for each save against the size of its object in S3
+func reconcileSizesCommand(db *sql.DB, args []string) error {
+
+	flags := flag.NewFlagSet("reconcile-sizes", flag.ContinueOnError)
+	instanceName := flags.String("instance", "", "Container name of the instance to check")
+	verify := flags.Bool("verify", false, "Download and verify each mismatched save")
+	deleteMismatched := flags.Bool("delete", false, "Delete mismatched saves from S3 and mark them deleted")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *instanceName == "" {
+		return fmt.Errorf("--instance is required")
+	}
+
+	err = checkAWSCLI()
+	if err != nil {
+		return err
+	}
+
+	instance, err := getInstanceByName(db, *instanceName)
+	if err != nil {
+		return err
+	}
+
+	if instance.backend != backendS3 {
+		return fmt.Errorf("%v uses the %v backend, sizes can only be reconciled against S3", instance.containerName, instance.backend)
+	}
+
+	mismatches, checked, err := findSizeMismatches(db, instance)
+	if err != nil {
+		return err
+	}
+
+	for _, mismatch := range mismatches {
+		if mismatch.missing {
+			fmt.Printf("MISMATCH save %d (%v): %d bytes in DB, object missing from S3\n", mismatch.id, mismatch.fileName, mismatch.dbSize)
+		} else {
+			fmt.Printf("MISMATCH save %d (%v): %d bytes in DB, %d bytes in S3\n", mismatch.id, mismatch.fileName, mismatch.dbSize, mismatch.s3Size)
+		}
+
+		if *verify {
+			err = verifySave(db, instance, mismatch.id, false)
+			if err != nil {
+				log.Printf("Could not verify save %d: %v", mismatch.id, err)
+			}
+		}
+
+		if *deleteMismatched {
+			err = deleteMismatchedSave(db, instance, mismatch)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Deleted save %d\n", mismatch.id)
+		}
+	}
+
+	fmt.Printf("%v: checked %d saves, found %d mismatches\n", instance.containerName, checked, len(mismatches))
+
+	if len(mismatches) > 0 && !*deleteMismatched {
+		return fmt.Errorf("found %d size mismatches", len(mismatches))
+	}
+
+	return nil
+}
+
+// Returns the saves whose S3 object size differs from the DB, and how many saves were checked
+func findSizeMismatches(db *sql.DB, instance Instance) ([]sizeMismatch, int, error) {
+
+	saveRecords, err := db.Query("SELECT id,filename,size,s3_bucket,region,prefix FROM saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC", instance.id)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not query DB: %v", err)
+	}
+
+	defer func(saveRecords *sql.Rows) {
+		err := saveRecords.Close()
+		if err != nil {
+			log.Printf("Error closing saves: %s", err)
+		}
+	}(saveRecords)
+
+	var mismatches []sizeMismatch
+	checked := 0
+
+	for saveRecords.Next() {
+
+		var save sizeMismatch
+		err = saveRecords.Scan(&save.id, &save.fileName, &save.dbSize, &save.bucket, &save.region, &save.prefix)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Error scanning row: %s", err)
+		}
+		checked = checked + 1
+
+		save.s3Size, err = s3FileSize(save.fileName, saveBucket(instance, save.bucket), savePrefix(instance, save.prefix), saveRegion(instance, save.bucket, save.region))
+		if err != nil {
+			// Anything other than a missing object means S3 couldn't be checked at all
+			if !strings.Contains(err.Error(), "Not Found") {
+				return nil, 0, err
+			}
+			save.missing = true
+		}
+
+		if save.missing || save.s3Size != save.dbSize {
+			mismatches = append(mismatches, save)
+		}
+	}
+
+	return mismatches, checked, nil
+}
+
+// Removes a mismatched save's object, if there still is one, and marks the save deleted
+func deleteMismatchedSave(db *sql.DB, instance Instance, mismatch sizeMismatch) error {
+
+	if !mismatch.missing {
+		err := deleteS3File(mismatch.fileName, saveBucket(instance, mismatch.bucket), savePrefix(instance, mismatch.prefix), mismatch.region)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec("UPDATE saves SET deleted = 1 WHERE id = ?", mismatch.id)
+	if err != nil {
+		return fmt.Errorf("Could not update save record: %v", err)
+	}
+
+	return nil
+}
+
+// An object under an instance's bucket and prefix that no stored save refers to
+type orphanedObject struct {
+	bucket string
+	prefix string
+	region string
+	s3Object
+}
+
+// Lists the objects in each instance's bucket and prefix that no stored save refers to, usually left by a backup that
+// failed between the upload and recording the save, and deletes them with --delete
+func reconcileCommand(db *sql.DB, args []string) error {
+
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	instanceName := flags.String("instance", "", "Container name of the instance to check, every active S3 instance if empty")
+	deleteOrphans := flags.Bool("delete", false, "Delete the orphaned objects from S3")
+	yes := flags.Bool("yes", false, "Delete without asking for confirmation")
+	minAge := flags.Duration("min-age", 24*time.Hour, "Ignore objects newer than this, a backup may not have recorded them yet")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = checkAWSCLI()
+	if err != nil {
+		return err
+	}
+
+	var instances []Instance
+	if *instanceName != "" {
+		instance, err := getInstanceByName(db, *instanceName)
+		if err != nil {
+			return err
+		}
+		if instance.backend != backendS3 {
+			return fmt.Errorf("%v uses the %v backend, only S3 can be reconciled", instance.containerName, instance.backend)
+		}
+		instances = append(instances, instance)
+	} else {
+		all, err := getInstances(db)
+		if err != nil {
+			return err
+		}
+		for _, instance := range all {
+			if instance.active && instance.backend == backendS3 {
+				instances = append(instances, instance)
+			}
+		}
+	}
+
+	var orphans []orphanedObject
+	var orphanedBytes int64
+	for _, instance := range instances {
+		found, err := findOrphanedObjects(db, instance, *minAge)
+		if err != nil {
+			return fmt.Errorf("%v: %v", instance.containerName, err)
+		}
+		for _, orphan := range found {
+			fmt.Printf("ORPHAN %v: s3://%v/%v/%v (%v, %v)\n", instance.containerName, orphan.bucket, orphan.prefix, orphan.name, formatBytes(orphan.size), orphan.modified.Format(time.DateTime))
+			orphanedBytes = orphanedBytes + orphan.size
+		}
+		orphans = append(orphans, found...)
+	}
+
+	fmt.Printf("Checked %d instances, found %d orphaned objects taking %v\n", len(instances), len(orphans), formatBytes(orphanedBytes))
+
+	if !*deleteOrphans || len(orphans) == 0 {
+		return nil
+	}
+
+	if !*yes && !dryRun {
+		fmt.Printf("Delete %d objects (%v) from S3? This can't be undone [y/N] ", len(orphans), formatBytes(orphanedBytes))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			return fmt.Errorf("nothing was deleted")
+		}
+	}
+
+	var reclaimed int64
+	var failures []string
+	for _, orphan := range orphans {
+		err = deleteS3File(orphan.name, orphan.bucket, orphan.prefix, orphan.region)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", orphan.name, err))
+			continue
+		}
+		reclaimed = reclaimed + orphan.size
+	}
+
+	if dryRun {
+		fmt.Printf("[DRY RUN] would reclaim %v\n", formatBytes(reclaimed))
+	} else {
+		fmt.Printf("Deleted %d objects, reclaimed %v\n", len(orphans)-len(failures), formatBytes(reclaimed))
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("could not delete %d objects: %v", len(failures), strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// Returns the objects where the instance's saves are stored, its bucket and prefix and any other its saves record,
+// that no save which hasn't been deleted refers to
+// Only objects directly under each prefix with the "world" names backups use are considered, so player data,
+// dictionaries and anything else sharing the bucket are left alone
+func findOrphanedObjects(db *sql.DB, instance Instance, minAge time.Duration) ([]orphanedObject, error) {
+
+	saveRecords, err := db.Query("SELECT filename,s3_bucket,region,prefix,deleted FROM saves WHERE instance_id = ?", instance.id)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query DB: %v", err)
+	}
+
+	defer func(saveRecords *sql.Rows) {
+		err := saveRecords.Close()
+		if err != nil {
+			log.Printf("Error closing saves: %s", err)
+		}
+	}(saveRecords)
+
+	// Keyed by bucket and prefix, with the region to reach them in
+	locations := map[[2]string]string{{instance.s3Bucket, instance.prefix}: instance.region}
+	tracked := make(map[[3]string]bool)
+
+	for saveRecords.Next() {
+
+		var fileName, bucket, region, prefix string
+		var deleted bool
+		err = saveRecords.Scan(&fileName, &bucket, &region, &prefix, &deleted)
+		if err != nil {
+			return nil, fmt.Errorf("Error scanning row: %s", err)
+		}
+
+		// Deleted saves still count as a location, a failed delete leaves their object behind
+		bucket, prefix = saveBucket(instance, bucket), savePrefix(instance, prefix)
+		locations[[2]string{bucket, prefix}] = saveRegion(instance, bucket, region)
+		if !deleted {
+			tracked[[3]string{bucket, prefix, fileName}] = true
+		}
+	}
+	err = saveRecords.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read saves: %v", err)
+	}
+
+	var orphans []orphanedObject
+	for location, region := range locations {
+
+		objects, err := listS3Objects(location[0], location[1], "world", region)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range objects {
+			if tracked[[3]string{location[0], location[1], object.name}] || time.Since(object.modified) < minAge {
+				continue
+			}
+			orphans = append(orphans, orphanedObject{bucket: location[0], prefix: location[1], region: region, s3Object: object})
+		}
+	}
+
+	slices.SortFunc(orphans, func(a, b orphanedObject) int {
+		return strings.Compare(a.bucket+"/"+a.prefix+"/"+a.name, b.bucket+"/"+b.prefix+"/"+b.name)
+	})
+
+	return orphans, nil
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const restoreDrillStartTimeout = 10 * time.Minute // How long the throwaway server gets to finish starting
+const restoreDrillPollInterval = 5 * time.Second  // How often the throwaway server's logs are checked
+const containerStopPollInterval = time.Second     // How often a stopping container's state is checked
+
+// Returns the newest save that hasn't been deleted
+func latestSave(db *sql.DB, instance Instance) (Save, error) {
+
+	var save Save
+
+	err := db.QueryRow("SELECT id, filename, dictionary_id, s3_bucket, region, prefix, parent_id, deleted, encryption, save_type FROM saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC, id DESC LIMIT 1", instance.id).Scan(&save.id, &save.fileName, &save.dictionaryID, &save.bucket, &save.region, &save.prefix, &save.parentID, &save.deleted, &save.encryption, &save.saveType)
+	if err == sql.ErrNoRows {
+		return save, fmt.Errorf("no saves found for %v", instance.containerName)
+	}
+	if err != nil {
+		return save, fmt.Errorf("could not query latest save: %v", err)
+	}
+
+	return save, nil
+}
+
+// Returns the instance's save with the given ID, whether or not it has been deleted
+func getSave(db *sql.DB, instance Instance, saveID int) (Save, error) {
+
+	var save Save
+
+	err := db.QueryRow("SELECT id, filename, dictionary_id, s3_bucket, region, prefix, parent_id, deleted, encryption, save_type FROM saves WHERE id = ? AND instance_id = ?", saveID, instance.id).Scan(&save.id, &save.fileName, &save.dictionaryID, &save.bucket, &save.region, &save.prefix, &save.parentID, &save.deleted, &save.encryption, &save.saveType)
+	if err == sql.ErrNoRows {
+		return save, fmt.Errorf("save %d does not belong to %v", saveID, instance.containerName)
+	}
+	if err != nil {
+		return save, fmt.Errorf("could not query save: %v", err)
+	}
+
+	return save, nil
+}
+
+// Checks whether enough time has passed since the instance's last restore drill
+func restoreDrillDue(db *sql.DB, instance Instance) (bool, error) {
+
+	var createdAt string
+
+	err := db.QueryRow("SELECT created_at FROM restore_drills WHERE instance_id = ? ORDER BY id DESC LIMIT 1", instance.id).Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	lastDrill, err := parseDBTime(createdAt)
+	if err != nil {
+		return false, err
+	}
+
+	return time.Since(lastDrill) >= time.Duration(instance.restoreDrillIntervalHours)*time.Hour, nil
+}
+
+// Downloads the latest save, boots it in a throwaway container and records whether the server started
+func runRestoreDrill(db *sql.DB, instance Instance) {
+
+	log.Printf("%v: Running restore drill...\n", instance.containerName)
+
+	fileName, err := restoreDrill(db, instance)
+
+	data := NotificationData{Instance: instance.containerName, Filename: fileName}
+	message := "Server started from the latest save"
+	if err != nil {
+		message = err.Error()
+		data.Error = message
+	}
+	notifier.NotifyRestoreDrill(data, message)
+
+	_, err = db.Exec("INSERT INTO restore_drills (filename,success,message,instance_id) VALUES (?,?,?,?)", fileName, err == nil, message, instance.id)
+	if err != nil {
+		log.Printf("%v: Could not record restore drill: %v\n", instance.containerName, err)
+	}
+}
+
+func restoreDrill(db *sql.DB, instance Instance) (string, error) {
+
+	save, err := latestSave(db, instance)
+	if err != nil {
+		return "", err
+	}
+	fileName := save.fileName
+
+	// Extract next to the live worlds rather than in /tmp, which is often too small for a world
+	drillDir, err := os.MkdirTemp(instance.workingPath, "restore-drill-")
+	if err != nil {
+		return fileName, fmt.Errorf("could not create restore drill directory: %v", err)
+	}
+	defer func(drillDir string) {
+		err := os.RemoveAll(drillDir)
+		if err != nil {
+			log.Printf("%v: Could not remove restore drill directory: %v\n", instance.containerName, err)
+		}
+	}(drillDir)
+
+	err = fetchSave(db, instance, save, drillDir)
+	if err != nil {
+		return fileName, err
+	}
+
+	containerName := fmt.Sprintf("%v-restore-drill", instance.containerName)
+
+	// Clear out anything left behind by an earlier drill that didn't clean up
+	_, _ = runCommand(containerBinary, "rm", "-f", containerName)
+
+	_, err = runCommand(containerBinary, "run", "-d", "--name", containerName, "-v", drillDir+":/data",
+		"-e", "EULA=TRUE", "-e", "LEVEL="+mainWorldDir(instance), instance.restoreDrillImage)
+	if err != nil {
+		return fileName, fmt.Errorf("could not start restore drill container: %v", err)
+	}
+
+	// Always tear the throwaway container down, even if it never started
+	defer func(containerName string) {
+		_, err := runCommand(containerBinary, "rm", "-f", containerName)
+		if err != nil {
+			log.Printf("%v: Could not remove restore drill container: %v\n", instance.containerName, err)
+		}
+	}(containerName)
+
+	err = waitForServerStart(containerName, restoreDrillStartTimeout)
+	if err != nil {
+		return fileName, err
+	}
+
+	return fileName, nil
+}
+
+// Downloads the save and extracts it into destination, which must be empty
+func fetchSave(db *sql.DB, instance Instance, save Save, destination string) error {
+
+	// A delta or incremental save is restored by extracting the full save it builds on and then every save up to it
+	chain, err := saveChain(db, instance, save)
+	if err != nil {
+		return err
+	}
+
+	for _, link := range chain {
+
+		dictionaryPath, err := saveDictionaryPath(db, instance, link.dictionaryID)
+		if err != nil {
+			return err
+		}
+
+		archivePath, err := downloadSave(instance, link, destination)
+		if err != nil {
+			return err
+		}
+
+		if link.saveType == saveTypeIncremental {
+			err = extractListedIncremental(archivePath, dictionaryPath, destination)
+		} else {
+			err = extractArchive(archivePath, dictionaryPath, destination)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = deleteFile(archivePath)
+		if err != nil {
+			return fmt.Errorf("could not delete downloaded save: %v", err)
+		}
+	}
+
+	if len(chain) > 1 {
+		return removeDeletedFiles(db, save.id, destination, worldDirs(instance))
+	}
+
+	return nil
+}
+
+// Downloads the save's archive into dir and returns the path of the archive to read,
+// which for an encrypted save is the decrypted copy, the encrypted download is removed once it is decrypted
+func downloadSave(instance Instance, save Save, dir string) (string, error) {
+
+	archivePath := filepath.Join(dir, save.fileName)
+
+	err := instanceStorage(instance, save.bucket, save.prefix, save.region, "").Download(save.fileName, archivePath)
+	if err != nil {
+		return "", err
+	}
+
+	if save.encryption == "" {
+		return archivePath, nil
+	}
+	if save.encryption != encryptionAES256GCM {
+		return "", fmt.Errorf("save %v is encrypted with unknown algorithm %v", save.fileName, save.encryption)
+	}
+
+	decryptedPath := strings.TrimSuffix(archivePath, encryptedExtension)
+	err = decryptFile(archivePath, decryptedPath, encryptionKey)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt %v: %v", save.fileName, err)
+	}
+
+	err = deleteFile(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("could not delete encrypted download: %v", err)
+	}
+
+	return decryptedPath, nil
+}
+
+// Polls the container's logs until the server reports it is done starting
+func waitForServerStart(containerName string, timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+
+		output, err := runCommand(containerBinary, "logs", containerName)
+		if err != nil {
+			return fmt.Errorf("could not read restore drill logs: %v", err)
+		}
+
+		// Vanilla and most forks log "Done (12.345s)! For help, type "help"" once the world is loaded
+		if strings.Contains(output, "Done (") {
+			return nil
+		}
+
+		running, err := runCommand(containerBinary, "inspect", "-f", "{{.State.Running}}", containerName)
+		if err != nil {
+			return fmt.Errorf("could not inspect restore drill container: %v", err)
+		}
+		if strings.TrimSpace(running) != "true" {
+			return fmt.Errorf("restore drill server exited before it finished starting")
+		}
+
+		time.Sleep(restoreDrillPollInterval)
+	}
+
+	return fmt.Errorf("restore drill server did not finish starting within %v", timeout)
+}
+
+// Asks the container to shut down and waits until docker reports it has exited
+// The server only writes the last of the world while shutting down, so a container that is still "running" must not have its world touched.
+// It is never killed outright, if it doesn't stop within the timeout the caller has to give up instead
+func stopContainerAndWait(containerName string, timeout time.Duration) error {
+
+	// SIGTERM is what docker stop sends first, but docker stop would follow it with SIGKILL once its own timeout ran out
+	_, err := runCommand(containerBinary, "kill", "--signal", "SIGTERM", containerName)
+	if err != nil && !strings.Contains(err.Error(), "is not running") {
+		return fmt.Errorf("could not stop %v: %v", containerName, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+
+		status, err := runCommand(containerBinary, "inspect", "-f", "{{.State.Status}}", containerName)
+		if err != nil {
+			return fmt.Errorf("could not inspect %v: %v", containerName, err)
+		}
+
+		status = strings.TrimSpace(status)
+		if status == "exited" || status == "created" || status == "dead" {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%v did not stop within %v (state %v), not touching the world while it may still be writing", containerName, timeout, status)
+		}
+
+		time.Sleep(containerStopPollInterval)
+	}
+}
+
+// Replaces the instance's world with the save, stopping the server for as short a time as possible
+// The save is downloaded and extracted before the server is stopped, and the world is only swapped once it has fully exited
+// Each world directory it replaces is kept as <dir>.bak next to it, replacing the one left by the previous restore
+func restoreInstance(db *sql.DB, instance Instance, saveID int) error {
+
+	save, err := getSave(db, instance, saveID)
+	if err != nil {
+		return err
+	}
+	if save.deleted {
+		return fmt.Errorf("save %d has been deleted by retention and is no longer in S3", saveID)
+	}
+
+	// Extract on the same filesystem as the world, so swapping it in is a rename rather than a copy
+	restoreDir, err := os.MkdirTemp(instance.workingPath, "restore-")
+	if err != nil {
+		return fmt.Errorf("could not create restore directory: %v", err)
+	}
+	defer func(restoreDir string) {
+		err := os.RemoveAll(restoreDir)
+		if err != nil {
+			log.Printf("%v: Could not remove restore directory: %v\n", instance.containerName, err)
+		}
+	}(restoreDir)
+
+	err = fetchSave(db, instance, save, restoreDir)
+	if err != nil {
+		return err
+	}
+
+	// A save taken before a directory was added to dir_name doesn't have it, and the live one is left as it is
+	var restoredDirs []string
+	for _, dir := range worldDirs(instance) {
+		if fileExists(filepath.Join(restoreDir, dir)) {
+			restoredDirs = append(restoredDirs, dir)
+		} else if dir == mainWorldDir(instance) {
+			return fmt.Errorf("save %d has no %v directory", save.id, dir)
+		} else {
+			log.Printf("%v: Save %d has no %v directory, leaving the current one in place\n", instance.containerName, save.id, dir)
+		}
+	}
+
+	err = stopContainerAndWait(instance.containerName, time.Duration(instance.stopTimeoutSeconds)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range restoredDirs {
+
+		worldPath := filepath.Join(instance.workingPath, dir)
+		backupPath := worldPath + ".bak"
+
+		// After a host loss there may be no world at all
+		if fileExists(worldPath) {
+			err = os.RemoveAll(backupPath)
+			if err != nil {
+				return fmt.Errorf("could not remove the previous %v: %v", backupPath, err)
+			}
+			err = os.Rename(worldPath, backupPath)
+			if err != nil {
+				return fmt.Errorf("could not move the current world to %v: %v", backupPath, err)
+			}
+			log.Printf("%v: Kept the replaced world as %v\n", instance.containerName, backupPath)
+		}
+
+		err = os.Rename(filepath.Join(restoreDir, dir), worldPath)
+		if err != nil {
+			return fmt.Errorf("could not move the restored world into place, the previous world is in %v: %v", backupPath, err)
+		}
+	}
+
+	output, err := runCommand(containerBinary, "start", instance.containerName)
+	if err != nil {
+		return fmt.Errorf("restored the world but could not start %v: %v, error: %v", instance.containerName, output, err)
+	}
+
+	return nil
+}
+
+// Restores a save of one instance, or the latest save of every active instance at once with --all
+func restoreCommand(db *sql.DB, args []string) error {
+
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	instanceName := flags.String("instance", "", "Container name of the instance to restore")
+	saveID := flags.Int("save", 0, "ID of the save to restore, defaults to the newest save")
+	all := flags.Bool("all", false, "Restore every active instance")
+	workers := flags.Int("workers", 2, "How many instances to restore at the same time with --all")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if (*instanceName == "") == !*all {
+		return fmt.Errorf("either --instance or --all is required")
+	}
+	if *workers < 1 {
+		return fmt.Errorf("--workers must be at least 1")
+	}
+	if *saveID != 0 && *all {
+		return fmt.Errorf("--save can only be used with --instance")
+	}
+
+	err = checkAWSCLI()
+	if err != nil {
+		return err
+	}
+
+	var instances []Instance
+	if *all {
+		allInstances, err := getInstances(db)
+		if err != nil {
+			return err
+		}
+		for _, instance := range allInstances {
+			if instance.active {
+				instances = append(instances, instance)
+			}
+		}
+	} else {
+		instance, err := getInstanceByName(db, *instanceName)
+		if err != nil {
+			return err
+		}
+		instances = append(instances, instance)
+	}
+
+	// Each restore stops and starts its own container, so they only compete for bandwidth and disk
+	results := make([]error, len(instances))
+	slots := make(chan struct{}, *workers)
+	var wg sync.WaitGroup
+
+	for i, instance := range instances {
+		wg.Add(1)
+		go func(i int, instance Instance) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			id := *saveID
+			var err error
+			if id == 0 {
+				var save Save
+				save, err = latestSave(db, instance)
+				id = save.id
+			}
+			if err == nil {
+				log.Printf("%v: Restoring save %d...\n", instance.containerName, id)
+				err = restoreInstance(db, instance, id)
+			}
+			if err != nil {
+				log.Printf("%v: Restore failed: %v\n", instance.containerName, err)
+			} else {
+				log.Printf("%v: Restored save %d\n", instance.containerName, id)
+			}
+			results[i] = err
+		}(i, instance)
+	}
+
+	wg.Wait()
+
+	failed := 0
+	fmt.Printf("\nRestore summary:\n")
+	for i, instance := range instances {
+		if results[i] != nil {
+			failed = failed + 1
+			fmt.Printf("FAIL %v: %v\n", instance.containerName, results[i])
+		} else {
+			fmt.Printf("OK   %v\n", instance.containerName)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d restores failed", failed, len(instances))
+	}
+
+	return nil
+}
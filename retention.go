@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Values accepted in the instances' retention_mode column, which decide how the count and age limits combine
+const retentionModeEither = "either" // A save is kept while either limit keeps it, so it goes once it is past both
+const retentionModeBoth = "both"     // A save is kept only while both limits keep it, so it goes once it is past either
+
+// Which saves to hold on to, limits left at 0 don't apply
+type retentionPolicy struct {
+	keepCount  int           // Keep at most this many saves
+	keepAge    time.Duration // Keep saves younger than this
+	maxBytes   int64         // Keep the newest saves that fit in this many bytes
+	keepEither bool          // Keep a save that is within keepCount or keepAge, rather than only one within both
+}
+
+// The parts of a save that retention decides on
+type retainedSave struct {
+	id        int
+	fileName  string
+	size      int64
+	createdAt time.Time
+	parentID  int // Save this one is a delta of, 0 for a full save
+}
+
+// Splits saves, which must be ordered newest first, into the ones the policy keeps and the ones it prunes
+// The saves a kept delta depends on are always kept, even past the policy's limits
+func pruneSaves(saves []retainedSave, policy retentionPolicy, now time.Time) ([]retainedSave, []retainedSave) {
+
+	var kept, pruned []retainedSave
+	var keptBytes int64
+	keptObjects := make(map[string]bool)
+
+	for _, save := range saves {
+
+		// Deduped saves share an object, which only takes up storage once
+		size := save.size
+		if keptObjects[save.fileName] {
+			size = 0
+		}
+
+		withinCount := policy.keepCount <= 0 || len(kept) < policy.keepCount
+		withinAge := policy.keepAge <= 0 || now.Sub(save.createdAt) < policy.keepAge
+
+		// With only one of the two limits set, the unset one would keep everything, so either only applies when both are
+		withinLimits := withinCount && withinAge
+		if policy.keepEither && policy.keepCount > 0 && policy.keepAge > 0 {
+			withinLimits = withinCount || withinAge
+		}
+
+		keep := withinLimits && (policy.maxBytes <= 0 || keptBytes+size <= policy.maxBytes)
+
+		if keep {
+			kept = append(kept, save)
+			keptBytes = keptBytes + size
+			keptObjects[save.fileName] = true
+		} else {
+			pruned = append(pruned, save)
+		}
+	}
+
+	if len(pruned) == 0 {
+		return kept, pruned
+	}
+
+	// A delta can only be restored on top of the saves it was taken against, so they are kept for as long as it is
+	parents := make(map[int]int)
+	for _, save := range saves {
+		parents[save.id] = save.parentID
+	}
+
+	needed := make(map[int]bool)
+	for _, save := range kept {
+		for id := save.id; id != 0 && !needed[id]; id = parents[id] {
+			needed[id] = true
+		}
+	}
+
+	kept, pruned = nil, nil
+	for _, save := range saves {
+		if needed[save.id] {
+			kept = append(kept, save)
+		} else {
+			pruned = append(pruned, save)
+		}
+	}
+
+	return kept, pruned
+}
+
+// Returns the instance's saves that haven't been deleted, newest first
+func getRetainedSaves(db *sql.DB, instance Instance) ([]retainedSave, error) {
+
+	saveRecords, err := db.Query("SELECT id,filename,size,created_at,COALESCE(parent_id,0) FROM saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC, id DESC", instance.id)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query DB: %v", err)
+	}
+
+	defer func(saveRecords *sql.Rows) {
+		err := saveRecords.Close()
+		if err != nil {
+			log.Printf("Error closing saves: %s", err)
+		}
+	}(saveRecords)
+
+	var saves []retainedSave
+	var createdAt string
+
+	for saveRecords.Next() {
+
+		var save retainedSave
+		err = saveRecords.Scan(&save.id, &save.fileName, &save.size, &createdAt, &save.parentID)
+		if err != nil {
+			return nil, fmt.Errorf("Error scanning row: %s", err)
+		}
+
+		save.createdAt, err = parseDBTime(createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		saves = append(saves, save)
+	}
+
+	return saves, saveRecords.Err()
+}
+
+// Combines the errors of the save files that couldn't be deleted while pruning, nil if they all were
+func pruneFailuresError(failures []string) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Could not delete %d save files, they will be retried next cycle: %v", len(failures), strings.Join(failures, "; "))
+}
+
+// Adds up the storage the saves take, counting objects shared by deduped saves once
+func storedBytes(saves []retainedSave) int64 {
+	var total int64
+	objects := make(map[string]bool)
+	for _, save := range saves {
+		if !objects[save.fileName] {
+			objects[save.fileName] = true
+			total = total + save.size
+		}
+	}
+	return total
+}
+
+// Shows which of an instance's saves a hypothetical retention policy would keep and prune, without deleting anything
+func simulateRetentionCommand(db *sql.DB, args []string) error {
+
+	flags := flag.NewFlagSet("simulate-retention", flag.ContinueOnError)
+	instanceName := flags.String("instance", "", "Container name of the instance to simulate retention for")
+	keepCount := flags.Int("keep-count", 0, "Keep at most this many saves, 0 for no limit")
+	keepDays := flags.Int("keep-days", 0, "Keep saves younger than this many days, 0 for no limit")
+	maxBytes := flags.Int64("max-bytes", 0, "Keep the newest saves that fit in this many bytes, 0 for no limit")
+	mode := flags.String("mode", retentionModeEither, "How --keep-count and --keep-days combine: either keeps saves within one of them, both only those within both")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *instanceName == "" {
+		return fmt.Errorf("--instance is required")
+	}
+	if *keepCount < 0 || *keepDays < 0 || *maxBytes < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	if *mode != retentionModeEither && *mode != retentionModeBoth {
+		return fmt.Errorf("invalid mode %v, expected %v or %v", *mode, retentionModeEither, retentionModeBoth)
+	}
+
+	instance, err := getInstanceByName(db, *instanceName)
+	if err != nil {
+		return err
+	}
+
+	saves, err := getRetainedSaves(db, instance)
+	if err != nil {
+		return err
+	}
+	if len(saves) == 0 {
+		return fmt.Errorf("no saves found for %v", instance.containerName)
+	}
+
+	policy := retentionPolicy{
+		keepCount:  *keepCount,
+		keepAge:    time.Duration(*keepDays) * 24 * time.Hour,
+		maxBytes:   *maxBytes,
+		keepEither: *mode == retentionModeEither,
+	}
+	now := time.Now()
+
+	kept, pruned := pruneSaves(saves, policy, now)
+
+	prunedIDs := make(map[int]bool)
+	for _, save := range pruned {
+		prunedIDs[save.id] = true
+	}
+
+	for _, save := range saves {
+		action := "KEEP "
+		if prunedIDs[save.id] {
+			action = "PRUNE"
+		}
+		fmt.Printf("%v %d\t%v\t%v\t%v\n", action, save.id, save.createdAt.Format(dbTimeLayout), formatBytes(save.size), save.fileName)
+	}
+
+	fmt.Printf("\nBefore: %d saves, %v\n", len(saves), formatBytes(storedBytes(saves)))
+	fmt.Printf("After:  %d saves, %v (%d pruned, %v freed)\n", len(kept), formatBytes(storedBytes(kept)),
+		len(pruned), formatBytes(storedBytes(saves)-storedBytes(kept)))
+
+	// Replay the policy at the end of each day the saves cover, to show how storage would have grown under it
+	fmt.Printf("\nFootprint over time:\n")
+	oldest := saves[len(saves)-1].createdAt
+	for day := oldest.Truncate(24 * time.Hour).Add(24 * time.Hour); ; day = day.Add(24 * time.Hour) {
+
+		at := day
+		if at.After(now) {
+			at = now
+		}
+
+		var existing []retainedSave
+		for _, save := range saves {
+			if !save.createdAt.After(at) {
+				existing = append(existing, save)
+			}
+		}
+
+		// Each row is the end of a day, apart from the last one which is now
+		label := at.Add(-time.Nanosecond).Format("2006-01-02")
+		if at.Equal(now) {
+			label = "now"
+		}
+
+		keptThen, _ := pruneSaves(existing, policy, at)
+		fmt.Printf("%v\t%d saves\t%v\n", label, len(keptThen), formatBytes(storedBytes(keptThen)))
+
+		if at.Equal(now) {
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// All S3 access goes through the AWS CLI, and the functions that call it are kept in this file
+
+// checkAWSCLI checks if the AWS CLI is installed and configured
+func checkAWSCLI() error {
+
+	// Check if AWS CLI is installed
+	if !fileExists("/usr/bin/aws") {
+		return fmt.Errorf("AWS CLI is not installed or not found in /usr/bin")
+	}
+	return nil
+}
+
+// Storage class saves are uploaded with, set in main() from the config
+var s3StorageClass = S3_STORAGE_CLASS
+
+// Storage class options
+var storageClasses = map[string]bool{
+	"STANDARD":            true,
+	"INTELLIGENT_TIERING": true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"GLACIER":             true,
+	"DEEP_ARCHIVE":        true,
+	"REDUCED_REDUNDANCY":  true,
+}
+
+// How many times an upload is attempted before it fails, and the wait before the first retry
+// Set in main() from the config
+var s3UploadAttempts = S3_UPLOAD_ATTEMPTS
+var s3UploadBackoff = S3_UPLOAD_BACKOFF_SECONDS * time.Second
+
+// Uploads the local file to the S3 path
+// An empty region uses the AWS CLI's default region, as do the other S3 functions
+// Failed uploads are retried with a doubling backoff, so a network blip or throttling doesn't cost the whole backup
+func uploadToS3(localPath string, s3Path string, region string, storageClass string) error {
+
+	if dryRun {
+		log.Printf("[DRY RUN] would upload %v to %v\n", localPath, s3Path)
+		return nil
+	}
+
+	backoff := s3UploadBackoff
+
+	for attempt := 1; ; attempt++ {
+		var err error
+		if uploadLimiter == nil {
+			_, err = runCommand("aws", append([]string{"s3", "cp", localPath, s3Path, "--storage-class", storageClass, "--checksum-algorithm", "SHA256"}, regionArgs(region)...)...)
+		} else {
+			err = uploadLimited(localPath, s3Path, region, storageClass)
+		}
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= s3UploadAttempts {
+			return err
+		}
+
+		log.Printf("Upload of %v failed, retrying in %v (attempt %d/%d): %v", localPath, backoff, attempt+1, s3UploadAttempts, strings.TrimSpace(err.Error()))
+		time.Sleep(backoff)
+		backoff = backoff * 2
+	}
+}
+
+// Uploads the file through stdin so it is read at the pace uploadLimiter allows
+// The size is passed on because the AWS CLI can't tell how big a stream is, and picks its multipart part size from it
+func uploadLimited(localPath string, s3Path string, region string, storageClass string) error {
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("aws", append([]string{"s3", "cp", "-", s3Path, "--storage-class", storageClass, "--checksum-algorithm", "SHA256",
+		"--expected-size", strconv.FormatInt(info.Size(), 10)}, regionArgs(region)...)...)
+
+	var output bytes.Buffer
+	cmd.Stdin = uploadLimiter.Reader(file)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err = cmd.Run()
+	if err != nil {
+		return newCommandError(output.Bytes(), err)
+	}
+
+	return nil
+}
+
+// Returns the storage class the instance's saves are uploaded with
+func instanceStorageClass(instance Instance) string {
+	if instance.storageClass == "" {
+		return s3StorageClass
+	}
+	return instance.storageClass
+}
+
+// Whether saves are tarred straight into the upload instead of to a local file first, set in main() from the config
+var streamUpload = false
+
+// Reports whether the instance's saves can be streamed
+// Converting to more formats, hashing the name and checking the quota all need the finished archive on disk,
+// and a failover or copies to other destinations need it to upload again, so those instances keep writing the archive locally
+func canStreamUpload(instance Instance) bool {
+	if dryRun {
+		return false
+	}
+	formats, _ := parseCompressionFormats(instance.compressionFormats)
+	return instance.backend == backendS3 && len(formats) <= 1 && !instance.hashInFilename && instance.bucketQuotaBytes == 0 && instance.failoverBucket == "" && !instance.encrypt && len(instance.destinations) == 0
+}
+
+// Uploads whatever write produces to the S3 path without it touching the local disk, and returns its size, its SHA-256
+// and the ChecksumSHA256 S3 should report for it, worked out from the CLI's default part size as the data goes by
+// If write fails the upload is killed before it completes, so no partial object is left under the key
+// Streamed uploads can't be retried, the caller has to produce the data again
+func streamToS3(write func(io.Writer) error, s3Path string, region string, storageClass string) (int64, string, string, error) {
+
+	cmd := exec.Command("aws", append([]string{"s3", "cp", "-", s3Path, "--storage-class", storageClass, "--checksum-algorithm", "SHA256"}, regionArgs(region)...)...)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return 0, "", "", newCommandError(nil, err)
+	}
+
+	checksum := newS3Checksum(s3MultipartChunkSize)
+
+	err = write(io.MultiWriter(uploadLimiter.Writer(stdin), checksum))
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return 0, "", "", err
+	}
+
+	err = stdin.Close()
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return 0, "", "", err
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		return 0, "", "", newCommandError(output.Bytes(), err)
+	}
+
+	return checksum.size, checksum.SHA256(), checksum.Expected(), nil
+}
+
+// Moves an already uploaded file to a different storage class by copying it onto itself
+func transitionS3File(fileName string, bucket string, prefix string, region string, storageClass string) error {
+
+	s3Path := fmt.Sprintf("s3://%v/%v/%v", bucket, prefix, fileName)
+
+	if dryRun {
+		log.Printf("[DRY RUN] would transition %v to %v\n", s3Path, storageClass)
+		return nil
+	}
+
+	_, err := runCommand("aws", append([]string{"s3", "cp", s3Path, s3Path, "--storage-class", storageClass}, regionArgs(region)...)...)
+	if err != nil {
+		return fmt.Errorf("could not transition save file to %v: %v", storageClass, err)
+	}
+
+	return nil
+}
+
+// Downloads the file from the S3 bucket to the destination path
+func downloadFromS3(fileName string, bucket string, prefix string, region string, destination string) error {
+
+	s3Path := fmt.Sprintf("s3://%v/%v/%v", bucket, prefix, fileName)
+
+	_, err := runCommand("aws", append([]string{"s3", "cp", s3Path, destination}, regionArgs(region)...)...)
+	if err != nil {
+		return fmt.Errorf("could not download save file from S3: %v", err)
+	}
+
+	return nil
+}
+
+// Returns the size in bytes of the file in the S3 bucket
+func s3FileSize(fileName string, bucket string, prefix string, region string) (int64, error) {
+
+	output, err := runCommand("aws", append([]string{"s3api", "head-object", "--bucket", bucket, "--key", prefix + "/" + fileName, "--query", "ContentLength", "--output", "text"}, regionArgs(region)...)...)
+	if err != nil {
+		return 0, fmt.Errorf("could not get size of save file in S3: %v", err)
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected size for save file in S3: %v", output)
+	}
+
+	return size, nil
+}
+
+func deleteS3File(fileName string, bucket string, prefix string, region string) error {
+
+	s3Path := fmt.Sprintf("s3://%v/%v/%v", bucket, prefix, fileName)
+
+	if dryRun {
+		log.Printf("[DRY RUN] would delete %v\n", s3Path)
+		return nil
+	}
+
+	_, err := runCommand("aws", append([]string{"s3", "rm", s3Path}, regionArgs(region)...)...)
+	if err != nil {
+		return fmt.Errorf("could not delete save file in S3: %v", err)
+	}
+
+	return nil
+}
+
+// Returns the names of the files directly under the prefix in the S3 bucket that start with namePrefix
+func listS3Files(bucket string, prefix string, namePrefix string, region string) ([]string, error) {
+
+	objects, err := listS3Objects(bucket, prefix, namePrefix, region)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(objects))
+	for _, object := range objects {
+		names = append(names, object.name)
+	}
+
+	return names, nil
+}
+
+// An object directly under a prefix, as listed by the AWS CLI
+type s3Object struct {
+	name     string
+	size     int64
+	modified time.Time
+}
+
+// Lists the objects directly under the prefix whose names start with namePrefix, objects under sub-prefixes aren't included
+func listS3Objects(bucket string, prefix string, namePrefix string, region string) ([]s3Object, error) {
+
+	output, err := runCommand("aws", append([]string{"s3", "ls", fmt.Sprintf("s3://%v/%v/%v", bucket, prefix, namePrefix)}, regionArgs(region)...)...)
+	if err != nil {
+		// The AWS CLI exits with 1 and prints nothing when no keys match
+		if commandExitCode(err) == 1 && strings.TrimSpace(err.Error()) == "" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not list save files in S3: %v", err)
+	}
+
+	// Objects are listed as "date time size name" in local time, sub-prefixes as "PRE name/"
+	var objects []s3Object
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] == "PRE" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected S3 listing line: %q", line)
+		}
+		modified, err := time.ParseInLocation("2006-01-02 15:04:05", fields[0]+" "+fields[1], time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected S3 listing line: %q", line)
+		}
+		objects = append(objects, s3Object{name: fields[3], size: size, modified: modified})
+	}
+
+	return objects, nil
+}
+
+// Returns the bucket a save was uploaded to, saves that failed over record their bucket and the rest are in the instance's
+func saveBucket(instance Instance, bucket string) string {
+	if bucket == "" {
+		return instance.s3Bucket
+	}
+	return bucket
+}
+
+// Returns the key prefix a save was uploaded under, saves from before prefixes were recorded are under the instance's
+func savePrefix(instance Instance, prefix string) string {
+	if prefix == "" {
+		return instance.prefix
+	}
+	return prefix
+}
+
+// Returns the region to reach a save in, saves in the instance's bucket that didn't record one are in the instance's region
+func saveRegion(instance Instance, bucket string, region string) string {
+	if region == "" && saveBucket(instance, bucket) == instance.s3Bucket {
+		return instance.region
+	}
+	return region
+}
+
+// Returns the --region arguments for the AWS CLI, or none to use the default region
+func regionArgs(region string) []string {
+	if region == "" {
+		return nil
+	}
+	return []string{"--region", region}
+}
+
+// Messages the AWS CLI prints when a region can't be reached or is failing, rather than rejecting the request
+var regionalFailureMessages = []string{
+	"Could not connect to the endpoint URL",
+	"Connect timeout on endpoint URL",
+	"Read timeout on endpoint URL",
+	"ServiceUnavailable",
+	"InternalError",
+	"(503)",
+	"(500)",
+}
+
+// Reports whether an S3 error looks like a region-level outage, as opposed to e.g. bad credentials or a missing bucket
+func isRegionalFailure(err error) bool {
+	for _, message := range regionalFailureMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the SHA-256 checksum S3 stored for the file, empty if it was uploaded without one
+// Unlike the ETag, it is the same whatever server-side encryption the bucket uses
+func s3ChecksumSHA256(fileName string, bucket string, prefix string, region string) (string, error) {
+
+	output, err := runCommand("aws", append([]string{"s3api", "head-object", "--bucket", bucket, "--key", prefix + "/" + fileName, "--checksum-mode", "ENABLED", "--query", "ChecksumSHA256", "--output", "text"}, regionArgs(region)...)...)
+	if err != nil {
+		return "", fmt.Errorf("could not get checksum of save file in S3: %v", err)
+	}
+
+	checksum := strings.TrimSpace(output)
+	if checksum == "None" {
+		return "", nil
+	}
+
+	return checksum, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Handles "saves <action>", currently only "saves list [instance]"
+func savesCommand(db *sql.DB, args []string) error {
+
+	if len(args) == 0 || args[0] != "list" {
+		return fmt.Errorf("usage: saves list [instance] [--limit <n>] [--deleted]")
+	}
+
+	flags := flag.NewFlagSet("saves list", flag.ContinueOnError)
+	instanceName := flags.String("instance", "", "Container name of the instance to list saves for, every instance if empty")
+	limit := flags.Int("limit", 20, "Number of saves to list, newest first")
+	deleted := flags.Bool("deleted", false, "Include saves deleted by retention")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	// The instance can also be given on its own, e.g. "saves list survival --limit 5"
+	if flags.NArg() > 0 {
+		if *instanceName != "" {
+			return fmt.Errorf("give the instance either with --instance or on its own, not both")
+		}
+		*instanceName = flags.Arg(0)
+		err = flags.Parse(flags.Args()[1:])
+		if err != nil {
+			return err
+		}
+		if flags.NArg() > 0 {
+			return fmt.Errorf("unexpected argument %v", flags.Arg(0))
+		}
+	}
+
+	instanceID := 0
+	if *instanceName != "" {
+		instance, err := getInstanceByName(db, *instanceName)
+		if err != nil {
+			return err
+		}
+		instanceID = instance.id
+	}
+
+	return listSaves(db, instanceID, *limit, *deleted)
+}
+
+// Prints the saves of the instance, or of every instance for ID 0, as a table with who was online when each was taken
+func listSaves(db *sql.DB, instanceID int, limit int, includeDeleted bool) error {
+
+	saveRecords, err := db.Query(`SELECT saves.id,instances.container_name,saves.created_at,saves.size,saves.filename,saves.deleted,saves.players
+		FROM saves JOIN instances ON instances.id = saves.instance_id
+		WHERE (? OR saves.deleted = 0) AND (? = 0 OR saves.instance_id = ?)
+		ORDER BY saves.created_at DESC, saves.id DESC LIMIT ?`, includeDeleted, instanceID, instanceID, limit)
+	if err != nil {
+		return fmt.Errorf("Could not query DB: %v", err)
+	}
+
+	defer func(saveRecords *sql.Rows) {
+		err := saveRecords.Close()
+		if err != nil {
+			log.Printf("Error closing saves: %s", err)
+		}
+	}(saveRecords)
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tINSTANCE\tCREATED\tSIZE\tFILENAME\tDELETED\tPLAYERS")
+
+	var id int
+	var containerName, createdAt, fileName, players string
+	var size int64
+	var deleted bool
+
+	for saveRecords.Next() {
+
+		err = saveRecords.Scan(&id, &containerName, &createdAt, &size, &fileName, &deleted, &players)
+		if err != nil {
+			return fmt.Errorf("Error scanning row: %s", err)
+		}
+
+		// Saves taken without record_players have no names
+		if players == "" {
+			players = "-"
+		} else {
+			players = strings.ReplaceAll(players, ",", ", ")
+		}
+
+		deletedStatus := "no"
+		if deleted {
+			deletedStatus = "yes"
+		}
+
+		fmt.Fprintf(table, "%d\t%v\t%v\t%v\t%v\t%v\t%v\n", id, containerName, createdAt, formatBytes(size), fileName, deletedStatus, players)
+	}
+
+	err = saveRecords.Err()
+	if err != nil {
+		return err
+	}
+
+	return table.Flush()
+}
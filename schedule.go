@@ -0,0 +1,43 @@
+package main
+
+import "time"
+
+// How soon an instance whose backup was deferred for its max_load_average is checked again
+const loadRetryDelay = time.Minute
+
+// Returns how often the instance is backed up, the global interval unless the instance sets its own
+func backupInterval(instance Instance, defaultInterval time.Duration) time.Duration {
+	if instance.backupIntervalMinutes > 0 {
+		return time.Duration(instance.backupIntervalMinutes) * time.Minute
+	}
+	return defaultInterval
+}
+
+// Returns when the instance is next due after now, at the next time its cron expression matches or one interval later
+func nextBackupTime(instance Instance, now time.Time, defaultInterval time.Duration) time.Time {
+
+	if instance.cron != "" {
+		schedule, err := parseCronSchedule(instance.cron)
+		// An invalid expression is reported by validateInstance when the instance comes due on the interval
+		if err == nil {
+			return schedule.Next(now)
+		}
+	}
+
+	return now.Add(backupInterval(instance, defaultInterval))
+}
+
+// Returns how long the loop can sleep before the next instance is due, at most maxWait
+// Instances that have never run are due immediately
+func untilNextBackup(instances []Instance, nextRun map[int]time.Time, now time.Time, maxWait time.Duration) time.Duration {
+
+	wait := maxWait
+	for _, instance := range instances {
+		if !instance.active || instance.groupID != 0 {
+			continue
+		}
+		wait = min(wait, nextRun[instance.id].Sub(now))
+	}
+
+	return max(wait, 0)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Game servers accepted in the instances' server_type column
+const serverTypeMinecraft = "minecraft"
+const serverTypeFactorio = "factorio"
+
+// Keeps a game server's save files from changing while they are archived
+// The tar and upload are the same for every server, only getting the files into a consistent state differs
+type GameServer interface {
+	PreBackup(ctx context.Context, instance Instance) error // Saves the world and stops it being written to
+	PostBackup(instance Instance) error                     // Lets the server save again, called however the backup ends
+}
+
+// Returns the implementation for the instance's server_type
+func gameServer(instance Instance) GameServer {
+	if instance.serverType == serverTypeFactorio {
+		return FactorioServer{}
+	}
+	return MinecraftServer{}
+}
+
+// Saves with the instance's save_command and turns saving off until the backup is done
+type MinecraftServer struct{}
+
+func (MinecraftServer) PreBackup(ctx context.Context, instance Instance) error {
+
+	// Disable command output
+	// This is so there isn't a ton of output to the console all the time
+	output, err := runDockerCommand("/gamerule sendCommandFeedback false", instance)
+	if err != nil {
+		return fmt.Errorf("Could not disable command feedback: %v, error: %v", output, err)
+	}
+
+	return quiesceInstance(ctx, instance)
+}
+
+func (MinecraftServer) PostBackup(instance Instance) error {
+	return resumeInstance(instance)
+}
+
+// Factorio has no way to turn saving off, but it writes saves under a temporary name and renames them into place,
+// so after /server-save the zip is complete until the next autosave replaces it whole
+type FactorioServer struct{}
+
+func (FactorioServer) PreBackup(ctx context.Context, instance Instance) error {
+
+	_, err := runFactorioCommand("/server-save", instance)
+	if err != nil {
+		return fmt.Errorf("Could not save world: %v", err)
+	}
+
+	saveDelay := saveAllDelay
+	if instance.nfsMode {
+		saveDelay = max(saveDelay, nfsSaveAllDelay)
+	}
+
+	// Buffer time to let the save finish
+	err = sleepContext(ctx, saveDelay)
+	if err != nil {
+		return fmt.Errorf("Backup interrupted: %v", err)
+	}
+
+	if instance.pauseDuringBackup {
+		return pauseContainer(instance.containerName)
+	}
+
+	return nil
+}
+
+func (FactorioServer) PostBackup(instance Instance) error {
+	return nil
+}
+
+// Runs a command through the rcon client shipped in the factoriotools/factorio image
+func runFactorioCommand(command string, instance Instance) (string, error) {
+	return runRconCommand("rcon", command, instance)
+}
+
+// Matches the header of Factorio's "/players online" output, e.g. "Online players (2):"
+var factorioPlayersPattern = regexp.MustCompile(`Online players \((\d+)\):`)
+
+// Returns the number of players online on a Factorio server and their names
+func factorioOnlinePlayers(instance Instance) (int32, []string, error) {
+
+	output, err := runFactorioCommand("/players online", instance)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	match := factorioPlayersPattern.FindStringSubmatchIndex(output)
+	if match == nil {
+		return -1, nil, fmt.Errorf("could not find a player count in %q", output)
+	}
+
+	count, err := strconv.Atoi(output[match[2]:match[3]])
+	if err != nil {
+		return -1, nil, err
+	}
+
+	// Each player is on their own line after the header, e.g. "  Alice (online)"
+	var players []string
+	for _, line := range strings.Split(output[match[1]:], "\n") {
+		name := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(line), "(online)"))
+		if name != "" {
+			players = append(players, name)
+		}
+	}
+
+	return int32(count), players, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stores saves in a directory on a remote host over SFTP, through the OpenSSH sftp client like the AWS CLI is used for S3
+// The client runs in batch mode, so the key must not need a passphrase and the host must already be in known_hosts
+type SFTPBackend struct {
+	host    string
+	port    int
+	user    string
+	keyPath string // Empty uses the user's default SSH keys
+	dir     string // Remote directory, absolute or relative to the user's home
+}
+
+func (backend SFTPBackend) Upload(localPath string, remoteName string) error {
+
+	destination := path.Join(backend.dir, remoteName)
+
+	if dryRun {
+		log.Printf("[DRY RUN] would upload %v to %v:%v\n", localPath, backend.host, destination)
+		return nil
+	}
+
+	// sftp's mkdir makes a single level, and fails on levels that already exist, which "-" ignores
+	var batch []string
+	for dir := path.Dir(destination); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		batch = append(batch, "-mkdir "+sftpQuote(dir))
+	}
+	slices.Reverse(batch)
+
+	// Uploaded under a temporary name and renamed into place, like the local backend, so a dropped connection never leaves a truncated save under the real name
+	partial := destination + ".partial"
+	batch = append(batch,
+		fmt.Sprintf("put %v %v", sftpQuote(localPath), sftpQuote(partial)),
+		fmt.Sprintf("posix-rename %v %v", sftpQuote(partial), sftpQuote(destination)),
+	)
+
+	_, err := backend.run(batch)
+	if err != nil {
+		return fmt.Errorf("could not upload save file to %v: %v", backend.host, err)
+	}
+
+	return nil
+}
+
+func (backend SFTPBackend) Download(remoteName string, localPath string) error {
+
+	_, err := backend.run([]string{fmt.Sprintf("get %v %v", sftpQuote(path.Join(backend.dir, remoteName)), sftpQuote(localPath))})
+	if err != nil {
+		return fmt.Errorf("could not download save file from %v: %v", backend.host, err)
+	}
+
+	return nil
+}
+
+func (backend SFTPBackend) Delete(remoteName string) error {
+
+	target := path.Join(backend.dir, remoteName)
+
+	if dryRun {
+		log.Printf("[DRY RUN] would delete %v:%v\n", backend.host, target)
+		return nil
+	}
+
+	_, err := backend.run([]string{"rm " + sftpQuote(target)})
+	if err != nil {
+		return fmt.Errorf("could not delete save file on %v: %v", backend.host, err)
+	}
+
+	return nil
+}
+
+func (backend SFTPBackend) List(prefix string) ([]string, error) {
+
+	// A directory that doesn't exist yet holds no saves, "-" keeps that from failing the batch
+	output, err := backend.run([]string{"-ls -1 " + sftpQuote(backend.dir)})
+	if err != nil {
+		return nil, fmt.Errorf("could not list %v on %v: %v", backend.dir, backend.host, err)
+	}
+
+	var names []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		// Batch mode echoes each command after the prompt
+		if line == "" || strings.HasPrefix(line, "sftp>") {
+			continue
+		}
+		name := path.Base(line)
+		if strings.HasPrefix(name, prefix) && !strings.HasSuffix(name, ".partial") {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	return names, nil
+}
+
+// Runs the commands in one sftp session and returns what it printed
+// A connection that can't be made or drops is retried with the same attempts and backoff as an S3 upload
+func (backend SFTPBackend) run(batch []string) (string, error) {
+
+	args := []string{"-b", "-", "-P", strconv.Itoa(backend.port), "-o", "BatchMode=yes"}
+	if backend.keyPath != "" {
+		args = append(args, "-i", backend.keyPath)
+	}
+	args = append(args, fmt.Sprintf("%v@%v", backend.user, backend.host))
+
+	input := strings.Join(batch, "\n") + "\n"
+	backoff := s3UploadBackoff
+
+	for attempt := 1; ; attempt++ {
+
+		cmd := exec.Command("sftp", args...)
+		cmd.Stdin = strings.NewReader(input)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		err := cmd.Run()
+		if err == nil {
+			return stdout.String(), nil
+		}
+		err = newCommandError(stderr.Bytes(), err)
+
+		// sftp exits with 255 when it can't connect or loses the connection, and with 1 when a command in the batch fails
+		if commandExitCode(err) != 255 || attempt >= s3UploadAttempts {
+			return "", err
+		}
+
+		log.Printf("SFTP connection to %v failed, retrying in %v (attempt %d/%d): %v", backend.host, backoff, attempt+1, s3UploadAttempts, strings.TrimSpace(err.Error()))
+		time.Sleep(backoff)
+		backoff = backoff * 2
+	}
+}
+
+// Quotes an argument for an sftp batch file, which splits on whitespace and understands double quotes and backslashes
+func sftpQuote(argument string) string {
+	argument = strings.ReplaceAll(argument, `\`, `\\`)
+	argument = strings.ReplaceAll(argument, `"`, `\"`)
+	return `"` + argument + `"`
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Timeout for Slack webhook posts, so an unreachable Slack can't hold up a backup
+const slackTimeout = 10 * time.Second
+
+var slackClient = &http.Client{Timeout: slackTimeout}
+
+// Posts to a Slack incoming webhook, results as an attachment with a coloured bar and other messages as plain text
+type SlackNotifier struct {
+	webhookURL string
+}
+
+// Colours of the Slack attachments for each kind of notification, matching the Discord embeds
+var slackColors = map[string]string{
+	resultSuccess:  "#2ecc71",
+	resultFailure:  "#e74c3c",
+	resultDeletion: "#95a5a6",
+}
+
+func (s SlackNotifier) Name() string {
+	return "Slack"
+}
+
+func (s SlackNotifier) Notify(message string, data NotificationData) error {
+
+	color, ok := slackColors[data.Result]
+	if !ok {
+		return postWebhook(slackClient, s.webhookURL, map[string]any{"text": message})
+	}
+
+	// The text is repeated as the fallback shown in desktop and mobile notifications, which don't show attachments
+	return postWebhook(slackClient, s.webhookURL, map[string]any{
+		"attachments": []map[string]any{{"fallback": message, "text": message, "color": color}},
+	})
+}
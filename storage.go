@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Where an instance's saves are kept
+// Names are relative to the backend's prefix or directory, so the backup and retention code doesn't care which one it has
+type StorageBackend interface {
+	Upload(localPath string, remoteName string) error
+	Download(remoteName string, localPath string) error
+	Delete(remoteName string) error
+	List(prefix string) ([]string, error) // Returns the names that start with prefix
+}
+
+// Backends accepted in the instances' backend column
+const backendS3 = "s3"
+const backendLocal = "local"
+const backendSFTP = "sftp"
+
+// Stores saves in an S3 bucket under a key prefix through the AWS CLI
+type S3Backend struct {
+	bucket       string
+	prefix       string
+	region       string // Empty for the AWS CLI's default region
+	storageClass string // Storage class uploads are made with
+}
+
+func (backend S3Backend) Upload(localPath string, remoteName string) error {
+	return uploadToS3(localPath, fmt.Sprintf("s3://%v/%v/%v", backend.bucket, backend.prefix, remoteName), backend.region, backend.storageClass)
+}
+
+func (backend S3Backend) Download(remoteName string, localPath string) error {
+	return downloadFromS3(remoteName, backend.bucket, backend.prefix, backend.region, localPath)
+}
+
+func (backend S3Backend) Delete(remoteName string) error {
+	return deleteS3File(remoteName, backend.bucket, backend.prefix, backend.region)
+}
+
+func (backend S3Backend) List(prefix string) ([]string, error) {
+	return listS3Files(backend.bucket, backend.prefix, prefix, backend.region)
+}
+
+// Copies saves into a directory, e.g. a NAS mounted on the host
+type LocalBackend struct {
+	dir string
+}
+
+// Copies the file into the directory under a temporary name and renames it into place,
+// so a crash mid-copy never leaves a truncated save behind under the real name
+func (backend LocalBackend) Upload(localPath string, remoteName string) error {
+
+	destination := filepath.Join(backend.dir, remoteName)
+
+	if dryRun {
+		log.Printf("[DRY RUN] would upload %v to %v\n", localPath, destination)
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create backup directory: %v", err)
+	}
+
+	partial := destination + ".partial"
+	err = copyFile(localPath, partial)
+	if err != nil {
+		_ = os.Remove(partial)
+		return fmt.Errorf("could not copy save file to %v: %v", backend.dir, err)
+	}
+
+	err = os.Rename(partial, destination)
+	if err != nil {
+		_ = os.Remove(partial)
+		return fmt.Errorf("could not move save file into place: %v", err)
+	}
+
+	return nil
+}
+
+func (backend LocalBackend) Download(remoteName string, localPath string) error {
+
+	err := copyFile(filepath.Join(backend.dir, remoteName), localPath)
+	if err != nil {
+		return fmt.Errorf("could not copy save file from %v: %v", backend.dir, err)
+	}
+
+	return nil
+}
+
+func (backend LocalBackend) Delete(remoteName string) error {
+
+	if dryRun {
+		log.Printf("[DRY RUN] would delete %v\n", filepath.Join(backend.dir, remoteName))
+		return nil
+	}
+
+	err := os.Remove(filepath.Join(backend.dir, remoteName))
+	if err != nil {
+		return fmt.Errorf("could not delete save file in %v: %v", backend.dir, err)
+	}
+
+	return nil
+}
+
+func (backend LocalBackend) List(prefix string) ([]string, error) {
+
+	entries, err := os.ReadDir(backend.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list %v: %v", backend.dir, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), prefix) && !strings.HasSuffix(entry.Name(), ".partial") {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+
+	return names, nil
+}
+
+// Returns the backend holding saves under the given bucket, prefix and region
+// Saves record an empty bucket and prefix when they are in the instance's, see saveBucket and savePrefix
+// The local and SFTP backends ignore the bucket and region and keep each prefix in a directory of the same name
+func instanceStorage(instance Instance, bucket string, prefix string, region string, storageClass string) StorageBackend {
+
+	switch instance.backend {
+	case backendLocal:
+		return LocalBackend{dir: filepath.Join(instance.backendDir, savePrefix(instance, prefix))}
+	case backendSFTP:
+		return SFTPBackend{host: instance.sftpHost, port: instance.sftpPort, user: instance.sftpUser, keyPath: instance.sftpKeyPath,
+			dir: path.Join(instance.backendDir, savePrefix(instance, prefix))}
+	}
+
+	return S3Backend{bucket: saveBucket(instance, bucket), prefix: savePrefix(instance, prefix), region: saveRegion(instance, bucket, region), storageClass: storageClass}
+}
+
+// Copies the file and syncs the copy to disk
+func copyFile(source string, destination string) error {
+
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func(input *os.File) {
+		_ = input.Close()
+	}(input)
+
+	output, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(output, input)
+	if err == nil {
+		err = output.Sync()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the logs of instances with a backup_trigger are checked
+const backupTriggerPollInterval = 5 * time.Second
+
+// Watches the logs of instances with a backup_trigger and backs them up out of band when the text shows up,
+// e.g. an admin typing "!backup" in chat or a datapack logging a /trigger
+// Backups are added to backups so a shutdown waits for them, and never overlap one the loop or the API started
+func watchBackupTriggers(ctx context.Context, db *sql.DB, backups *sync.WaitGroup) {
+
+	checkedAt := make(map[int]time.Time)     // How far each instance's log has been read
+	lastTriggered := make(map[int]time.Time) // When each instance last started a triggered backup
+
+	for sleepContext(ctx, backupTriggerPollInterval) == nil {
+
+		instances, err := getInstances(db)
+		if err != nil {
+			log.Printf("Could not get instances to check for backup triggers: %v", err)
+			continue
+		}
+
+		for _, instance := range instances {
+
+			if !instance.active || instance.backupTrigger == "" {
+				delete(checkedAt, instance.id)
+				continue
+			}
+
+			// Only text logged after the trigger was set up counts, not whatever is already in the log
+			now := time.Now()
+			since, ok := checkedAt[instance.id]
+			if !ok {
+				checkedAt[instance.id] = now
+				continue
+			}
+
+			// A container that can't be read is left to the backup loop to report, it is checked again on the next poll
+			output, err := runCommand(containerBinary, "logs", "--since", fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()), instance.containerName)
+			if err != nil {
+				continue
+			}
+			checkedAt[instance.id] = now
+
+			if !containsBackupTrigger(output, instance.backupTrigger) {
+				continue
+			}
+
+			interval := time.Duration(instance.backupTriggerIntervalMinutes) * time.Minute
+			if last, ok := lastTriggered[instance.id]; ok && time.Since(last) < interval {
+				log.Printf("%v: Backup trigger seen, but the last triggered backup started less than %v ago\n", instance.containerName, interval)
+				_ = say(fmt.Sprintf("A backup was started less than %v ago, try again later", formatRemaining(interval)), instance)
+				continue
+			}
+
+			err = validateInstance(instance)
+			if err != nil {
+				log.Printf("%v: Backup trigger seen, but the instance configuration is invalid: %v\n", instance.containerName, err)
+				continue
+			}
+
+			// min_backup_gap_minutes applies to triggered backups like any other, there is no way to force one from the game
+			remaining, err := backupGapRemaining(db, instance)
+			if err != nil {
+				log.Printf("%v: Backup trigger seen, but the time since the last backup could not be checked: %v\n", instance.containerName, err)
+				continue
+			}
+			if remaining > 0 {
+				// Whole minutes read better in chat than a count of seconds, rounded up so the player isn't told to try too early
+				if remaining > time.Minute {
+					remaining = (remaining + time.Minute - 1).Truncate(time.Minute)
+				}
+				log.Printf("%v: Backup trigger seen, but the last backup was less than %d minutes ago\n", instance.containerName, instance.minBackupGapMinutes)
+				_ = say(fmt.Sprintf("The world was backed up recently, try again in %v", formatRemaining(remaining)), instance)
+				continue
+			}
+
+			lock := backupLocks.get(instance.id)
+			if !lock.TryLock() {
+				log.Printf("%v: Backup trigger seen, but a backup is already running\n", instance.containerName)
+				_ = say("A backup is already running", instance)
+				continue
+			}
+
+			lastTriggered[instance.id] = now
+			backups.Add(1)
+			go func(instance Instance, lock *sync.Mutex) {
+				defer backups.Done()
+				defer lock.Unlock()
+
+				log.Printf("%v: Backup triggered in game\n", instance.containerName)
+				_, _ = manualBackup(ctx, db, instance)
+			}(instance, lock)
+		}
+	}
+}
+
+// Reports whether a line of the log contains the trigger
+// Lines the server logs for RCON commands and /say are ignored, so the service's own messages can't set it off
+func containsBackupTrigger(output string, trigger string) bool {
+
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, "[Rcon") || strings.Contains(line, "[Server]") {
+			continue
+		}
+		if strings.Contains(line, trigger) {
+			return true
+		}
+	}
+
+	return false
+}
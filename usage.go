@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+)
+
+// Prints how many saves each instance has stored and how much space they take, and the total over every instance
+// Deduped saves point at another save's object, so they are counted as saves but their size isn't
+func usageCommand(db *sql.DB, args []string) error {
+
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	bytes := flags.Bool("bytes", false, "Print sizes in bytes instead of KiB, MiB and GiB")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT instances.container_name, COUNT(saves.id), COALESCE(SUM(CASE WHEN saves.deduped = 0 THEN saves.size END), 0)
+		FROM instances LEFT JOIN saves ON saves.instance_id = instances.id AND saves.deleted = 0
+		GROUP BY instances.id ORDER BY instances.container_name`)
+	if err != nil {
+		return fmt.Errorf("Could not query DB: %v", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Error closing rows: %s", err)
+		}
+	}(rows)
+
+	size := func(size int64) string {
+		if *bytes {
+			return fmt.Sprintf("%d", size)
+		}
+		return formatBytes(size)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "INSTANCE\tSAVES\tSIZE")
+
+	var totalSaves, totalBytes int64
+	for rows.Next() {
+
+		var containerName string
+		var saves, stored int64
+		err = rows.Scan(&containerName, &saves, &stored)
+		if err != nil {
+			return fmt.Errorf("Error scanning row: %s", err)
+		}
+
+		fmt.Fprintf(table, "%v\t%d\t%v\n", containerName, saves, size(stored))
+		totalSaves = totalSaves + saves
+		totalBytes = totalBytes + stored
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(table, "total\t%d\t%v\n", totalSaves, size(totalBytes))
+
+	return table.Flush()
+}
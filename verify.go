@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Name of the marker file appended to the end of archives
+const canaryFileName = ".mcbackuper-canary"
+
+// Writes a canary file with a random token into dir and returns its content
+func writeCanary(dir string) (string, error) {
+
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", fmt.Errorf("Could not generate canary: %v", err)
+	}
+
+	content := fmt.Sprintf("%v %v", time.Now().UTC().Format(time.RFC3339), hex.EncodeToString(token))
+
+	err = os.WriteFile(filepath.Join(dir, canaryFileName), []byte(content), 0644)
+	if err != nil {
+		return "", fmt.Errorf("Could not write canary file: %v", err)
+	}
+
+	return content, nil
+}
+
+// Downloads a save and checks that the archive is readable and complete
+func verifyCommand(db *sql.DB, args []string) error {
+
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	instanceName := flags.String("instance", "", "Container name of the instance to verify")
+	saveID := flags.Int("save", 0, "ID of the save to verify, defaults to the newest save")
+	deep := flags.Bool("deep", false, "Also extract the save and check that level.dat and a sample of region files are structurally valid")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *instanceName == "" {
+		return fmt.Errorf("--instance is required")
+	}
+
+	err = checkAWSCLI()
+	if err != nil {
+		return err
+	}
+
+	instance, err := getInstanceByName(db, *instanceName)
+	if err != nil {
+		return err
+	}
+
+	if *saveID == 0 {
+		err = db.QueryRow("SELECT id FROM saves WHERE deleted = 0 AND instance_id = ? ORDER BY created_at DESC, id DESC LIMIT 1", instance.id).Scan(saveID)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no saves found for %v", instance.containerName)
+		}
+		if err != nil {
+			return fmt.Errorf("could not query latest save: %v", err)
+		}
+	}
+
+	return verifySave(db, instance, *saveID, *deep)
+}
+
+// Downloads the save and checks its contents, printing the result of each check
+// deep extracts the world and parses level.dat and a sample of region files, which takes much longer
+func verifySave(db *sql.DB, instance Instance, saveID int, deep bool) error {
+
+	var fileName, canary, bucket, region, prefix, encryption string
+	var deleted bool
+	var dictionaryID sql.NullInt64
+
+	err := db.QueryRow("SELECT filename, canary, deleted, dictionary_id, s3_bucket, region, prefix, encryption FROM saves WHERE id = ? AND instance_id = ?", saveID, instance.id).Scan(&fileName, &canary, &deleted, &dictionaryID, &bucket, &region, &prefix, &encryption)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("save %d does not belong to %v", saveID, instance.containerName)
+	}
+	if err != nil {
+		return fmt.Errorf("could not query save: %v", err)
+	}
+	if deleted {
+		return fmt.Errorf("save %d has been deleted", saveID)
+	}
+
+	verifyDir, err := os.MkdirTemp(instance.workingPath, "verify-")
+	if err != nil {
+		return fmt.Errorf("could not create verify directory: %v", err)
+	}
+	defer func(verifyDir string) {
+		err := os.RemoveAll(verifyDir)
+		if err != nil {
+			log.Printf("Could not remove verify directory: %v\n", err)
+		}
+	}(verifyDir)
+
+	archivePath, err := downloadSave(instance, Save{fileName: fileName, bucket: bucket, region: region, prefix: prefix, encryption: encryption}, verifyDir)
+	if err != nil {
+		return err
+	}
+
+	dictionaryPath, err := saveDictionaryPath(db, instance, dictionaryID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Verifying save %d (%v)\n", saveID, fileName)
+
+	failed := false
+	check := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL %v: %v\n", name, err)
+		} else {
+			fmt.Printf("PASS %v\n", name)
+		}
+	}
+
+	// Listing reads the whole archive, so it also catches a corrupt or truncated compression stream
+	listing, err := listArchive(archivePath, dictionaryPath)
+	check("archive is readable", err)
+	if err != nil {
+		return fmt.Errorf("save %d failed verification", saveID)
+	}
+
+	entries := strings.Split(strings.TrimSpace(listing), "\n")
+
+	levelDat := fmt.Sprintf("./%v/level.dat", mainWorldDir(instance))
+	if slices.Contains(entries, levelDat) {
+		check("level.dat is present", nil)
+	} else {
+		check("level.dat is present", fmt.Errorf("%v not found in archive", levelDat))
+	}
+
+	if canary != "" {
+		check("canary is intact", verifyCanary(archivePath, dictionaryPath, entries, canary))
+	}
+
+	if deep {
+		deepVerify(archivePath, dictionaryPath, verifyDir, mainWorldDir(instance), entries, check)
+	}
+
+	if failed {
+		return fmt.Errorf("save %d failed verification", saveID)
+	}
+
+	return nil
+}
+
+// Checks that the canary is the last member of the archive and still holds the recorded content
+func verifyCanary(archivePath string, dictionaryPath string, entries []string, canary string) error {
+
+	canaryEntry := "./" + canaryFileName
+
+	if len(entries) == 0 || entries[len(entries)-1] != canaryEntry {
+		return fmt.Errorf("canary is not the last member of the archive, it may be truncated")
+	}
+
+	content, err := readArchiveMember(archivePath, dictionaryPath, canaryEntry)
+	if err != nil {
+		return fmt.Errorf("could not read canary: %v", err)
+	}
+	if content != canary {
+		return fmt.Errorf("canary content does not match the recorded value")
+	}
+
+	return nil
+}
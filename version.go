@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// The line vanilla, Spigot/Paper and Fabric servers log when they start
+var serverVersionPattern = regexp.MustCompile(`Starting minecraft server version (\S+)`)
+
+// Reads the Minecraft version the container's server last started with from its logs
+func detectServerVersion(container string) (string, error) {
+
+	output, err := runCommand(containerBinary, "logs", container)
+	if err != nil {
+		return "", fmt.Errorf("Could not read container logs: %v", err)
+	}
+
+	// The server may have been restarted into a newer version, so the last start wins
+	matches := serverVersionPattern.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no server version found in the container logs")
+	}
+
+	return matches[len(matches)-1][1], nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Timeout for generic webhook posts, so an unreachable service can't hold up a backup
+const webhookTimeout = 10 * time.Second
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Payload posted when webhook_template is empty
+const defaultWebhookTemplate = `{"instance": {{json .Instance}}, "result": {{json .Result}}, "filename": {{json .Filename}}, "size": {{.Size}}, ` +
+	`"duration_seconds": {{.Duration.Seconds}}, "timestamp": {{json .Timestamp}}, "error": {{json .Error}}, "message": {{json .Message}}}`
+
+// Posts every notification to a URL with a body rendered from a user's template, for services that expect their own JSON shape
+type WebhookNotifier struct {
+	url     string
+	payload *template.Template
+	headers map[string]string
+}
+
+// The fields webhook templates can use, the notification's and the message rendered for the chat notifiers
+type webhookData struct {
+	NotificationData
+	Message string
+}
+
+// Parses the payload template and headers from the config, and renders the template once so mistakes are caught at startup
+func newWebhookNotifier(config Config) (*WebhookNotifier, error) {
+
+	text := config.WebhookTemplate
+	if text == "" {
+		text = defaultWebhookTemplate
+	}
+
+	// json writes a value as JSON, quoting and escaping strings so names and errors can't break the payload
+	funcs := template.FuncMap{"json": func(value any) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	}}
+
+	payload, err := template.New("webhook").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook_template: %v", err)
+	}
+
+	err = payload.Execute(&strings.Builder{}, webhookData{
+		NotificationData: NotificationData{Instance: "example", Result: resultSuccess, Timestamp: time.Now()},
+		Message:          "example message",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook_template: %v", err)
+	}
+
+	headers, err := parseWebhookHeaders(config.WebhookHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook_headers: %v", err)
+	}
+
+	return &WebhookNotifier{url: config.WebhookURL, payload: payload, headers: headers}, nil
+}
+
+// Splits "Name: value; Name: value" into headers, ignoring empty entries
+func parseWebhookHeaders(list string) (map[string]string, error) {
+
+	headers := make(map[string]string)
+	for _, header := range strings.Split(list, ";") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		name, value, found := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("expected Name: value, got %q", strings.TrimSpace(header))
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+
+	return headers, nil
+}
+
+func (w *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (w *WebhookNotifier) Notify(message string, data NotificationData) error {
+
+	var body bytes.Buffer
+	err := w.payload.Execute(&body, webhookData{NotificationData: data, Message: message})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, w.url, &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range w.headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", response.Status)
+	}
+
+	return nil
+}
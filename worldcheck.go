@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// How many region files the deep verify reads, spread evenly across the world
+const regionSampleSize = 8
+
+// Region files are made of 4 KiB sectors, the first two hold the chunk locations and timestamps
+const regionSectorSize = 4096
+const regionHeaderSize = 2 * regionSectorSize
+
+// Chunk compression types, with regionExternalChunk set when the chunk is stored in a separate .mcc file
+const (
+	regionGzip          = 1
+	regionZlib          = 2
+	regionUncompressed  = 3
+	regionLZ4           = 4
+	regionCustom        = 127
+	regionExternalChunk = 128
+)
+
+// Checks that the extracted level.dat is gzipped NBT with the Data compound the server needs to load the world
+func checkLevelDat(path string) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("not gzip compressed: %v", err)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("could not decompress: %v", err)
+	}
+
+	names, err := parseNBT(data)
+	if err != nil {
+		return fmt.Errorf("invalid NBT: %v", err)
+	}
+	if !slices.Contains(names, "Data") {
+		return fmt.Errorf("no Data compound")
+	}
+
+	return nil
+}
+
+// Checks the region file's chunk table and that the first chunk it points to decompresses to valid NBT
+func checkRegionFile(path string) error {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// The server creates empty region files before it writes any chunks to them
+	if len(content) == 0 {
+		return nil
+	}
+	if len(content) < regionHeaderSize {
+		return fmt.Errorf("%d bytes is shorter than the %d byte header", len(content), regionHeaderSize)
+	}
+
+	sectors := (len(content) + regionSectorSize - 1) / regionSectorSize
+	checkedChunk := false
+
+	for i := 0; i < 1024; i++ {
+
+		location := binary.BigEndian.Uint32(content[i*4:])
+		offset := int(location >> 8)
+		count := int(location & 0xff)
+		if location == 0 {
+			continue
+		}
+
+		if offset < 2 || count == 0 || offset+count > sectors {
+			return fmt.Errorf("chunk %d points at sectors %d-%d, outside the %d sector file", i, offset, offset+count, sectors)
+		}
+
+		start := offset * regionSectorSize
+		if start+5 > len(content) {
+			return fmt.Errorf("chunk %d header is past the end of the file", i)
+		}
+
+		length := int(binary.BigEndian.Uint32(content[start:]))
+		compression := content[start+4]
+
+		if compression&regionExternalChunk != 0 {
+			continue
+		}
+		if length < 1 || start+4+length > len(content) || length+4 > count*regionSectorSize {
+			return fmt.Errorf("chunk %d has length %d, which doesn't fit its %d sectors", i, length, count)
+		}
+
+		// One chunk per file is enough to catch a file full of garbage without decompressing the whole world
+		if !checkedChunk {
+			err = checkChunk(compression, content[start+5:start+4+length])
+			if err != nil {
+				return fmt.Errorf("chunk %d: %v", i, err)
+			}
+			checkedChunk = true
+		}
+	}
+
+	return nil
+}
+
+// Decompresses a chunk and checks that it is valid NBT
+// LZ4 and custom compression can't be read without extra dependencies, so those chunks only get the table checks
+func checkChunk(compression byte, data []byte) error {
+
+	var reader io.Reader
+	var err error
+
+	switch compression {
+	case regionGzip:
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case regionZlib:
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	case regionUncompressed:
+		reader = bytes.NewReader(data)
+	case regionLZ4, regionCustom:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression type %d", compression)
+	}
+	if err != nil {
+		return fmt.Errorf("could not decompress: %v", err)
+	}
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("could not decompress: %v", err)
+	}
+
+	_, err = parseNBT(decompressed)
+	if err != nil {
+		return fmt.Errorf("invalid NBT: %v", err)
+	}
+
+	return nil
+}
+
+// Picks up to regionSampleSize region files spread evenly across the archive listing
+func sampleRegionFiles(entries []string) []string {
+
+	var regions []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry, ".mca") {
+			regions = append(regions, entry)
+		}
+	}
+
+	if len(regions) <= regionSampleSize {
+		return regions
+	}
+
+	sample := make([]string, 0, regionSampleSize)
+	for i := 0; i < regionSampleSize; i++ {
+		sample = append(sample, regions[i*len(regions)/regionSampleSize])
+	}
+
+	return sample
+}
+
+// Extracts the archive and runs the structural checks on level.dat and a sample of region files
+func deepVerify(archivePath string, dictionaryPath string, verifyDir string, dirName string, entries []string, check func(string, error)) {
+
+	extractDir := filepath.Join(verifyDir, "extracted")
+
+	err := os.Mkdir(extractDir, 0755)
+	if err == nil {
+		err = extractArchive(archivePath, dictionaryPath, extractDir)
+	}
+	check("archive extracts", err)
+	if err != nil {
+		return
+	}
+
+	check("level.dat is valid NBT", checkLevelDat(filepath.Join(extractDir, dirName, "level.dat")))
+
+	for _, region := range sampleRegionFiles(entries) {
+		check(fmt.Sprintf("region file %v is valid", region), checkRegionFile(filepath.Join(extractDir, region)))
+	}
+}